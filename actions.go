@@ -0,0 +1,126 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// outputAction is one line of the output of a command with
+// "output-actions: true"
+type outputAction struct {
+	Action   string `json:"action"`
+	Message  string `json:"message,omitempty"`
+	Room     string `json:"room,omitempty"`
+	Reaction string `json:"reaction,omitempty"`
+	Topic    string `json:"topic,omitempty"`
+}
+
+// parseActions decodes the output as newline delimited JSON actions, blank
+// lines are skipped and invalid lines are reported with their number
+func parseActions(output []byte) ([]*outputAction, []error) {
+	actions := make([]*outputAction, 0)
+	errs := make([]error, 0)
+
+	scanner := bufio.NewScanner(bytes.NewReader(output))
+	for line := 1; scanner.Scan(); line++ {
+		text := bytes.TrimSpace(scanner.Bytes())
+		if len(text) == 0 {
+			continue
+		}
+
+		a := &outputAction{}
+		err := json.Unmarshal(text, a)
+		if err == nil {
+			err = a.validate()
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Line %d: %s", line, err))
+			continue
+		}
+		actions = append(actions, a)
+	}
+	if err := scanner.Err(); err != nil {
+		errs = append(errs, err)
+	}
+
+	return actions, errs
+}
+
+func (a *outputAction) validate() error {
+	switch a.Action {
+	case "message":
+		if a.Message == "" {
+			return errors.New("Missing message")
+		}
+	case "react":
+		if a.Reaction == "" {
+			return errors.New("Missing reaction")
+		}
+	case "topic":
+		if a.Topic == "" {
+			return errors.New("Missing topic")
+		}
+	case "":
+		return errors.New("Missing action")
+	default:
+		return errors.New("Unsupported action: " + a.Action)
+	}
+	return nil
+}
+
+// dispatchActions sends the actions the command emitted, in order. Messages
+// go out as replies, reactions are added to the triggering message and topics
+// set on its room unless the action names another room.
+func dispatchActions(pr *passiveResponderConfig, output []byte,
+	source string, m *messageBlock, mentionMode bool,
+	dispatch chan<- *dispatcherRequest) {
+
+	actions, errs := parseActions(output)
+	for _, err := range errs {
+		logger.Warn.Println("Invalid action from", pr.Name+":", err)
+	}
+
+	responder := "Passive Responder: " + pr.Name
+	for _, a := range actions {
+		room := m.Room
+		if a.Room != "" {
+			room = a.Room
+		}
+
+		switch a.Action {
+		case "message":
+			request := passiveReply(pr, pr.sanitizer.sanitize(a.Message),
+				source, m, mentionMode)
+			request.Query.Message.Room = room
+			dispatch <- request
+		case "react":
+			if m.Id == "" {
+				logger.Warn.Println("Reaction from", pr.Name,
+					"dropped, the message has no id")
+				continue
+			}
+			dispatch <- &dispatcherRequest{
+				Query: reactRequest(responder, source, m.Id, m.Room,
+					a.Reaction),
+				Reply: true,
+			}
+		case "topic":
+			dispatch <- &dispatcherRequest{
+				Query: &query{
+					Type:   "command",
+					Source: responder,
+					To:     source,
+					Command: &commandBlock{
+						Action: "topic",
+						Data:   a.Topic,
+						Map:    map[string]string{"room": room},
+					},
+				},
+				Reply: true,
+			}
+		}
+	}
+}
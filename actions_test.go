@@ -0,0 +1,84 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestOutputActionsDispatched(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: poll
+    match: ["^poll$"]
+    cmd: /bin/sh
+    args:
+    - -c
+    - |
+      echo '{"action":"message","message":"lunch?"}'
+      echo '{"action":"react"}'
+      echo '{"action":"react","reaction":"eyes"}'
+      echo '{"action":"topic","topic":"polls","room":"food"}'
+    output-actions: true
+`)
+	dispatch := make(chan *dispatcherRequest, 10)
+
+	m := testMessage("pris poll", "general")
+	m.Id = "msg-1"
+	m.handleMessage("adapter", dispatch)
+
+	got := make([]*query, 0, 3)
+	for len(got) < 3 {
+		select {
+		case req := <-dispatch:
+			got = append(got, req.Query)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Actions missing, got:", len(got))
+		}
+	}
+
+	if q := got[0]; q.Type != "message" || q.Message.Message != "lunch?" ||
+		q.Message.Room != "general" {
+
+		t.Error("Unexpected message:", q.Type, q.Message)
+	}
+	// the react line without a reaction is skipped
+	if q := got[1]; q.Command == nil || q.Command.Action != "react" ||
+		q.Command.Data != "msg-1" || q.Command.Map["reaction"] != "eyes" {
+
+		t.Error("Unexpected reaction:", q.Type, q.Command)
+	}
+	if q := got[2]; q.Command == nil || q.Command.Action != "topic" ||
+		q.Command.Data != "polls" || q.Command.Map["room"] != "food" {
+
+		t.Error("Unexpected topic:", q.Type, q.Command)
+	}
+}
+
+func TestParseActionsReportsInvalidLines(t *testing.T) {
+	actions, errs := parseActions([]byte(`{"action":"message","message":"a"}
+
+not json
+{"action":"shout","message":"b"}
+{"message":"c"}
+`))
+	if len(actions) != 1 || actions[0].Message != "a" {
+		t.Error("Unexpected actions:", actions)
+	}
+
+	// the JSON error itself is up to encoding/json
+	expected := []string{
+		"Line 3: ",
+		"Line 4: Unsupported action: shout",
+		"Line 5: Missing action",
+	}
+	if len(errs) != len(expected) {
+		t.Fatal("Unexpected errors:", errs)
+	}
+	for i, err := range errs {
+		if !strings.HasPrefix(err.Error(), expected[i]) {
+			t.Errorf("Expected %q, got %q", expected[i], err)
+		}
+	}
+}
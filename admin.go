@@ -0,0 +1,614 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"gopkg.in/yaml.v2"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type adminRequest struct {
+	cmd      *commandBlock
+	source   string
+	connMap  *connRegistry
+	dispatch chan<- *dispatcherRequest
+}
+
+type adminHandler func(r *adminRequest) (string, error)
+
+// errAdminPending is returned by handlers that finish their work outside of
+// the dispatcher, they send the reply themselves once done
+var errAdminPending = errors.New("Admin command pending")
+
+var adminHandlers = map[string]adminHandler{
+	"disable":     adminDisable,
+	"enable":      adminEnable,
+	"diagnose":    adminDiagnose,
+	"dryrun":      adminDryRun,
+	"export":      adminExport,
+	"inject":      adminInject,
+	"kick":        adminKick,
+	"logs":        adminLogs,
+	"loglevel":    adminLogLevel,
+	"maintenance": adminMaintenance,
+	"reset":       adminReset,
+	"restore":     adminRestore,
+	"snapshot":    adminSnapshot,
+}
+
+// disabledRooms tracks the rooms passive responders have been disabled in at
+// runtime, keyed by responder name, guarded by routeLock. It's kept in the
+// state store under disabledRoomsState when state-dir is configured
+var disabledRooms = make(map[string]map[string]bool)
+
+const disabledRoomsState = "disabled-rooms"
+
+// maintenance blocks state changing passive responders, initialized from the
+// config and toggled with the maintenance admin command, guarded by routeLock
+var maintenance bool
+
+// handleAdmin runs in the dispatcher, it returns the reply to send to the
+// requester, or nil if the reply will be sent later
+func (c *commandBlock) handleAdmin(source string,
+	connMap *connRegistry,
+	dispatch chan<- *dispatcherRequest) *query {
+
+	r := &adminRequest{
+		cmd:      c,
+		source:   source,
+		connMap:  connMap,
+		dispatch: dispatch,
+	}
+
+	result, err := r.run()
+	if err == errAdminPending {
+		return nil
+	}
+
+	return r.reply(result, err)
+}
+
+func (r *adminRequest) run() (string, error) {
+	if conf.AdminSecret == "" {
+		return "", errors.New("Admin commands are disabled")
+	}
+
+	err := checkAuth(r.cmd.Time, r.cmd.Data, r.source, conf.AdminSecret)
+	if err != nil {
+		return "", err
+	}
+
+	handler, ok := adminHandlers[r.cmd.Type]
+	if !ok {
+		return "", errors.New("Unknown admin command: " + r.cmd.Type)
+	}
+
+	return handler(r)
+}
+
+func (r *adminRequest) reply(result string, err error) *query {
+	reply := &query{
+		Type:   "command",
+		Source: "server",
+		To:     r.source,
+		Command: &commandBlock{
+			Id:     r.cmd.Id,
+			Action: "admin",
+			Type:   r.cmd.Type,
+			Data:   result,
+		},
+	}
+
+	if err != nil {
+		logger.Error.Println("Admin command failed:", r.cmd.Type, err)
+		reply.Command.Error = err.Error()
+	} else {
+		logger.Warn.Println("Admin command executed by", r.source+":",
+			r.cmd.Type)
+	}
+
+	return reply
+}
+
+func adminDisable(r *adminRequest) (string, error) {
+	name, room, err := r.cmd.responderRoom()
+	if err != nil {
+		return "", err
+	}
+
+	routeLock.Lock()
+	if disabledRooms[name] == nil {
+		disabledRooms[name] = make(map[string]bool)
+	}
+	disabledRooms[name][room] = true
+	err = saveDisabledRooms()
+	routeLock.Unlock()
+
+	return "Responder " + name + " disabled in " + room, err
+}
+
+func adminEnable(r *adminRequest) (string, error) {
+	name, room, err := r.cmd.responderRoom()
+	if err != nil {
+		return "", err
+	}
+
+	routeLock.Lock()
+	delete(disabledRooms[name], room)
+	if len(disabledRooms[name]) == 0 {
+		delete(disabledRooms, name)
+	}
+	err = saveDisabledRooms()
+	routeLock.Unlock()
+
+	return "Responder " + name + " enabled in " + room, err
+}
+
+// saveDisabledRooms persists disabledRooms if there's a state store, the
+// caller holds routeLock
+func saveDisabledRooms() error {
+	if stateStore == nil {
+		return nil
+	}
+
+	data, err := json.Marshal(disabledRooms)
+	if err != nil {
+		return err
+	}
+	if err := stateStore.put(disabledRoomsState, data); err != nil {
+		return errors.New("Unable to persist disabled rooms: " + err.Error())
+	}
+	return nil
+}
+
+// loadDisabledRooms restores the disabled rooms persisted by an earlier run,
+// nothing persisted yet isn't an error
+func loadDisabledRooms() error {
+	if stateStore == nil {
+		return nil
+	}
+
+	data, err := stateStore.get(disabledRoomsState)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	rooms := make(map[string]map[string]bool)
+	if err := json.Unmarshal(data, &rooms); err != nil {
+		return err
+	}
+
+	routeLock.Lock()
+	disabledRooms = rooms
+	routeLock.Unlock()
+	return nil
+}
+
+// adminDiagnose runs the test input of every passive responder that has one
+// and pings the connections owning active responders, the commands run and
+// the pongs are waited for outside the dispatcher so it isn't held up.
+// State-changing responders only run when the request opts in with
+// "state-changing", and never in maintenance mode.
+func adminDiagnose(r *adminRequest) (string, error) {
+	report := make([]string, 0)
+	failed := 0
+
+	timeout := 5 * time.Second
+	if seconds, err := strconv.Atoi(r.cmd.Map["timeout"]); err == nil &&
+		seconds > 0 {
+
+		timeout = time.Duration(seconds) * time.Second
+	}
+	runStateChanging, _ := strconv.ParseBool(r.cmd.Map["state-changing"])
+
+	routeLock.RLock()
+	sources := make(map[string]bool)
+	for _, arl := range []*list.List{prefixAResponders, noPrefixAResponders,
+		mentionAResponders, unhandledAResponders} {
+
+		for eAr := arl.Front(); eAr != nil; eAr = eAr.Next() {
+			sources[eAr.Value.(*activeResponderConfig).source] = true
+		}
+	}
+	passive := make([]*passiveResponderConfig, 0)
+	for _, pr := range conf.Responders.Passive {
+		if pr.TestInput != "" {
+			passive = append(passive, pr)
+		}
+	}
+	inMaintenance := maintenance
+	routeLock.RUnlock()
+
+	active := make([]string, 0, len(sources))
+	for source := range sources {
+		active = append(active, source)
+	}
+	sort.Strings(active)
+
+	type sentPing struct {
+		source   string
+		id       string
+		answered <-chan struct{}
+	}
+	sent := make([]sentPing, 0, len(active))
+	for _, source := range active {
+		encoder, ok := r.connMap.get(source)
+		if !ok {
+			report = append(report, "active "+source+": FAILED (not connected)")
+			failed++
+			continue
+		}
+		id, answered := pings.ping(encoder, source)
+		sent = append(sent, sentPing{source, id, answered})
+	}
+
+	go func() {
+		for _, pr := range passive {
+			switch {
+			case pr.StateChanging && inMaintenance:
+				report = append(report, "passive "+pr.Name+
+					": skipped (state-changing, maintenance mode)")
+			case pr.StateChanging && !runStateChanging:
+				report = append(report, "passive "+pr.Name+
+					": skipped (state-changing)")
+			default:
+				if err := pr.diagnose(); err != nil {
+					report = append(report,
+						fmt.Sprintf("passive %s: FAILED (%s)", pr.Name, err))
+					failed++
+				} else {
+					report = append(report, "passive "+pr.Name+": ok")
+				}
+			}
+		}
+
+		deadline := time.After(timeout)
+		for _, p := range sent {
+			select {
+			case <-p.answered:
+				report = append(report, "active "+p.source+": answered ping")
+			case <-deadline:
+				pings.forget(p.id)
+				report = append(report,
+					"active "+p.source+": FAILED (no answer to ping)")
+				failed++
+			}
+		}
+
+		var err error
+		if failed > 0 {
+			err = fmt.Errorf("%d of %d checks failed", failed, len(report))
+		}
+
+		r.dispatch <- &dispatcherRequest{
+			Query: r.reply(strings.Join(report, "\n"), err),
+			Reply: true,
+		}
+	}()
+
+	return "", errAdminPending
+}
+
+func adminDryRun(r *adminRequest) (string, error) {
+	m, err := r.cmd.adminMessage()
+	if err != nil {
+		return "", err
+	}
+
+	return strings.Join(m.dryRun(), "\n"), nil
+}
+
+// adminInject hands a synthetic message to the workers exactly as if the sink
+// connection, the requester by default, sent it as an adapter, so responders
+// fire for real and their replies go to the sink
+func adminInject(r *adminRequest) (string, error) {
+	if !conf.AdminInject {
+		return "", errors.New("Message injection is disabled")
+	}
+
+	m, err := r.cmd.adminMessage()
+	if err != nil {
+		return "", err
+	}
+
+	sink := r.cmd.Map["sink"]
+	if sink == "" {
+		sink = r.source
+	}
+	if _, ok := r.connMap.get(sink); !ok {
+		return "", errors.New("No such connection: " + sink)
+	}
+
+	logger.Warn.Println("Message injected by", r.source, "as", sink)
+	workers.submit(sink, func() {
+		defer recoverJob(m)
+		m.handleMessage(sink, r.dispatch)
+	})
+
+	return "Message injected as " + sink, nil
+}
+
+// adminMessage builds the message described by the map of a dryrun or inject
+func (c *commandBlock) adminMessage() (*messageBlock, error) {
+	if c.Map["message"] == "" {
+		return nil, errors.New("Missing message")
+	}
+
+	m := &messageBlock{
+		Message:    c.Map["message"],
+		Stripped:   c.Map["message"],
+		Room:       c.Map["room"],
+		From:       c.Map["from"],
+		Visibility: c.Map["visibility"],
+		Locale:     c.Map["locale"],
+	}
+	m.Mentioned, _ = strconv.ParseBool(c.Map["mentioned"])
+	m.IsBot, _ = strconv.ParseBool(c.Map["is_bot"])
+	m.IsDM, _ = strconv.ParseBool(c.Map["is_dm"])
+
+	return m, nil
+}
+
+// adminExport serializes the running config, secrets are left out and the
+// current maintenance setting is included. Runtime state the config can't
+// express, active responders and rooms responders are disabled in, is listed
+// in comments.
+func adminExport(r *adminRequest) (string, error) {
+	routeLock.RLock()
+	exported := conf
+	exported.Responders = redactResponders(conf.Responders)
+	routeLock.RUnlock()
+
+	exported.Secret = ""
+	exported.AdminSecret = ""
+	// responders loaded from the directory are part of the passive list
+	exported.ResponderDir = ""
+	exported.Maintenance = inMaintenance()
+
+	if conf.Webhook != nil {
+		webhook := *conf.Webhook
+		webhook.Secret = ""
+		exported.Webhook = &webhook
+	}
+
+	if conf.AuthHook != nil {
+		hook := *conf.AuthHook
+		hook.Args = make([]string, len(conf.AuthHook.Args))
+		for i := range hook.Args {
+			hook.Args[i] = "REDACTED"
+		}
+		exported.AuthHook = &hook
+	}
+
+	out, err := yaml.Marshal(&exported)
+	if err != nil {
+		return "", err
+	}
+
+	comments := make([]string, 0)
+
+	routeLock.RLock()
+	for _, group := range []struct {
+		name string
+		arl  *list.List
+	}{
+		{"prefix", prefixAResponders},
+		{"noprefix", noPrefixAResponders},
+		{"mention", mentionAResponders},
+		{"unhandled", unhandledAResponders},
+	} {
+		for eAr := group.arl.Front(); eAr != nil; eAr = eAr.Next() {
+			ar := eAr.Value.(*activeResponderConfig)
+			comments = append(comments, fmt.Sprintf(
+				"# active %s responder from %s: %s", group.name, ar.source,
+				ar.regex))
+		}
+	}
+
+	for name, rooms := range disabledRooms {
+		for room := range rooms {
+			comments = append(comments,
+				"# passive responder "+name+" disabled in "+room)
+		}
+	}
+	routeLock.RUnlock()
+
+	sort.Strings(comments)
+	if len(comments) > 0 {
+		comments = append([]string{
+			"# runtime state not expressed in the config above:"}, comments...)
+	}
+
+	return string(out) + strings.Join(comments, "\n"), nil
+}
+
+// redactResponders copies the passive responders for the export with the
+// values of their env and http headers replaced, the running config is left
+// as is
+func redactResponders(rc *responderConfig) *responderConfig {
+	if rc == nil {
+		return nil
+	}
+
+	redacted := &responderConfig{
+		Passive: make([]*passiveResponderConfig, len(rc.Passive)),
+	}
+	for i, pr := range rc.Passive {
+		copied := *pr
+		copied.Env = redactValues(pr.Env)
+		copied.Headers = redactValues(pr.Headers)
+		redacted.Passive[i] = &copied
+	}
+	return redacted
+}
+
+// redactValues keeps the names and replaces every value
+func redactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+
+	redacted := make(map[string]string, len(values))
+	for name := range values {
+		redacted[name] = "REDACTED"
+	}
+	return redacted
+}
+
+// adminKick disengages the connection with the id given in "source", or
+// every connection engaged under the "name" or given the "label" by the auth
+// hook, each is sent a terminate and closed, its serve() then disengages it
+// as if the client disconnected, which deregisters its active responders
+func adminKick(r *adminRequest) (string, error) {
+	var sources []string
+	switch {
+	case r.cmd.Map["source"] != "":
+		sources = []string{r.cmd.Map["source"]}
+	case r.cmd.Map["name"] != "" || r.cmd.Map["label"] != "":
+		sources = r.connMap.lookup(r.cmd.Map["name"], r.cmd.Map["label"])
+		if len(sources) == 0 {
+			return "", errors.New("No connection with that name or label")
+		}
+	default:
+		return "", errors.New("Missing source, name or label")
+	}
+
+	for _, source := range sources {
+		if err := r.kick(source); err != nil {
+			return "", err
+		}
+	}
+
+	return "Disengaged: " + strings.Join(sources, ", "), nil
+}
+
+func (r *adminRequest) kick(source string) error {
+	encoder, ok := r.connMap.get(source)
+	if !ok {
+		return errors.New("No such connection: " + source)
+	}
+
+	encoder.Encode(&query{
+		Type:   "command",
+		Source: "server",
+		To:     source,
+		Command: &commandBlock{
+			Action: "terminate",
+			Data:   "Disengaged by admin",
+		},
+	})
+
+	if !r.connMap.close(source) {
+		return errors.New("Unable to close connection: " + source)
+	}
+
+	logger.Warn.Println("Connection", source, "kicked by", r.source)
+	return nil
+}
+
+func adminLogs(r *adminRequest) (string, error) {
+	if logBuffer == nil {
+		return "", errors.New("Log buffer is disabled")
+	}
+
+	lines := 50
+	if r.cmd.Map["lines"] != "" {
+		n, err := strconv.Atoi(r.cmd.Map["lines"])
+		if err != nil || n < 1 {
+			return "", errors.New("Invalid number of lines: " +
+				r.cmd.Map["lines"])
+		}
+		lines = n
+	}
+
+	level := r.cmd.Map["level"]
+	if level != "" && levelRank(level) < 0 {
+		return "", errors.New("Invalid log level: " + level)
+	}
+
+	return strings.Join(logBuffer.tail(lines, level), "\n"), nil
+}
+
+func adminLogLevel(r *adminRequest) (string, error) {
+	previous := logLevel()
+	if err := setLogLevel(r.cmd.Map["level"]); err != nil {
+		return "", err
+	}
+
+	return "Log level changed from " + previous + " to " + r.cmd.Map["level"],
+		nil
+}
+
+func adminMaintenance(r *adminRequest) (string, error) {
+	enabled, err := strconv.ParseBool(r.cmd.Map["enabled"])
+	if err != nil {
+		return "", errors.New("Invalid maintenance setting: " +
+			r.cmd.Map["enabled"])
+	}
+
+	routeLock.Lock()
+	maintenance = enabled
+	routeLock.Unlock()
+
+	if enabled {
+		return "Maintenance mode enabled", nil
+	}
+	return "Maintenance mode disabled", nil
+}
+
+// adminReset clears the info request rate limit of a responder, or of all of
+// them, it's the only per responder limit the server keeps
+func adminReset(r *adminRequest) (string, error) {
+	source := r.cmd.Map["source"]
+	infoAccess.reset(source)
+
+	if source == "" {
+		return "Rate limits reset for all responders", nil
+	}
+	return "Rate limit reset for " + source, nil
+}
+
+func inMaintenance() bool {
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+
+	return maintenance
+}
+
+func (c *commandBlock) responderRoom() (string, string, error) {
+	name, room := c.Map["responder"], c.Map["room"]
+
+	if name == "" || room == "" {
+		return "", "", errors.New("Missing responder or room")
+	}
+
+	if findPassiveResponder(name) == nil {
+		return "", "", errors.New("No such passive responder: " + name)
+	}
+
+	return name, room, nil
+}
+
+func findPassiveResponder(name string) *passiveResponderConfig {
+	for _, pr := range conf.Responders.Passive {
+		if pr.Name == name {
+			return pr
+		}
+	}
+	return nil
+}
+
+func (pr *passiveResponderConfig) disabledIn(room string) bool {
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+
+	return disabledRooms[pr.Name][room]
+}
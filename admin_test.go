@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"gopkg.in/yaml.v2"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestExportRedactsResponderEnv(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/true
+    env:
+      DEPLOY_TOKEN: s3cr3t-token
+`)
+
+	out, err := adminExport(&adminRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(out, "s3cr3t-token") {
+		t.Fatal("Env value exported:", out)
+	}
+	if !strings.Contains(out, "DEPLOY_TOKEN: REDACTED") {
+		t.Fatal("Env name missing from the export:", out)
+	}
+	if conf.Responders.Passive[0].Env["DEPLOY_TOKEN"] != "s3cr3t-token" {
+		t.Fatal("Export changed the running config")
+	}
+}
+
+func TestLogBufferRedactsResponderEnv(t *testing.T) {
+	logBuffer = newLogRing(10)
+	defer func() { logBuffer = nil }()
+
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/true
+    env:
+      DEPLOY_TOKEN: s3cr3t-token
+      DEPLOY_ENV: prod
+`)
+
+	logBuffer.add("error", "running with s3cr3t-token in prod")
+	line := logBuffer.tail(1, "debug")[0]
+	if line != "running with [REDACTED] in prod" {
+		t.Fatal("Unexpected log line:", line)
+	}
+}
+
+func TestExportRedactsHeadersAndHookArgs(t *testing.T) {
+	setupTest(t, `
+auth-hook:
+  cmd: /usr/local/bin/check-token
+  args: ["--api-key", "hook-s3cr3t"]
+responders:
+  passive:
+  - name: weather
+    match: ["^weather$"]
+    type: http
+    url: "https://weather.internal/lookup"
+    headers:
+      Authorization: "Bearer header-s3cr3t"
+`)
+
+	out, err := adminExport(&adminRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, secret := range []string{"hook-s3cr3t", "header-s3cr3t"} {
+		if strings.Contains(out, secret) {
+			t.Fatal("Secret exported:", out)
+		}
+	}
+	if !strings.Contains(out, "Authorization: REDACTED") {
+		t.Fatal("Header name missing from the export:", out)
+	}
+	if conf.AuthHook.Args[1] != "hook-s3cr3t" ||
+		conf.Responders.Passive[0].Headers["Authorization"] !=
+			"Bearer header-s3cr3t" {
+
+		t.Fatal("Export changed the running config")
+	}
+}
+
+// pongEncoder stands in for a connection, it answers pings when alive
+type pongEncoder struct {
+	alive bool
+}
+
+func (e *pongEncoder) Encode(v interface{}) error {
+	if q := v.(*query); e.alive && q.Command != nil &&
+		q.Command.Action == "ping" {
+
+		go pings.answered(q.Command.Id)
+	}
+	return nil
+}
+
+func TestDiagnoseReportsFailures(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: healthy
+    match: ["^healthy$"]
+    cmd: /bin/true
+    test-input: healthy
+  - name: broken
+    match: ["^broken$"]
+    cmd: /bin/false
+    test-input: broken
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/false
+    test-input: deploy
+    state-changing: true
+`)
+
+	connMap := newConnRegistry()
+	for id, alive := range map[string]bool{"alive": true, "stuck": false} {
+		connMap.claim(id, &connEntry{
+			sender: newConnSender(&pongEncoder{alive}, nil, 10),
+		})
+		connMap.conns[id].sender.start()
+		prefixAResponders.PushBack(&activeResponderConfig{source: id})
+	}
+	prefixAResponders.PushBack(&activeResponderConfig{source: "gone"})
+
+	dispatch := make(chan *dispatcherRequest, 1)
+	_, err := adminDiagnose(&adminRequest{
+		cmd: &commandBlock{Type: "diagnose",
+			Map: map[string]string{"timeout": "1"}},
+		connMap:  connMap,
+		dispatch: dispatch,
+	})
+	if err != errAdminPending {
+		t.Fatal("Diagnose didn't run in the background:", err)
+	}
+
+	var reply *commandBlock
+	select {
+	case req := <-dispatch:
+		reply = req.Query.Command
+	case <-time.After(5 * time.Second):
+		t.Fatal("No diagnose report")
+	}
+
+	for _, line := range []string{
+		"passive healthy: ok",
+		"passive broken: FAILED",
+		"passive deploy: skipped (state-changing)",
+		"active alive: answered ping",
+		"active stuck: FAILED (no answer to ping)",
+		"active gone: FAILED (not connected)",
+	} {
+		if !strings.Contains(reply.Data, line) {
+			t.Fatalf("Report is missing %q:\n%s", line, reply.Data)
+		}
+	}
+	if reply.Error != "3 of 6 checks failed" {
+		t.Fatal("Unexpected error:", reply.Error)
+	}
+}
+
+func TestDisabledRoomOnlyBlocksThatRoom(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+    args: ["hi"]
+`)
+
+	_, err := adminDisable(&adminRequest{cmd: &commandBlock{
+		Map: map[string]string{"responder": "hello", "room": "quiet"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris hello", "quiet").handleMessage("adapter", dispatch)
+	for _, reply := range collectReplies(t, dispatch, 1, 500*time.Millisecond) {
+		if reply == "hi" {
+			t.Fatal("Responder fired in the room it's disabled in")
+		}
+	}
+
+	testMessage("pris hello", "lobby").handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 ||
+		got[0] != "hi" {
+
+		t.Fatal("Responder didn't fire in another room:", got)
+	}
+}
+
+func TestDisabledRoomsPersisted(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+`)
+
+	dir, err := ioutil.TempDir("", "priscilla-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if stateStore, err = newFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	rooms := map[string]string{"responder": "hello", "room": "quiet"}
+	for _, handler := range []adminHandler{adminDisable, adminEnable,
+		adminDisable} {
+
+		if _, err := handler(&adminRequest{
+			cmd: &commandBlock{Map: rooms}}); err != nil {
+
+			t.Fatal(err)
+		}
+	}
+
+	// a restart starts out with nothing disabled
+	disabledRooms = make(map[string]map[string]bool)
+	if err := loadDisabledRooms(); err != nil {
+		t.Fatal(err)
+	}
+	if !findPassiveResponder("hello").disabledIn("quiet") {
+		t.Fatal("Disabled room lost across the restart:", disabledRooms)
+	}
+}
+
+type closeRecorder struct {
+	closed chan struct{}
+}
+
+func (c *closeRecorder) Close() error {
+	close(c.closed)
+	return nil
+}
+
+func TestKickByNameAndLabel(t *testing.T) {
+	setupTest(t, "")
+
+	connMap := newConnRegistry()
+	closers := make(map[string]*closeRecorder)
+	encoders := make(map[string]*recordEncoder)
+	for _, c := range []struct {
+		name   string
+		labels []string
+	}{
+		{"slack", []string{"chat"}},
+		{"slack", []string{"chat"}},
+		{"deploy", []string{"ops"}},
+		{"build", []string{"ops", "ci"}},
+	} {
+		encoder, closer := &recordEncoder{}, &closeRecorder{make(chan struct{})}
+		sender := newConnSender(encoder, nil, 10)
+		sender.start()
+		id := connMap.claim(c.name, &connEntry{sender: sender, closer: closer,
+			name: c.name, labels: c.labels})
+		closers[id], encoders[id] = closer, encoder
+	}
+
+	kick := func(key, value string) []string {
+		t.Helper()
+		before := connMap.ids()
+
+		_, err := adminKick(&adminRequest{
+			cmd:     &commandBlock{Map: map[string]string{key: value}},
+			connMap: connMap,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		kicked := make([]string, 0)
+		for _, id := range before {
+			select {
+			case <-closers[id].closed:
+				kicked = append(kicked, id)
+				connMap.remove(id)
+			case <-time.After(100 * time.Millisecond):
+			}
+		}
+		return kicked
+	}
+
+	// the second slack connection got a random id, the name still finds it
+	if kicked := kick("name", "slack"); len(kicked) != 2 {
+		t.Fatal("Expected both slack connections kicked, got", kicked)
+	}
+	if kicked := kick("label", "ops"); len(kicked) != 2 {
+		t.Fatal("Expected both ops connections kicked, got", kicked)
+	}
+	if len(connMap.ids()) != 0 {
+		t.Fatal("Connections left:", connMap.ids())
+	}
+	for id, encoder := range encoders {
+		if len(encoder.sent) != 1 ||
+			encoder.sent[0].Command.Action != "terminate" {
+
+			t.Fatal(id, "wasn't sent terminate:", encoder.sent)
+		}
+	}
+
+	_, err := adminKick(&adminRequest{
+		cmd:     &commandBlock{Map: map[string]string{"label": "ops"}},
+		connMap: connMap,
+	})
+	if err == nil {
+		t.Fatal("Kick without a match succeeded")
+	}
+}
+
+func TestLogsTailFilteredByLevel(t *testing.T) {
+	logBuffer = newLogRing(4, "s3cr3t")
+	defer func() { logBuffer = nil }()
+
+	for i, level := range []string{"error", "debug", "warn", "info", "error",
+		"debug", "warn"} {
+
+		logBuffer.add(level, level+" "+strconv.Itoa(i)+" s3cr3t")
+	}
+
+	for _, test := range []struct {
+		opts map[string]string
+		out  string
+	}{
+		// the first three lines are past the buffer size
+		{map[string]string{}, "info 3 [REDACTED]\nerror 4 [REDACTED]\n" +
+			"debug 5 [REDACTED]\nwarn 6 [REDACTED]"},
+		{map[string]string{"level": "warn"},
+			"error 4 [REDACTED]\nwarn 6 [REDACTED]"},
+		{map[string]string{"level": "info", "lines": "2"},
+			"error 4 [REDACTED]\nwarn 6 [REDACTED]"},
+	} {
+		out, err := adminLogs(&adminRequest{cmd: &commandBlock{Map: test.opts}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != test.out {
+			t.Errorf("logs %v returned:\n%s", test.opts, out)
+		}
+	}
+
+	_, err := adminLogs(&adminRequest{
+		cmd: &commandBlock{Map: map[string]string{"level": "loud"}}})
+	if err == nil {
+		t.Fatal("Invalid level accepted")
+	}
+}
+
+func TestDryRunReportsSkipReasons(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+  - name: quiet-hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+  - name: greet
+    match: ["^hello$"]
+    cmd: /bin/echo
+    noprefix: true
+  - name: bye
+    match: ["^bye$"]
+    cmd: /bin/echo
+`)
+
+	if _, err := adminDisable(&adminRequest{cmd: &commandBlock{
+		Map: map[string]string{"responder": "quiet-hello",
+			"room": "quiet"}}}); err != nil {
+
+		t.Fatal(err)
+	}
+
+	out, err := adminDryRun(&adminRequest{cmd: &commandBlock{
+		Map: map[string]string{"message": "pris hello", "room": "quiet"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"passive hello: would fire, matched ^hello$",
+		"passive quiet-hello: skipped, disabled in room quiet",
+		"passive greet: skipped, prefix not expected",
+		"passive bye: skipped, no pattern matched",
+	} {
+		if !strings.Contains(out, line) {
+			t.Errorf("Dry run is missing %q:\n%s", line, out)
+		}
+	}
+}
+
+func TestExportRoundTrip(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ['^deploy (\S+)$']
+    cmd: /usr/local/bin/deploy
+    args: ["__0__"]
+    help: deploy a service
+    help-commands: ["deploy <service>"]
+    state-changing: true
+    timeout: 30
+  - name: weather
+    match: ["^weather$"]
+    mentionmatch: ["weather"]
+    type: http
+    url: "https://weather.internal/lookup"
+    exit-messages:
+      1: no forecast
+  - name: greet
+    match: ["^hello$"]
+    noprefix: true
+    cmd: /bin/echo
+    group: greetings
+    weight: 2
+`)
+	prefixAResponders.PushBack(&activeResponderConfig{source: "deployer",
+		regex: regexp.MustCompile("^rollback$"), helpCmd: "rollback"})
+
+	out, err := adminExport(&adminRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed config
+	if err := parseConfig([]byte(out), &parsed); err != nil {
+		t.Fatal("Export doesn't parse:", err, "\n", out)
+	}
+	if _, err := buildPassive(parsed.Responders); err != nil {
+		t.Fatal("Exported responders don't load:", err)
+	}
+
+	expected, _ := yaml.Marshal(conf.Responders.Passive)
+	got, _ := yaml.Marshal(parsed.Responders.Passive)
+	if string(got) != string(expected) {
+		t.Fatalf("Responders changed in the round trip:\n%s\nexpected:\n%s",
+			got, expected)
+	}
+	if !strings.Contains(out, "^rollback$") {
+		t.Error("Active responder missing from the export:\n", out)
+	}
+}
+
+// syncBuffer collects log output, loggers may be written from any goroutine
+type syncBuffer struct {
+	lock sync.Mutex
+	buf  bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.buf.String()
+}
+
+func TestLogLevelChangedAtRuntime(t *testing.T) {
+	out := &syncBuffer{}
+	logOutput = out
+	defer func() {
+		logOutput = ioutil.Discard
+		setLogLevel("error")
+	}()
+	if err := setLogLevel("error"); err != nil {
+		t.Fatal(err)
+	}
+
+	logger.Debug.Println("before the change")
+	reply, err := adminLogLevel(&adminRequest{
+		cmd: &commandBlock{Map: map[string]string{"level": "debug"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Log level changed from error to debug" {
+		t.Error("Unexpected reply:", reply)
+	}
+	logger.Debug.Println("after the change")
+
+	if strings.Contains(out.String(), "before the change") ||
+		!strings.Contains(out.String(), "after the change") {
+
+		t.Fatal("Debug lines not switched on:", out.String())
+	}
+	if logLevel() != "debug" {
+		t.Fatal("Level reported as", logLevel())
+	}
+
+	_, err = adminLogLevel(&adminRequest{
+		cmd: &commandBlock{Map: map[string]string{"level": "loud"}}})
+	if err == nil || logLevel() != "debug" {
+		t.Fatal("Invalid level accepted")
+	}
+}
+
+func TestInjectedMessageRepliesToSink(t *testing.T) {
+	setupTest(t, `
+admin-secret: admin-secret
+responders:
+  passive:
+  - name: hello
+    match: ["^hello (\\w+)$"]
+    cmd: /bin/echo
+    args: ["hello", "__0__"]
+`)
+	dispatch := startDispatcher(t)
+
+	sink := engageAs(t, dispatch, "test-sink", "adapter")
+	ops := engageAs(t, dispatch, "ops", "responder")
+
+	inject := func() *query {
+		now := time.Now().Unix()
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: "ops",
+			Command: &commandBlock{Id: "inject-1", Action: "admin",
+				Type: "inject", Time: now,
+				Data: authData(now, "ops", conf.AdminSecret),
+				Map: map[string]string{"message": "pris hello world",
+					"room": "qa", "from": "tester", "sink": "test-sink"}},
+		}}
+		return ops.next(t, "admin")
+	}
+
+	if q := inject(); q.Command.Error != "Message injection is disabled" {
+		t.Fatal("Injected while disabled:", *q.Command)
+	}
+
+	conf.AdminInject = true
+	if q := inject(); q.Command.Error != "" ||
+		q.Command.Data != "Message injected as test-sink" {
+
+		t.Fatal("Inject failed:", *q.Command)
+	}
+
+	q := sink.next(t, "message")
+	if q.Message.Message != "hello world" || q.Message.Room != "qa" {
+		t.Fatal("Unexpected reply at the sink:", *q.Message)
+	}
+
+	// the injected message's job is done with the config once the next one
+	// for the sink runs
+	done := make(chan struct{})
+	workers.submit("test-sink", func() { close(done) })
+	<-done
+}
+
+func TestResetRateLimits(t *testing.T) {
+	setupTest(t, "")
+	infoAccess, _ = newInfoGuard(&infoRequestsConfig{Rate: 1})
+
+	exhaust := func(sources ...string) {
+		t.Helper()
+		for _, source := range sources {
+			infoAccess.check(source, nil)
+			if infoAccess.check(source, nil) == nil {
+				t.Fatal("Rate limit not reached for", source)
+			}
+		}
+	}
+
+	exhaust("directory", "lookup")
+	reply, err := adminReset(&adminRequest{cmd: &commandBlock{
+		Map: map[string]string{"source": "directory"}}})
+	if err != nil || reply != "Rate limit reset for directory" {
+		t.Fatal("Unexpected reset:", reply, err)
+	}
+	if err := infoAccess.check("directory", nil); err != nil {
+		t.Fatal("Reset responder still limited:", err)
+	}
+	if infoAccess.check("lookup", nil) == nil {
+		t.Fatal("Other responder's limit reset too")
+	}
+
+	exhaust("directory")
+	reply, err = adminReset(&adminRequest{cmd: &commandBlock{}})
+	if err != nil || reply != "Rate limits reset for all responders" {
+		t.Fatal("Unexpected reset:", reply, err)
+	}
+	for _, source := range []string{"directory", "lookup"} {
+		if err := infoAccess.check(source, nil); err != nil {
+			t.Fatal("Responder still limited after resetting all:", source)
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type authHookConfig struct {
+	Cmd     string   `yaml:"cmd"`
+	Args    []string `yaml:"args"`
+	Timeout int      `yaml:"timeout"`
+}
+
+// authResult is the outcome of the auth hook for an engagement, labels are
+// what the hook printed on success
+type authResult struct {
+	labels []string
+	err    error
+}
+
+// authenticate runs the auth hook for the engagement, with the credential
+// from the "data" field on its stdin. The hook accepts the engagement by
+// exiting with 0, anything else, including running past the timeout, rejects
+// it.
+func (h *authHookConfig) authenticate(c *commandBlock,
+	source string) *authResult {
+
+	cmd := exec.Command(h.Cmd, h.Args...)
+	cmd.Env = append(os.Environ(),
+		"PRISCILLA_SOURCE="+source,
+		"PRISCILLA_TYPE="+c.Type,
+		"PRISCILLA_TIME="+strconv.FormatInt(c.Time, 10))
+	cmd.Stdin = strings.NewReader(c.Data)
+	setProcessGroup(cmd)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		logger.Error.Println("Unable to run auth hook:", err)
+		return &authResult{err: errors.New("Authentication unavailable")}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			logger.Warn.Println("Auth hook rejected", source+":", err,
+				strings.TrimSpace(stderr.String()))
+			return &authResult{err: errors.New("Authentication failed")}
+		}
+	case <-time.After(time.Duration(h.Timeout) * time.Second):
+		killProcessGroup(cmd)
+		logger.Error.Println("Auth hook timed out for", source)
+		return &authResult{err: errors.New("Authentication timed out")}
+	}
+
+	return &authResult{labels: strings.Fields(stdout.String())}
+}
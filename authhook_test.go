@@ -0,0 +1,45 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestAuthHook(t *testing.T) {
+	setupTest(t, "")
+	conf.AuthHook = &authHookConfig{
+		Cmd: "/bin/sh",
+		Args: []string{"-c", `token=$(cat)
+case "$token" in
+good) echo "directory ops" ;;
+slow) sleep 5 ;;
+*) exit 1 ;;
+esac`},
+		Timeout: 1,
+	}
+
+	for _, test := range []struct {
+		hook   *authHookConfig
+		data   string
+		labels string
+		err    string
+	}{
+		{conf.AuthHook, "good", "directory,ops", ""},
+		{conf.AuthHook, "forged", "", "Authentication failed"},
+		{conf.AuthHook, "slow", "", "Authentication timed out"},
+		{&authHookConfig{Cmd: "/nonexistent/hook", Timeout: 1}, "good", "",
+			"Authentication unavailable"},
+	} {
+		c := &commandBlock{Action: "engage", Type: "responder",
+			Data: test.data}
+		auth := test.hook.authenticate(c, "directory")
+
+		msg := ""
+		if err := c.engageChk("directory", "", auth); err != nil {
+			msg = err.Error()
+		}
+		if msg != test.err || strings.Join(auth.labels, ",") != test.labels {
+			t.Errorf("%s: error %q, labels %v", test.data, msg, auth.labels)
+		}
+	}
+}
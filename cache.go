@@ -0,0 +1,87 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+	"sync"
+	"time"
+)
+
+type cacheConfig struct {
+	Ttl  int `yaml:"ttl"`
+	Size int `yaml:"size"`
+}
+
+// outputCache keeps the output of successful runs of a passive command, keyed
+// by the resolved arguments and environment, for ttl. It holds at most size
+// entries, the least recently used one is evicted to make room.
+type outputCache struct {
+	lock    sync.Mutex
+	ttl     time.Duration
+	size    int
+	entries map[string]*list.Element
+	lru     *list.List
+}
+
+type cacheEntry struct {
+	key     string
+	output  []byte
+	expires time.Time
+}
+
+func newOutputCache(cc *cacheConfig) *outputCache {
+	return &outputCache{
+		ttl:     time.Duration(cc.Ttl) * time.Second,
+		size:    cc.Size,
+		entries: make(map[string]*list.Element),
+		lru:     list.New(),
+	}
+}
+
+func cacheKey(args, env []string) string {
+	return strings.Join(args, "\x00") + "\x01" + strings.Join(env, "\x00")
+}
+
+func (c *outputCache) get(key string) ([]byte, bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+
+	entry := e.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.lru.Remove(e)
+		delete(c.entries, key)
+		return nil, false
+	}
+
+	c.lru.MoveToFront(e)
+	return entry.output, true
+}
+
+func (c *outputCache) put(key string, output []byte) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	entry := &cacheEntry{
+		key:     key,
+		output:  output,
+		expires: time.Now().Add(c.ttl),
+	}
+
+	if e, ok := c.entries[key]; ok {
+		e.Value = entry
+		c.lru.MoveToFront(e)
+		return
+	}
+
+	c.entries[key] = c.lru.PushFront(entry)
+	for c.lru.Len() > c.size {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+)
+
+// protocolVersion is the version of the client protocol this server speaks,
+// clients that don't send one are taken to speak version 1
+const protocolVersion = 2
+
+// serverFeatures are the optional parts of the protocol this server supports,
+// sent to clients in "proceed"
+var serverFeatures = []string{
+	"framed",
+	"ping",
+	"server-info",
+	"list-responders",
+	"deregister",
+	"handoff",
+}
+
+// clientProtocol is the protocol version the client asked for in the "map"
+// of its engagement
+func (c *commandBlock) clientProtocol() (int, error) {
+	v, ok := c.Map["protocol"]
+	if !ok {
+		return 1, nil
+	}
+
+	version, err := strconv.Atoi(v)
+	if err != nil || version < 1 {
+		return 0, fmt.Errorf("Invalid protocol version: %q", v)
+	}
+	return version, nil
+}
+
+// protocolChk rejects clients speaking an older protocol than min-protocol
+func (c *commandBlock) protocolChk() error {
+	version, err := c.clientProtocol()
+	if err != nil {
+		return err
+	}
+
+	if version < conf.MinProtocol {
+		return fmt.Errorf("Protocol version %d is below the minimum %d",
+			version, conf.MinProtocol)
+	}
+	return nil
+}
+
+// clientCapabilities is what the client listed in the "array" of its
+// engagement, nil if it didn't negotiate a protocol version at all
+func (c *commandBlock) clientCapabilities() map[string]bool {
+	if _, ok := c.Map["protocol"]; !ok {
+		return nil
+	}
+
+	capabilities := make(map[string]bool, len(c.Array))
+	for _, capability := range c.Array {
+		capabilities[capability] = true
+	}
+	return capabilities
+}
+
+// supports tells whether the connection announced the capability, clients
+// that didn't negotiate are assumed to support everything, as they always
+// have been
+func (r *connRegistry) supports(id, capability string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entry, ok := r.conns[id]
+	if !ok || entry.caps == nil {
+		return true
+	}
+	return entry.caps[capability]
+}
+
+// negotiated adds the server's side of the negotiation to "proceed"
+func (c *commandBlock) negotiated() {
+	c.Map = map[string]string{"protocol": strconv.Itoa(protocolVersion)}
+	c.Array = serverFeatures
+}
@@ -1,11 +1,13 @@
 package main
 
 import (
+	"container/list"
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/base64"
 	"errors"
 	"fmt"
+	"strconv"
 	"time"
 )
 
@@ -15,10 +17,12 @@ type commandBlock struct {
 	Type    string            `json:"type"`
 	Time    int64             `json:"time,omitempty"`
 	Data    string            `json:"data,omitempty"`
-	Error   string            `json"error,omitempty"`
+	Error   string            `json:"error,omitempty"`
 	Array   []string          `json:"array,omitempty"`
 	Options []string          `json:"options,omitempty"`
 	Map     map[string]string `json:"map,omitempty"`
+	// Responders is only set on list-responders replies
+	Responders []*responderListing `json:"responders,omitempty"`
 }
 
 func (c *commandBlock) handleCommand(source string,
@@ -38,18 +42,64 @@ func (c *commandBlock) registerChk() error {
 	if c.Data == "" {
 		return errors.New("Missing regex expression")
 	}
-	if len(c.Array) < 2 {
+	if len(c.Array) < 2 && !c.temporary() {
 		return errors.New("Missing help info (in \"array\" element)")
 	}
+	if ttl, ok := c.Map["ttl"]; ok {
+		if seconds, err := strconv.Atoi(ttl); err != nil || seconds <= 0 {
+			return errors.New("Invalid ttl: " + ttl)
+		}
+	}
+	if priority, ok := c.Map["priority"]; ok {
+		if _, err := strconv.Atoi(priority); err != nil {
+			return errors.New("Invalid priority: " + priority)
+		}
+	}
+	if timeout, ok := c.Map["reply-timeout"]; ok {
+		if seconds, err := strconv.Atoi(timeout); err != nil || seconds <= 0 {
+			return errors.New("Invalid reply timeout: " + timeout)
+		}
+	}
 	return nil
 }
 
-func (c *commandBlock) engageChk(source, secret string) error {
+// temporary registrations are one-shot or have a ttl, they don't need and
+// don't get a help entry
+func (c *commandBlock) temporary() bool {
+	if c.Map["ttl"] != "" {
+		return true
+	}
+	for _, option := range c.Options {
+		if option == "oneshot" || option == "followup" {
+			return true
+		}
+	}
+	return false
+}
+
+// engageChk verifies the engagement, with the auth hook's result if one is
+// configured, otherwise with the shared secret
+func (c *commandBlock) engageChk(source, secret string,
+	auth *authResult) error {
+
 	if c.Type != "adapter" && c.Type != "responder" {
 		return errors.New("Invalid client engagement type: " + c.Type)
 	}
 
-	if c.Data == "" {
+	if conf.AuthHook != nil {
+		if auth == nil {
+			return errors.New("Engagement wasn't authenticated")
+		}
+		return auth.err
+	}
+
+	return checkAuth(c.Time, c.Data, source, secret)
+}
+
+// checkAuth verifies data is the base64 encoded SHA256-HMAC of the timestamp,
+// source and secret, and that the timestamp is current
+func checkAuth(t int64, data, source, secret string) error {
+	if data == "" {
 		return errors.New("No auth data received")
 	}
 
@@ -57,9 +107,9 @@ func (c *commandBlock) engageChk(source, secret string) error {
 
 	logger.Debug.Println("Current time:", now)
 	logger.Debug.Println("Current unix timestamp:", now.Unix())
-	logger.Debug.Println("Received auth unix timestamp:", c.Time)
+	logger.Debug.Println("Received auth unix timestamp:", t)
 
-	diff := now.Unix() - c.Time
+	diff := now.Unix() - t
 
 	logger.Info.Println("Time differential:", diff)
 
@@ -67,13 +117,13 @@ func (c *commandBlock) engageChk(source, secret string) error {
 		return errors.New("Timestamp out of range")
 	}
 
-	decoded, err := base64.StdEncoding.DecodeString(c.Data)
+	decoded, err := base64.StdEncoding.DecodeString(data)
 
 	if err != nil {
 		return err
 	}
 
-	authMsg := fmt.Sprintf("%d%s%s", c.Time, source, secret)
+	authMsg := fmt.Sprintf("%d%s%s", t, source, secret)
 
 	mac := hmac.New(sha256.New, []byte(secret))
 	mac.Write([]byte(authMsg))
@@ -83,5 +133,74 @@ func (c *commandBlock) engageChk(source, secret string) error {
 	}
 
 	return nil
+}
+
+// handoff repoints the active responders registered by the connection named
+// in the "source" map entry to source, so a new responder instance can take
+// over from the old one without a gap
+func (c *commandBlock) handoff(source string) *query {
+	reply := &query{
+		Type:   "command",
+		Source: "server",
+		To:     source,
+		Command: &commandBlock{
+			Id:     c.Id,
+			Action: "handoff",
+		},
+	}
+
+	old := c.Map["source"]
+	if old == "" || old == source {
+		reply.Command.Error = "Invalid handoff source: " + old
+		return reply
+	}
+
+	if err := checkAuth(c.Time, c.Data, old, conf.Secret); err != nil {
+		logger.Error.Println("Handoff authentication failed:", err)
+		reply.Command.Error = err.Error()
+		return reply
+	}
 
+	routeLock.Lock()
+	count := 0
+	for _, arl := range []*list.List{prefixAResponders, noPrefixAResponders,
+		mentionAResponders, unhandledAResponders} {
+
+		for eAr := arl.Front(); eAr != nil; eAr = eAr.Next() {
+			ar := eAr.Value.(*activeResponderConfig)
+			if ar.source == old {
+				ar.source = source
+				count++
+			}
+		}
+	}
+	routeLock.Unlock()
+
+	logger.Info.Println("Handed off", count, "active responders from", old,
+		"to", source)
+	reply.Command.Data = fmt.Sprintf("%d", count)
+
+	return reply
+}
+
+func timeReply(to, id string) *query {
+	now := time.Now().In(conf.location)
+	zone, offset := now.Zone()
+
+	return &query{
+		Type:   "command",
+		Source: "server",
+		To:     to,
+		Command: &commandBlock{
+			Id:     id,
+			Action: "time",
+			Time:   now.Unix(),
+			Data:   now.Format(time.RFC3339),
+			Map: map[string]string{
+				"timezone": conf.location.String(),
+				"zone":     zone,
+				"offset":   fmt.Sprintf("%d", offset),
+			},
+		},
+	}
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/base64"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimeReplyInConfiguredZone(t *testing.T) {
+	setupTest(t, "")
+	zone, err := time.LoadLocation("Asia/Tokyo")
+	if err != nil {
+		t.Skip("No timezone database:", err)
+	}
+	conf.location = zone
+
+	reply := timeReply("responder", "t1").Command
+	if reply.Id != "t1" || reply.Action != "time" {
+		t.Fatal("Unexpected reply:", reply)
+	}
+	if skew := time.Now().Unix() - reply.Time; skew < 0 || skew > 2 {
+		t.Fatal("Time isn't current, off by", skew)
+	}
+
+	stamp, err := time.Parse(time.RFC3339, reply.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stamp.Unix() != reply.Time {
+		t.Fatal("Timestamp and unix time differ:", reply.Data, reply.Time)
+	}
+	if _, offset := stamp.Zone(); offset != 9*3600 ||
+		reply.Map["timezone"] != "Asia/Tokyo" ||
+		reply.Map["offset"] != "32400" {
+
+		t.Fatal("Not in the configured timezone:", reply.Data, reply.Map)
+	}
+}
+
+func TestHandoffMovesActiveResponders(t *testing.T) {
+	setupTest(t, "")
+	conf.Secret = "sharedsecret"
+
+	addActiveResponder("prefix", &activeResponderConfig{
+		regex:   regexp.MustCompile("^build (\\S+)$"),
+		source:  "responder-a",
+		helpCmd: "build",
+	}, true)
+
+	now := time.Now().Unix()
+	reply := (&commandBlock{
+		Id:     "h1",
+		Action: "handoff",
+		Time:   now,
+		Data:   authData(now, "responder-a", conf.Secret),
+		Map:    map[string]string{"source": "responder-a"},
+	}).handoff("responder-b")
+	if reply.Command.Error != "" || reply.Command.Data != "1" {
+		t.Fatal("Handoff failed:", reply.Command)
+	}
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris build web", "room").handleMessage("adapter", dispatch)
+	select {
+	case req := <-dispatch:
+		if req.Query.To != "responder-b" {
+			t.Fatal("Match routed to", req.Query.To)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Match not routed")
+	}
+}
+
+func TestHandoffNeedsOldSourceAuth(t *testing.T) {
+	setupTest(t, "")
+	conf.Secret = "sharedsecret"
+
+	now := time.Now().Unix()
+	reply := (&commandBlock{
+		Action: "handoff",
+		Time:   now,
+		Data:   authData(now, "responder-b", conf.Secret),
+		Map:    map[string]string{"source": "responder-a"},
+	}).handoff("responder-b")
+	if reply.Command.Error == "" {
+		t.Fatal("Handoff authenticated as the wrong source")
+	}
+}
+
+func TestWrongSecretsRejected(t *testing.T) {
+	setupTest(t, "")
+	secret := "test-secret"
+	now := time.Now().Unix()
+
+	if err := checkAuth(now, authData(now, "chat", secret), "chat",
+		secret); err != nil {
+
+		t.Fatal("Right secret rejected:", err)
+	}
+
+	for _, wrong := range []string{"", "t", "test-secre", "test-secreT",
+		"test-secret ", "test-secret-but-longer",
+		strings.Repeat("test-secret", 100)} {
+
+		err := checkAuth(now, authData(now, "chat", wrong), "chat", secret)
+		if err == nil || err.Error() != "Incorrect auth code" {
+			t.Errorf("Secret %.20q: expected rejection, got %v", wrong, err)
+		}
+	}
+
+	// codes cut short or too long
+	code := authData(now, "chat", secret)
+	raw, _ := base64.StdEncoding.DecodeString(code)
+	for _, data := range []string{
+		base64.StdEncoding.EncodeToString(raw[:len(raw)-1]),
+		base64.StdEncoding.EncodeToString(append(raw, 0)),
+		base64.StdEncoding.EncodeToString([]byte("x")),
+	} {
+		err := checkAuth(now, data, "chat", secret)
+		if err == nil || err.Error() != "Incorrect auth code" {
+			t.Errorf("Code %q: expected rejection, got %v", data, err)
+		}
+	}
+
+	if err := checkAuth(now, "not base64!", "chat", secret); err == nil {
+		t.Error("Malformed code accepted")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"errors"
+	"sync/atomic"
+)
+
+var errCommandsBusy = errors.New("Too many commands waiting to run")
+
+// commandLimiter caps how many passive responder commands run at once, the
+// ones over the cap wait for a slot, up to a bounded number of them
+type commandLimiter struct {
+	slots    chan struct{}
+	maxQueue int32
+	inFlight int32
+	queued   int32
+}
+
+var commandSlots *commandLimiter
+
+// runningCommands is how many passive responder commands are running
+var runningCommands int64
+
+// commandStarted updates the count of running commands, the returned func
+// is called when the command is done
+func commandStarted() func() {
+	gaugeMetric("commands.in_flight", atomic.AddInt64(&runningCommands, 1))
+	return func() {
+		gaugeMetric("commands.in_flight",
+			atomic.AddInt64(&runningCommands, -1))
+	}
+}
+
+func newCommandLimiter(max, queue int) *commandLimiter {
+	return &commandLimiter{
+		slots:    make(chan struct{}, max),
+		maxQueue: int32(queue),
+	}
+}
+
+// acquire waits for a slot, it fails right away if the queue is full, the
+// returned func gives the slot back
+func (l *commandLimiter) acquire() (func(), error) {
+	select {
+	case l.slots <- struct{}{}:
+	default:
+		if atomic.AddInt32(&l.queued, 1) > l.maxQueue {
+			atomic.AddInt32(&l.queued, -1)
+			return nil, errCommandsBusy
+		}
+		l.slots <- struct{}{}
+		atomic.AddInt32(&l.queued, -1)
+	}
+
+	atomic.AddInt32(&l.inFlight, 1)
+	return func() {
+		atomic.AddInt32(&l.inFlight, -1)
+		<-l.slots
+	}, nil
+}
+
+// counts reports the commands running and the ones waiting for a slot
+func (l *commandLimiter) counts() (inFlight, queued int) {
+	return int(atomic.LoadInt32(&l.inFlight)),
+		int(atomic.LoadInt32(&l.queued))
+}
@@ -0,0 +1,224 @@
+package main
+
+import (
+	"io"
+	"net"
+	"sort"
+	"sync"
+	"time"
+)
+
+// connRegistry maps engaged source ids to their connection's sender, id
+// assignment checks for collisions and claims the id under the same lock so
+// two engagements can never end up with the same id
+type connRegistry struct {
+	lock  sync.RWMutex
+	conns map[string]*connEntry
+	// aliases are ids a connection had before rotation, still routed to it
+	// for the grace period
+	aliases map[string]bool
+}
+
+type connEntry struct {
+	sender  *connSender
+	closer  io.Closer
+	adapter bool
+	id      *connIdentity
+	pinged  time.Time
+	caps    map[string]bool
+	// name is the source id the connection asked for when it engaged, it
+	// keeps it when it got another id or its id is rotated
+	name   string
+	labels []string
+}
+
+// connIdentity is the id currently assigned to a connection, the dispatcher
+// sets it and the connection's serve() stamps it on everything it reads
+type connIdentity struct {
+	lock sync.RWMutex
+	id   string
+	seen int64
+}
+
+func (c *connIdentity) get() string {
+	c.lock.RLock()
+	defer c.lock.RUnlock()
+	return c.id
+}
+
+func (c *connIdentity) set(id string) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.id = id
+}
+
+// connCloser flushes whatever is buffered for the connection before closing
+// it
+type connCloser struct {
+	conn net.Conn
+	out  io.Writer
+}
+
+func (c *connCloser) Close() error {
+	if flusher, ok := c.out.(*flushWriter); ok {
+		flusher.Flush()
+	}
+	return c.conn.Close()
+}
+
+func newConnRegistry() *connRegistry {
+	return &connRegistry{
+		conns:   make(map[string]*connEntry),
+		aliases: make(map[string]bool),
+	}
+}
+
+// claim registers the connection under the requested id, or under a random
+// id if none was requested or it's already taken, and returns the id assigned
+func (r *connRegistry) claim(requested string, entry *connEntry) string {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	id := requested
+	// no source identifier given, we'll use a random source id
+	if id == "" {
+		id = generateId()
+	}
+
+	// source identifier collision, use a random source id and keep
+	// generating until no collision is found, "server" is reserved for
+	// server originated queries
+	for _, ok := r.conns[id]; ok || id == "server"; _, ok = r.conns[id] {
+		id = generateId()
+	}
+
+	r.conns[id] = entry
+	if entry.id != nil {
+		entry.id.set(id)
+		entry.id.touch()
+	}
+
+	return id
+}
+
+// ids lists the ids of the engaged connections, aliases left out
+func (r *connRegistry) ids() []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ids := make([]string, 0, len(r.conns))
+	for id := range r.conns {
+		if !r.aliases[id] {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// rotate assigns the connection a new random id, the old one keeps routing
+// to it for grace and is released after that
+func (r *connRegistry) rotate(old string, grace time.Duration) (string,
+	bool) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	entry, ok := r.conns[old]
+	if !ok || r.aliases[old] {
+		return "", false
+	}
+
+	id := generateId()
+	for _, ok := r.conns[id]; ok || id == "server"; _, ok = r.conns[id] {
+		id = generateId()
+	}
+
+	r.conns[id] = entry
+	r.aliases[old] = true
+	if entry.id != nil {
+		entry.id.set(id)
+	}
+
+	time.AfterFunc(grace, func() {
+		r.lock.Lock()
+		defer r.lock.Unlock()
+		if r.conns[old] == entry {
+			delete(r.conns, old)
+		}
+		delete(r.aliases, old)
+	})
+
+	return id, true
+}
+
+func (r *connRegistry) get(id string) (queryEncoder, bool) {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entry, ok := r.conns[id]
+	if !ok {
+		return nil, false
+	}
+	return entry.sender, true
+}
+
+// lookup lists the engaged connections that asked for the name when they
+// engaged, or that the auth hook gave the label, an empty name or label
+// matches nothing
+func (r *connRegistry) lookup(name, label string) []string {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	ids := make([]string, 0)
+	for id, entry := range r.conns {
+		if r.aliases[id] {
+			continue
+		}
+		if name != "" && entry.name == name {
+			ids = append(ids, id)
+			continue
+		}
+		for _, l := range entry.labels {
+			if label != "" && l == label {
+				ids = append(ids, id)
+				break
+			}
+		}
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+func (r *connRegistry) isAdapter(id string) bool {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	entry, ok := r.conns[id]
+	return ok && entry.adapter
+}
+
+// close closes the connection after what's already queued for it is sent,
+// it stays registered until its serve() notices and disengages it
+func (r *connRegistry) close(id string) bool {
+	r.lock.RLock()
+	entry, ok := r.conns[id]
+	r.lock.RUnlock()
+
+	if !ok || entry.closer == nil {
+		return false
+	}
+
+	entry.sender.close(entry.closer)
+	return true
+}
+
+func (r *connRegistry) remove(id string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	if entry, ok := r.conns[id]; ok {
+		entry.sender.stop()
+	}
+	delete(r.conns, id)
+}
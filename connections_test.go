@@ -0,0 +1,41 @@
+package main
+
+import (
+	"sync"
+	"testing"
+)
+
+func TestConcurrentClaimsGetUniqueIds(t *testing.T) {
+	r := newConnRegistry()
+
+	const engagements = 100
+	var wg sync.WaitGroup
+	ids := make([]string, engagements)
+	for i := 0; i < engagements; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i] = r.claim("adapter", &connEntry{id: &connIdentity{}})
+			// lookups race with the claims
+			r.ids()
+		}(i)
+	}
+	wg.Wait()
+
+	seen := make(map[string]bool)
+	for _, id := range ids {
+		if seen[id] {
+			t.Fatal("Id assigned twice:", id)
+		}
+		seen[id] = true
+		if r.conns[id] == nil || r.conns[id].id.get() != id {
+			t.Fatal("Registry doesn't map", id, "to its connection")
+		}
+	}
+	if !seen["adapter"] {
+		t.Fatal("No engagement got the requested id")
+	}
+	if len(r.ids()) != engagements {
+		t.Fatal("Expected", engagements, "connections, got", len(r.ids()))
+	}
+}
@@ -3,16 +3,36 @@ package main
 import (
 	"container/list"
 	"crypto/rand"
-	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
+	"strconv"
+	"time"
 )
 
 type dispatcherRequest struct {
 	Query      *query
-	Encoder    *json.Encoder
+	Encoder    queryEncoder
 	EngageResp chan<- string
+	// Framed replaces Encoder once the engagement is accepted, for
+	// connections that negotiated length-prefixed framing
+	Framed queryEncoder
+	// Auth is the auth hook's verdict on an engagement, if one is configured
+	Auth *authResult
+	// Closer closes the connection of an engagement, to force it to disengage
+	Closer io.Closer
+	// Identity is where the id assigned to an engagement is kept
+	Identity *connIdentity
+	// Reload is the passive responders to install on a reload
+	Reload *passiveSet
+	// Remote is the ip an engagement came from
+	Remote string
+	// Close closes the destination connection once a Reply is delivered
+	Close bool
+	// Reply marks a server generated query that is delivered to Query.To
+	// as is, without being interpreted as a request
+	Reply bool
 }
 
 func generateId() string {
@@ -21,28 +41,138 @@ func generateId() string {
 	return fmt.Sprintf("%x", b)
 }
 
+// removeSource drops the source's active responders from arl, the caller
+// holds routeLock
 func removeSource(arl *list.List, source string) {
-	for eAr := arl.Front(); eAr != nil; eAr = eAr.Next() {
+	for eAr := arl.Front(); eAr != nil; {
 		ar := eAr.Value.(*activeResponderConfig)
+		next := eAr.Next()
 		logger.Debug.Println("Remove check, source:", ar.source)
 		if ar.source == source {
-			rAr := eAr
-			eAr = eAr.Prev()
 			logger.Debug.Println("Deregistering active responder:", ar.helpCmd)
-			arl.Remove(rAr)
-			if eAr == nil {
-				break
-			}
+			arl.Remove(eAr)
 		}
+		eAr = next
+	}
+}
+
+// removeHelp drops the help entries of the source's active responders, the
+// caller holds routeLock
+func removeHelp(source string) {
+	for helpE := help.Front(); helpE != nil; {
+		next := helpE.Next()
+		info := helpE.Value.(*helpInfo)
+		if info.active != nil && info.active.source == source {
+			help.Remove(helpE)
+		}
+		helpE = next
 	}
 }
 
 func deregister(source string) {
 	logger.Debug.Println("Deregister started for:", source)
+	routeLock.Lock()
+	defer routeLock.Unlock()
 	removeSource(prefixAResponders, source)
 	removeSource(noPrefixAResponders, source)
 	removeSource(mentionAResponders, source)
 	removeSource(unhandledAResponders, source)
+	removeHelp(source)
+}
+
+// addActiveResponder registers the responder with the list for its type,
+// with a help entry unless it's temporary, and returns the list
+func addActiveResponder(kind string, ar *activeResponderConfig,
+	withHelp bool) *list.List {
+
+	helpMsg := &helpInfo{
+		helpCmd: ar.helpCmd,
+		helpMsg: ar.help,
+		active:  ar,
+	}
+
+	var arl *list.List
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	switch kind {
+	case "prefix":
+		arl = prefixAResponders
+	case "noprefix":
+		helpMsg.noPrefix = true
+		arl = noPrefixAResponders
+	case "mention":
+		helpMsg.mention = true
+		arl = mentionAResponders
+	case "unhandled":
+		arl = unhandledAResponders
+	}
+	if kind != "unhandled" && withHelp {
+		help.PushBack(helpMsg)
+	}
+	insertByPriority(arl, ar, ar.priority)
+
+	return arl
+}
+
+// deregisterResponder removes the source's active responders registered
+// with the id under the type, along with their help entries, it returns
+// whether there were any
+func deregisterResponder(source, id, kind string) bool {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	var arl *list.List
+	switch kind {
+	case "prefix":
+		arl = prefixAResponders
+	case "noprefix":
+		arl = noPrefixAResponders
+	case "mention":
+		arl = mentionAResponders
+	case "unhandled":
+		arl = unhandledAResponders
+	default:
+		return false
+	}
+
+	removed := make(map[*activeResponderConfig]bool)
+	for eAr := arl.Front(); eAr != nil; {
+		next := eAr.Next()
+		ar := eAr.Value.(*activeResponderConfig)
+		if ar.source == source && ar.id == id {
+			logger.Debug.Println("Deregistering active responder:", ar.regex)
+			arl.Remove(eAr)
+			removed[ar] = true
+		}
+		eAr = next
+	}
+
+	for helpE := help.Front(); helpE != nil; {
+		next := helpE.Next()
+		if removed[helpE.Value.(*helpInfo).active] {
+			help.Remove(helpE)
+		}
+		helpE = next
+	}
+
+	return len(removed) > 0
+}
+
+// removeResponder unregisters a single active responder, once a one-shot
+// responder fired or a ttl expired
+func removeResponder(arl *list.List, ar *activeResponderConfig) {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	for eAr := arl.Front(); eAr != nil; eAr = eAr.Next() {
+		if eAr.Value.(*activeResponderConfig) == ar {
+			logger.Debug.Println("Removing temporary active responder:",
+				ar.regex)
+			arl.Remove(eAr)
+			return
+		}
+	}
 }
 
 func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
@@ -51,8 +181,17 @@ func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
 	// if it's targeting specific connection id, patch to that connection
 	// if it's operation to register pattern or command, perform registration
 
-	connMap := make(map[string]*json.Encoder)
+	setHealth(&health.dispatching, true)
+
+	connMap := newConnRegistry()
+	deliveries := newRouteTracker(1000)
+	requests := newRouteTracker(1000)
+	reactions := newRouteTracker(1000)
+	// labels the auth hook gave each connection
+	labels := make(map[string][]string)
+	shuttingDown := false
 
+Dispatch:
 	for {
 		req := <-request
 		q := req.Query
@@ -63,6 +202,18 @@ func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
 			continue
 		}
 
+		if req.Reply {
+			if encoder, ok := connMap.get(q.To); ok {
+				encoder.Encode(q)
+				if req.Close {
+					connMap.close(q.To)
+				}
+			} else {
+				logger.Error.Println("Reply destination doesn't exist:", q.To)
+			}
+			continue
+		}
+
 		switch {
 		case q.Type == "command":
 			cmd := q.Command
@@ -73,21 +224,51 @@ func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
 						"No connection provided for engagement")
 					logger.Error.Fatal("Bad code, check code ininitialize()")
 				} else {
-					if err := cmd.engageChk(q.Source, conf.Secret); err == nil {
-						id := q.Source
-						// no source identifier given, we'll use a random
-						// source id
-						if id == "" {
-							id = generateId()
+					// checked again, the ip may have been locked out while
+					// the auth hook ran
+					var err error
+					if engageLocks != nil {
+						err = engageLocks.check(req.Remote, time.Now())
+					}
+					if err == nil {
+						err = cmd.protocolChk()
+					}
+					if err == nil {
+						err = cmd.engageChk(q.Source, conf.Secret, req.Auth)
+						if engageLocks != nil && err != nil {
+							engageLocks.fail(req.Remote, time.Now())
 						}
+					}
 
-						// source identifier collision, use a random source id
-						// and keep generating until no collision is found
-						for _, ok := connMap[id]; ok; _, ok = connMap[id] {
-							id = generateId()
+					if err == nil {
+						if engageLocks != nil {
+							engageLocks.reset(req.Remote)
 						}
 
-						connMap[id] = req.Encoder
+						encoder := req.Encoder
+						if req.Framed != nil {
+							encoder = req.Framed
+						}
+						sender := newConnSender(encoder, req.Identity,
+							conf.SendQueue)
+						entry := &connEntry{
+							sender:  sender,
+							closer:  req.Closer,
+							adapter: cmd.Type == "adapter",
+							id:      req.Identity,
+							caps:    cmd.clientCapabilities(),
+							name:    q.Source,
+						}
+						if req.Auth != nil {
+							entry.labels = req.Auth.labels
+						}
+						id := connMap.claim(q.Source, entry)
+
+						if req.Auth != nil && len(req.Auth.labels) > 0 {
+							logger.Info.Println("Labels for", id+":",
+								req.Auth.labels)
+							labels[id] = req.Auth.labels
+						}
 
 						if id != q.Source && q.Source != "" {
 							logger.Warn.Println("Requester's source id already",
@@ -96,23 +277,36 @@ func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
 						}
 
 						logger.Info.Println("Engagement accepted: ", id)
+						countMetric("connections.engaged", 1)
+						gaugeMetric("connections.active",
+							int64(len(connMap.ids())))
 						req.EngageResp <- id
 						close(req.EngageResp)
 
+						// proceed is the last query in the streaming
+						// encoding, it confirms the framing to the client
+						proceed := &commandBlock{
+							Action: "proceed",
+							Data:   id,
+						}
+						if req.Framed != nil {
+							proceed.Options = []string{"framed"}
+						}
+						proceed.negotiated()
+
 						req.Encoder.Encode(&query{
-							Type:   "command",
-							Source: "server",
-							To:     id,
-							Command: &commandBlock{
-								Action: "proceed",
-								Data:   id,
-							},
+							Type:    "command",
+							Source:  "server",
+							To:      id,
+							Command: proceed,
 						})
+						sender.start()
 					} else {
 						logger.Error.Println("Invalid engagement request", err)
-						req.EngageResp <- ""
-						close(req.EngageResp)
+						countMetric("connections.rejected", 1)
 
+						// terminate has to be written before serve() is
+						// unblocked, it closes the connection right away
 						req.Encoder.Encode(&query{
 							Type:   "command",
 							Source: "server",
@@ -122,14 +316,57 @@ func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
 								Data:   err.Error(),
 							},
 						})
+
+						req.EngageResp <- ""
+						close(req.EngageResp)
 					}
 				}
 			case "disengage":
 				if q.Source != "" {
-					delete(connMap, q.Source)
+					connMap.remove(q.Source)
 				}
 				logger.Info.Println("Connection disengaged: ", q.Source)
+				countMetric("connections.disengaged", 1)
+				gaugeMetric("connections.active", int64(len(connMap.ids())))
 				deregister(q.Source)
+				infoAccess.forget(q.Source)
+				delete(labels, q.Source)
+
+				if shuttingDown && len(connMap.ids()) == 0 {
+					logger.Warn.Println("All connections closed")
+					break Dispatch
+				}
+			case "reload":
+				if q.Source != "server" || req.Reload == nil {
+					logger.Error.Println("Reload requested by", q.Source)
+					break
+				}
+				req.Reload.install()
+				logger.Warn.Println("Reloaded",
+					len(req.Reload.responders.Passive), "passive responders")
+			case "shutdown":
+				if q.Source != "server" {
+					logger.Error.Println("Shutdown requested by", q.Source)
+					break
+				}
+
+				if cmd.Type == "timeout" {
+					logger.Warn.Println("Shutdown timed out with",
+						len(connMap.ids()), "connections left")
+					break Dispatch
+				}
+
+				shuttingDown = true
+				if shutdown(connMap) == 0 {
+					break Dispatch
+				}
+
+				timeout := time.Duration(conf.ShutdownTimeout) * time.Second
+				time.AfterFunc(timeout, func() {
+					request <- &dispatcherRequest{
+						Query: shutdownQuery("timeout"),
+					}
+				})
 			case "register":
 				logger.Debug.Println("Register command received:", cmd)
 				if err := cmd.registerChk(); err == nil {
@@ -141,78 +378,233 @@ func dispatcher(request chan *dispatcherRequest, quitChan chan bool) {
 					}
 					ar.source = q.Source
 					ar.id = cmd.Id
-					ar.helpCmd = cmd.Array[0]
-					ar.help = cmd.Array[1]
+					if len(cmd.Array) >= 2 {
+						ar.helpCmd = cmd.Array[0]
+						ar.help = cmd.Array[1]
+					}
 					for _, option := range cmd.Options {
-						if option == "fallthrough" {
+						switch option {
+						case "fallthrough":
 							ar.matchNext = true
+						case "oneshot":
+							ar.oneShot = true
+						case "followup":
+							ar.oneShot = true
+							ar.scope = newFollowUpScope(cmd.Map)
 						}
 					}
 
-					helpMsg := &helpInfo{
-						helpCmd: ar.helpCmd,
-						helpMsg: ar.help,
+					var ttl time.Duration
+					if cmd.Map["ttl"] != "" {
+						seconds, _ := strconv.Atoi(cmd.Map["ttl"])
+						ttl = time.Duration(seconds) * time.Second
+					} else if ar.scope != nil {
+						ttl = time.Duration(conf.FollowUpTimeout) * time.Second
+					}
+					if ttl > 0 {
+						ar.expires = time.Now().Add(ttl)
 					}
 
-					switch cmd.Type {
-					case "prefix":
-						help.PushBack(helpMsg)
-						prefixAResponders.PushBack(ar)
-					case "noprefix":
-						helpMsg.noPrefix = true
-						help.PushBack(helpMsg)
-						noPrefixAResponders.PushBack(ar)
-					case "mention":
-						helpMsg.mention = true
-						help.PushBack(helpMsg)
-						mentionAResponders.PushBack(ar)
-					case "unhandled":
-						unhandledAResponders.PushBack(ar)
+					if cmd.Map["priority"] != "" {
+						ar.priority, _ = strconv.Atoi(cmd.Map["priority"])
+					}
+
+					if cmd.Map["reply-timeout"] != "" {
+						seconds, _ := strconv.Atoi(cmd.Map["reply-timeout"])
+						ar.replyTimeout = time.Duration(seconds) * time.Second
+						ar.fallback = cmd.Map["fallback"]
+					}
+
+					arl := addActiveResponder(cmd.Type, ar, !cmd.temporary())
+					if ttl > 0 {
+						time.AfterFunc(ttl, func() {
+							removeResponder(arl, ar)
+						})
 					}
 					logger.Debug.Println("Active adapter registered:", ar)
 				} else {
 					logger.Error.Println("Invalid register command:", err)
+					if encoder, ok := connMap.get(q.Source); ok {
+						encoder.Encode(rejectRequest(q.Source, cmd, err))
+					}
+				}
+			case "deregister":
+				reply := &query{
+					Type:   "command",
+					Source: "server",
+					To:     q.Source,
+					Command: &commandBlock{
+						Id:     cmd.Id,
+						Action: cmd.Action,
+						Type:   cmd.Type,
+					},
 				}
-			case "user_request":
-				fallthrough
-			case "room_request":
-				fallthrough
-			case "info":
-				if q.To != "" && q.To != "server" {
-					logger.Debug.Println("Info command received from:",
-						q.Source)
-					logger.Debug.Println("Info command destined to:", q.To)
-					logger.Debug.Println("Action:", cmd.Action)
-
-					if encoder, ok := connMap[q.To]; ok {
+				if !deregisterResponder(q.Source, cmd.Id, cmd.Type) {
+					reply = rejectRequest(q.Source, cmd,
+						errors.New("No such responder: "+cmd.Id))
+				}
+				if encoder, ok := connMap.get(q.Source); ok {
+					encoder.Encode(reply)
+				}
+			case "user_request", "room_request", "message_request", "info",
+				"delete":
+				// requests go from responders to adapters, the responses
+				// are routed back to the requester by the request id
+				if connMap.isAdapter(q.Source) {
+					to, ok := requests.route(q.Source, cmd.Id)
+					if !ok {
+						logger.Warn.Println("Dropping", cmd.Action,
+							"response with unknown id from", q.Source+":",
+							cmd.Id)
+					} else if encoder, ok := connMap.get(to); ok {
+						q.To = to
 						encoder.Encode(q)
 					} else {
-						logger.Error.Println("Destination doesn't exist:", q.To)
+						logger.Warn.Println("Requester is gone:", to)
+					}
+					continue
+				}
+
+				err := q.checkRequest(connMap, requests)
+				if err == nil && cmd.Action != "delete" {
+					err = infoAccess.check(q.Source, labels[q.Source])
+				}
+				if err != nil {
+					logger.Warn.Println("Request", cmd.Action, "from",
+						q.Source, "rejected:", err)
+					if encoder, ok := connMap.get(q.Source); ok {
+						encoder.Encode(rejectRequest(q.Source, cmd, err))
+					}
+					continue
+				}
+
+				logger.Debug.Println("Request", cmd.Action, "from", q.Source,
+					"destined to:", q.To)
+				requests.track(q.To, cmd.Id, q.Source)
+				if encoder, ok := connMap.get(q.To); ok {
+					encoder.Encode(q)
+				}
+			case "delivery":
+				// reported by the adapter, routed back to the responder that
+				// sent the message
+				if cmd.Data == "" {
+					logger.Error.Println("Missing message id for delivery")
+					break
+				}
+
+				if pending, ok := reactions.route(q.Source, cmd.Data); ok {
+					react := cmd.react(q.Source, pending)
+					encoder, ok := connMap.get(q.Source)
+					if ok && react != nil {
+						encoder.Encode(react)
 					}
+				}
+
+				if to, ok := deliveries.route(q.Source,
+					cmd.Data); !ok {
+
+					logger.Warn.Println("Delivery result for unknown message:",
+						cmd.Data)
+				} else if encoder, ok := connMap.get(to); ok {
+					q.To = to
+					encoder.Encode(q)
 				} else {
-					logger.Error.Println("Missing destination for info request")
+					logger.Warn.Println("Delivery result sender is gone:", to)
+				}
+			case "admin":
+				reply := cmd.handleAdmin(q.Source, connMap, request)
+				if encoder, ok := connMap.get(q.Source); ok && reply != nil {
+					encoder.Encode(reply)
+				}
+			case "handoff":
+				if encoder, ok := connMap.get(q.Source); ok {
+					encoder.Encode(cmd.handoff(q.Source))
+				}
+			case "rotate":
+				if q.Source != "server" {
+					logger.Error.Println("Rotation requested by", q.Source)
+					break
+				}
+				rotateConnections(connMap, labels, deliveries, requests,
+					reactions)
+			case "time":
+				if encoder, ok := connMap.get(q.Source); ok {
+					encoder.Encode(timeReply(q.Source, cmd.Id))
+				}
+			case "ping":
+				if encoder, ok := connMap.get(q.Source); ok {
+					encoder.Encode(pongReply(q.Source, cmd.Id))
+				}
+			case "pong":
+				// reading it was enough for the heartbeat, only a diagnose
+				// waits on the answer
+				pings.answered(cmd.Id)
+			case "heartbeat":
+				if q.Source != "server" {
+					logger.Error.Println("Heartbeat requested by", q.Source)
+					break
+				}
+				checkHeartbeats(connMap)
+			case "server-info":
+				if encoder, ok := connMap.get(q.Source); ok {
+					encoder.Encode(serverInfoReply(q.Source, cmd.Id, connMap))
+				}
+			case "list-responders":
+				if encoder, ok := connMap.get(q.Source); ok {
+					encoder.Encode(listResponders(q.Source, cmd.Id))
 				}
 			default:
-				go cmd.handleCommand(q.Source, request)
+				workers.submit(q.Source, func() {
+					defer recoverJob(q)
+					cmd.handleCommand(q.Source, request)
+				})
 			}
 		case q.Type == "message":
 			// message from an adapter won't have a "To" field
 			if q.To != "" && q.To != "server" {
 				logger.Debug.Println("Responder message received:", *q.Message)
 				logger.Debug.Println("Query source:", q.Source)
-				if encoder, ok := connMap[q.To]; ok {
+				if q.Message.ReplyTo != "" {
+					replies.replied(q.Source, q.Message.ReplyTo)
+				}
+				if encoder, ok := connMap.get(q.To); ok {
+					if q.Message.Id != "" {
+						deliveries.track(q.To, q.Message.Id, q.Source)
+					}
+					if q.Message.React != "" && q.Message.Id == "" {
+						logger.Warn.Println("Reaction without message id from",
+							q.Source, "ignored")
+					} else if q.Message.React != "" {
+						reactions.track(q.To, q.Message.Id,
+							pendingReaction(q.Message))
+					}
+					q.Message.React = ""
+					if q.Message.Thread != "" &&
+						!connMap.supports(q.To, "threads") {
+
+						logger.Debug.Println(q.To, "doesn't support threads,",
+							"replying in the room")
+						q.Message.Thread = ""
+					}
+					q.Message.applyRoomFormat()
+					q.Message.applyOutbound(conf.Outbound.lookup(q.To,
+						labels[q.To]))
 					encoder.Encode(q)
 				} else {
 					logger.Error.Println("Cannot find adapter source for", q.To)
 				}
 			} else {
 				logger.Debug.Println("Adapter message received:", *q.Message)
-				go q.Message.handleMessage(q.Source, request)
+				workers.submit(q.Source, func() {
+					defer recoverJob(q)
+					q.Message.handleMessage(q.Source, request)
+				})
 			}
 		default:
 			logger.Error.Println("Unhandlabe message, bad client code")
 		}
 	}
 
+	setHealth(&health.dispatching, false)
 	quitChan <- true
 }
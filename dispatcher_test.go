@@ -0,0 +1,640 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chanEncoder hands what's written to a connection to the test
+type chanEncoder chan *query
+
+func (e chanEncoder) Encode(v interface{}) error {
+	e <- v.(*query)
+	return nil
+}
+
+// next waits for the query of the type or command action written to the
+// connection
+func (e chanEncoder) next(t *testing.T, kind string) *query {
+	t.Helper()
+
+	for {
+		select {
+		case q := <-e:
+			if q.Type == kind ||
+				(q.Command != nil && q.Command.Action == kind) {
+
+				return q
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No", kind, "sent")
+		}
+	}
+}
+
+// startDispatcher runs the dispatcher until the test is done with it
+func startDispatcher(t *testing.T) chan *dispatcherRequest {
+	conf.Secret = "test-secret"
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	quit := make(chan bool)
+	go dispatcher(dispatch, quit)
+
+	t.Cleanup(func() {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:    "command",
+			Source:  "server",
+			Command: &commandBlock{Action: "shutdown", Type: "timeout"},
+		}}
+		<-quit
+	})
+
+	return dispatch
+}
+
+// engageAs engages a client with the dispatcher under the id, with the labels
+// an auth hook would have given it, it returns what the client is sent
+func engageAs(t *testing.T, dispatch chan<- *dispatcherRequest, id,
+	kind string, labels ...string) chanEncoder {
+
+	t.Helper()
+
+	now := time.Now().Unix()
+	encoder := make(chanEncoder, 10)
+	resp := make(chan string, 1)
+	req := &dispatcherRequest{
+		Query: &query{
+			Type:   "command",
+			Source: id,
+			Command: &commandBlock{Action: "engage", Type: kind, Time: now,
+				Data: authData(now, id, conf.Secret)},
+		},
+		Encoder:    encoder,
+		EngageResp: resp,
+		Identity:   &connIdentity{},
+	}
+	if len(labels) > 0 {
+		req.Auth = &authResult{labels: labels}
+	}
+	dispatch <- req
+
+	if got := <-resp; got != id {
+		t.Fatal("Engaged as", got, "instead of", id)
+	}
+	encoder.next(t, "proceed")
+	return encoder
+}
+
+func TestDeleteForwardedToAdapter(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	responder := engageAs(t, dispatch, "moderator", "responder")
+
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "command",
+		Source: "moderator",
+		To:     "chat",
+		Command: &commandBlock{Id: "del-1", Action: "delete", Data: "msg-42",
+			Map: map[string]string{"room": "general"}},
+	}}
+
+	q := adapter.next(t, "delete")
+	if q.Source != "moderator" || q.Command.Id != "del-1" ||
+		q.Command.Data != "msg-42" {
+
+		t.Fatal("Unexpected delete forwarded:", q.Source, *q.Command)
+	}
+
+	// the adapter's answer goes back to the requester by the request id
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "command",
+		Source: "chat",
+		Command: &commandBlock{Id: "del-1", Action: "delete", Data: "msg-42",
+			Error: "unsupported"},
+	}}
+
+	q = responder.next(t, "delete")
+	if q.To != "moderator" || q.Command.Error != "unsupported" {
+		t.Fatal("Unexpected delete response:", q.To, *q.Command)
+	}
+}
+
+func TestDeliveryFailureRoutedToSender(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	responder := engageAs(t, dispatch, "deployer", "responder")
+
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "message",
+		Source: "deployer",
+		To:     "chat",
+		Message: &messageBlock{Id: "msg-7", Message: "deployed",
+			Room: "archived"},
+	}}
+	if q := adapter.next(t, "message"); q.Message.Id != "msg-7" {
+		t.Fatal("Unexpected message delivered:", *q.Message)
+	}
+
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "command",
+		Source: "chat",
+		Command: &commandBlock{Action: "delivery", Type: "failure",
+			Data: "msg-7", Error: "permission denied"},
+	}}
+
+	q := responder.next(t, "delivery")
+	if q.To != "deployer" || q.Command.Type != "failure" ||
+		q.Command.Data != "msg-7" || q.Command.Error != "permission denied" {
+
+		t.Fatal("Unexpected delivery result:", q.To, *q.Command)
+	}
+}
+
+func TestInfoRoundTrip(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	requester := engageAs(t, dispatch, "directory", "responder")
+	other := engageAs(t, dispatch, "other", "responder")
+
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "command",
+		Source: "directory",
+		To:     "chat",
+		Command: &commandBlock{Id: "who-1", Action: "user_request",
+			Type: "user", Data: "alice"},
+	}}
+
+	q := adapter.next(t, "user_request")
+	if q.Source != "directory" || q.Command.Id != "who-1" ||
+		q.Command.Data != "alice" {
+
+		t.Fatal("Unexpected request forwarded:", q.Source, *q.Command)
+	}
+
+	// routed by the request id, not by what the adapter put in "to"
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "command",
+		Source: "chat",
+		To:     "other",
+		Command: &commandBlock{Id: "who-1", Action: "info", Type: "user",
+			Map: map[string]string{"email": "alice@example.com"}},
+	}}
+
+	q = requester.next(t, "info")
+	if q.To != "directory" || q.Command.Map["email"] != "alice@example.com" {
+		t.Fatal("Unexpected info response:", q.To, *q.Command)
+	}
+	select {
+	case q := <-other:
+		t.Fatal("Response leaked to another responder:", *q)
+	default:
+	}
+}
+
+func TestInfoRequestsRestricted(t *testing.T) {
+	setupTest(t, "")
+	var err error
+	infoAccess, err = newInfoGuard(
+		&infoRequestsConfig{Allow: []string{"directory"}, Rate: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	clients := map[string]chanEncoder{
+		"directory": engageAs(t, dispatch, "directory", "responder"),
+		"rogue":     engageAs(t, dispatch, "rogue", "responder"),
+	}
+
+	request := func(source, id string) {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: source,
+			To:     "chat",
+			Command: &commandBlock{Id: id, Action: "room_request",
+				Type: "id", Data: "general"},
+		}}
+	}
+
+	request("rogue", "r-1")
+	q := clients["rogue"].next(t, "room_request")
+	if q.Command.Error != "Not allowed to send info requests" {
+		t.Fatal("Unauthorized request not rejected:", *q.Command)
+	}
+
+	for _, id := range []string{"d-1", "d-2"} {
+		request("directory", id)
+		if q := adapter.next(t, "room_request"); q.Command.Id != id {
+			t.Fatal("Unexpected request forwarded:", *q.Command)
+		}
+	}
+
+	request("directory", "d-3")
+	q = clients["directory"].next(t, "room_request")
+	if q.Command.Id != "d-3" ||
+		q.Command.Error != "Info request rate limit exceeded" {
+
+		t.Fatal("Request over the rate not rejected:", *q.Command)
+	}
+	select {
+	case q := <-adapter:
+		t.Fatal("Rejected request forwarded:", *q.Command)
+	default:
+	}
+}
+
+func TestPlainRoomDowngradesReplies(t *testing.T) {
+	setupTest(t, `
+room-formats:
+  irc-bridge: plain
+  general: rich
+`)
+	dispatch := startDispatcher(t)
+
+	// an adapter that didn't negotiate capabilities supports everything
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	engageAs(t, dispatch, "deployer", "responder")
+
+	for _, test := range []struct {
+		room, text, format string
+	}{
+		{"irc-bridge", "deployed web", "plain"},
+		{"general", "**deployed** `web`", ""},
+	} {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "message",
+			Source: "deployer",
+			To:     "chat",
+			Message: &messageBlock{Message: "**deployed** `web`",
+				Room: test.room},
+		}}
+
+		q := adapter.next(t, "message")
+		if q.Message.Message != test.text || q.Message.Format != test.format {
+			t.Errorf("Reply to %s sent as %q (%s)", test.room,
+				q.Message.Message, q.Message.Format)
+		}
+	}
+}
+
+func TestOutboundTransformPerConnection(t *testing.T) {
+	setupTest(t, `
+outbound:
+  label:irc:
+    strip-markdown: true
+  slack:
+    prefix: ":robot_face: "
+`)
+	dispatch := startDispatcher(t)
+
+	irc := engageAs(t, dispatch, "irc-bridge", "adapter", "irc")
+	slack := engageAs(t, dispatch, "slack", "adapter")
+	other := engageAs(t, dispatch, "chat", "adapter")
+	engageAs(t, dispatch, "deployer", "responder")
+
+	for _, test := range []struct {
+		to      string
+		adapter chanEncoder
+		text    string
+	}{
+		{"irc-bridge", irc, "deployed web (https://ci/1)"},
+		{"slack", slack, ":robot_face: **deployed** [web](https://ci/1)"},
+		{"chat", other, "**deployed** [web](https://ci/1)"},
+	} {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "message",
+			Source: "deployer",
+			To:     test.to,
+			Message: &messageBlock{Message: "**deployed** [web](https://ci/1)",
+				Room: "general"},
+		}}
+
+		q := test.adapter.next(t, "message")
+		if q.Message.Message != test.text {
+			t.Errorf("Message to %s sent as %q", test.to, q.Message.Message)
+		}
+	}
+}
+
+func TestTemporaryRegistrations(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	engageAs(t, dispatch, "chat", "adapter")
+	responder := engageAs(t, dispatch, "confirm", "responder")
+
+	register := func(id, regex string, options []string,
+		opts map[string]string) {
+
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: "confirm",
+			To:     "server",
+			Command: &commandBlock{Id: id, Action: "register",
+				Type: "prefix", Data: regex, Options: options, Map: opts,
+				Array: []string{regex, "test responder"}},
+		}}
+	}
+	register("yes", "^yes$", []string{"oneshot"}, nil)
+	register("later", "^later$", nil, map[string]string{"ttl": "1"})
+	register("marker", "^marker$", nil, nil)
+
+	// the messages from a source are handled in order, the marker coming
+	// through means the ones before it were handled
+	fired := func(text string) bool {
+		t.Helper()
+		for _, text := range []string{text, "pris marker"} {
+			dispatch <- &dispatcherRequest{Query: &query{
+				Type:    "message",
+				Source:  "chat",
+				Message: testMessage(text, "room"),
+			}}
+		}
+		q := responder.next(t, "message")
+		if q.Message.Message == "pris marker" {
+			return false
+		}
+		responder.next(t, "message")
+		return true
+	}
+
+	if !fired("pris yes") {
+		t.Fatal("One-shot responder didn't fire")
+	}
+	if fired("pris yes") {
+		t.Fatal("One-shot responder fired twice")
+	}
+
+	if !fired("pris later") {
+		t.Fatal("Responder didn't fire within its ttl")
+	}
+	time.Sleep(1100 * time.Millisecond)
+	if fired("pris later") {
+		t.Fatal("Responder fired after its ttl")
+	}
+
+	// the marker's handleMessage may still be running, jobs from the source
+	// run in order
+	done := make(chan struct{})
+	workers.submit("chat", func() { close(done) })
+	<-done
+
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+	for eAr := prefixAResponders.Front(); eAr != nil; eAr = eAr.Next() {
+		if ar := eAr.Value.(*activeResponderConfig); ar.id != "marker" {
+			t.Error("Temporary responder still registered:", ar.id)
+		}
+	}
+	for eHelp := help.Front(); eHelp != nil; eHelp = eHelp.Next() {
+		if info := eHelp.Value.(*helpInfo); info.helpCmd != "^marker$" {
+			t.Error("Temporary responder has a help entry:", info.helpCmd)
+		}
+	}
+}
+
+func TestInvalidRegistrationRejected(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	responder := engageAs(t, dispatch, "confirm", "responder")
+
+	for _, test := range []struct {
+		opts map[string]string
+		err  string
+	}{
+		{map[string]string{"priority": "high"}, "Invalid priority: high"},
+		{map[string]string{"priority": "10x"}, "Invalid priority: 10x"},
+		{map[string]string{"ttl": "0"}, "Invalid ttl: 0"},
+	} {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: "confirm",
+			To:     "server",
+			Command: &commandBlock{Id: "bad", Action: "register",
+				Type: "prefix", Data: "^bad$", Map: test.opts,
+				Array: []string{"bad", "test responder"}},
+		}}
+
+		q := responder.next(t, "register")
+		if q.Command.Error != test.err {
+			t.Errorf("Register with %v rejected with %q", test.opts,
+				q.Command.Error)
+		}
+	}
+	if prefixAResponders.Len() != 0 {
+		t.Error("Invalid registrations were registered")
+	}
+}
+
+func TestMetadataForwardedVerbatim(t *testing.T) {
+	setupTest(t, "room-formats:\n  irc-bridge: plain\n")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	engageAs(t, dispatch, "builds", "responder")
+
+	metadata := `{"color":"#36a64f","fields":[{"short":true,"title":"Job"}],` +
+		`"footer":"ci","weight":1.5}`
+	q := new(query)
+	err := json.Unmarshal([]byte(`{"type": "message", "source": "builds", `+
+		`"to": "chat", "message": {"message": "**passed**", `+
+		`"room": "irc-bridge", "metadata": `+metadata+`}}`), q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch <- &dispatcherRequest{Query: q}
+
+	// the text is downgraded for the room, the metadata is left alone
+	got := adapter.next(t, "message")
+	encoded, err := json.Marshal(got.Message.Metadata)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(encoded) != metadata {
+		t.Fatal("Metadata changed on the way:", string(encoded))
+	}
+}
+
+func TestRequestsCorrelatedById(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	responder := engageAs(t, dispatch, "directory", "responder")
+
+	request := func(id, user string) {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: "directory",
+			To:     "chat",
+			Command: &commandBlock{Id: id, Action: "user_request",
+				Type: "user", Data: user},
+		}}
+	}
+	answer := func(id, user string) {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: "chat",
+			Command: &commandBlock{Id: id, Action: "info", Type: "user",
+				Map: map[string]string{"user": user}},
+		}}
+	}
+
+	request("", "nobody")
+	if q := responder.next(t, "user_request"); q.Command.Error !=
+		"Missing request id" {
+
+		t.Fatal("Request without an id not rejected:", *q.Command)
+	}
+
+	request("q-1", "alice")
+	request("q-2", "bob")
+	request("q-2", "carol")
+	if q := responder.next(t, "user_request"); q.Command.Error !=
+		"Request id already in use: q-2" {
+
+		t.Fatal("Duplicate request id not rejected:", *q.Command)
+	}
+	adapter.next(t, "user_request")
+	adapter.next(t, "user_request")
+
+	// answered out of order, with a stray response in between
+	answer("q-2", "bob")
+	answer("q-9", "mallory")
+	answer("q-1", "alice")
+
+	for _, expected := range []struct{ id, user string }{
+		{"q-2", "bob"},
+		{"q-1", "alice"},
+	} {
+		q := responder.next(t, "info")
+		if q.Command.Id != expected.id ||
+			q.Command.Map["user"] != expected.user {
+
+			t.Fatal("Response", q.Command.Id, "carries",
+				q.Command.Map["user"], "expected", expected.user)
+		}
+	}
+
+	// answered once, the id no longer routes, the next response to come
+	// through is the one that follows it
+	answer("q-1", "alice again")
+	request("q-3", "dave")
+	adapter.next(t, "user_request")
+	answer("q-3", "dave")
+	if q := responder.next(t, "info"); q.Command.Id != "q-3" {
+		t.Fatal("Answered request routed again:", *q.Command)
+	}
+}
+
+// run with -race, registrations change the responder and help lists while
+// the workers match messages against them
+func TestConcurrentRegisterAndMatch(t *testing.T) {
+	setupTest(t, "")
+	workers = newWorkerPool(4, 10000)
+	dispatch := startDispatcher(t)
+
+	adapters := []string{"chat-0", "chat-1", "chat-2", "chat-3"}
+	for _, id := range adapters {
+		engageAs(t, dispatch, id, "adapter")
+	}
+	responder := engageAs(t, dispatch, "deployer", "responder")
+
+	// only the final messages matter, the ones before can be dropped when the
+	// responder's queue is full
+	finals := make(chan string, len(adapters))
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case q := <-responder:
+				if q.Type == "message" && q.Message.Message == "pris final" {
+					finals <- q.Message.Room
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+
+	command := func(action, id, regex string) {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: "deployer",
+			To:     "server",
+			Command: &commandBlock{Id: id, Action: action, Type: "prefix",
+				Data: regex, Array: []string{id, "test responder"}},
+		}}
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			id := fmt.Sprintf("cmd-%d", i)
+			command("register", id, "^"+id+"$")
+			if i%2 == 0 {
+				command("deregister", id, "")
+			}
+		}
+	}()
+	for _, adapter := range adapters {
+		wg.Add(1)
+		go func(adapter string) {
+			defer wg.Done()
+			for i := 0; i < 100; i++ {
+				dispatch <- &dispatcherRequest{Query: &query{
+					Type:   "message",
+					Source: adapter,
+					Message: testMessage(fmt.Sprintf("pris cmd-%d", i),
+						adapter),
+				}}
+				showHelp("", "")
+			}
+		}(adapter)
+	}
+	wg.Wait()
+
+	command("register", "final", "^final$")
+	for _, adapter := range adapters {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:    "message",
+			Source:  adapter,
+			Message: testMessage("pris final", adapter),
+		}}
+	}
+	rooms := make(map[string]bool)
+	for len(rooms) < len(adapters) {
+		select {
+		case room := <-finals:
+			rooms[room] = true
+		case <-time.After(5 * time.Second):
+			t.Fatal("Final message matched for", rooms, "only")
+		}
+	}
+
+	text := showHelp("", "")
+	if !strings.Contains(text, "cmd-1 -") || strings.Contains(text, "cmd-0 -") {
+		t.Fatal("Unexpected help after the registrations:\n" + text)
+	}
+
+	for _, adapter := range adapters {
+		done := make(chan struct{})
+		workers.submit(adapter, func() { close(done) })
+		<-done
+	}
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var envKeyRegex = regexp.MustCompile("^[A-Za-z_][A-Za-z0-9_]*$")
+
+// checkEnv validates the responder's env keys, PRISCILLA_ARGS and
+// PRISCILLA_DIAGNOSE are set by the server and can't be overridden
+func (pr *passiveResponderConfig) checkEnv() error {
+	for key, value := range pr.Env {
+		if !envKeyRegex.MatchString(key) {
+			return configError("Malformed env variable name for responder",
+				pr.Name+":", key)
+		}
+		if key == "PRISCILLA_ARGS" || key == "PRISCILLA_DIAGNOSE" {
+			return configError("Env variable", key, "is reserved, responder:",
+				pr.Name)
+		}
+		for _, name := range namedSubRegex.FindAllStringSubmatch(value, -1) {
+			if !pr.hasGroup(name[1]) {
+				return configError("No capture group named", name[1],
+					"in the patterns of responder:", pr.Name)
+			}
+		}
+	}
+	return nil
+}
+
+// expandEnv is the responder's env with the same substitutions as its args,
+// sorted by name so cached output is keyed the same way every time
+func (pr *passiveResponderConfig) expandEnv(match []string,
+	captured map[string]string, m *messageBlock, source string) []string {
+
+	return pr.expandPairs(pr.Env, "=", match, captured, m, source)
+}
+
+// expandPairs expands the values of a name to value map, sorted by name and
+// joined with sep
+func (pr *passiveResponderConfig) expandPairs(pairs map[string]string,
+	sep string, match []string, captured map[string]string, m *messageBlock,
+	source string) []string {
+
+	if len(pairs) == 0 {
+		return nil
+	}
+
+	keys := make([]string, 0, len(pairs))
+	for key := range pairs {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	expanded := make([]string, 0, len(keys))
+	for _, key := range keys {
+		expanded = append(expanded, key+sep+
+			expandValue(pairs[key], match, captured, m, source, nil))
+	}
+
+	return expanded
+}
+
+// expandValue applies the substitutions of args to a single value, without
+// dropping anything when a submatch is empty, escape is applied to what's
+// substituted in if it isn't nil
+func expandValue(value string, match []string, captured map[string]string,
+	m *messageBlock, source string, escape func(string) string) string {
+
+	if escape == nil {
+		escape = func(s string) string { return s }
+	}
+
+	value = subRegex.ReplaceAllStringFunc(value, func(token string) string {
+		// a submatch that doesn't exist is left as is, like in args
+		mId, _ := strconv.Atoi(strings.Trim(token, "_"))
+		if mId < len(match)-1 {
+			return escape(match[mId+1])
+		}
+		return token
+	})
+	value = namedSubRegex.ReplaceAllStringFunc(value,
+		func(token string) string {
+			return escape(captured[namedSubRegex.FindStringSubmatch(token)[1]])
+		})
+	value = strings.Replace(value, "__room__", escape(m.Room), -1)
+
+	sender := map[string]string{"user": m.From, "source": source}
+	return senderRegex.ReplaceAllStringFunc(value, func(token string) string {
+		if token[0] == '\\' {
+			return token[1:]
+		}
+		return escape(sender[strings.Trim(token, "_")])
+	})
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// replyWatcher keeps a timer for every message forwarded to an active
+// responder registered with a reply timeout, the room gets the fallback
+// message if the responder doesn't reply to the message before it fires
+type replyWatcher struct {
+	lock    sync.Mutex
+	pending map[string]*time.Timer
+}
+
+var replies = &replyWatcher{pending: make(map[string]*time.Timer)}
+
+// watch starts waiting for the responder's reply to the message from the
+// adapter, messages without an id can't be matched to a reply
+func (w *replyWatcher) watch(responder string, ar *activeResponderConfig,
+	adapter string, m *messageBlock, dispatch chan<- *dispatcherRequest) {
+
+	if m.Id == "" {
+		logger.Debug.Println("Not watching for a reply, message has no id")
+		return
+	}
+
+	key := routeKey(responder, m.Id)
+	fallback := ar.fallback
+	if fallback == "" {
+		fallback = conf.ReplyFallback
+	}
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if timer, ok := w.pending[key]; ok {
+		timer.Stop()
+	}
+
+	w.pending[key] = time.AfterFunc(ar.replyTimeout, func() {
+		w.lock.Lock()
+		delete(w.pending, key)
+		w.lock.Unlock()
+
+		logger.Warn.Println("No reply from", responder, "to message", m.Id)
+		dispatch <- &dispatcherRequest{
+			Query: &query{
+				Type:   "message",
+				Source: "server",
+				To:     adapter,
+				Message: &messageBlock{
+					Message: fallback,
+					Room:    m.Room,
+					Thread:  m.Thread,
+				},
+			},
+		}
+	})
+}
+
+// replied stops waiting once the responder replied to the message
+func (w *replyWatcher) replied(responder, id string) {
+	key := routeKey(responder, id)
+
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if timer, ok := w.pending[key]; ok {
+		timer.Stop()
+		delete(w.pending, key)
+	}
+}
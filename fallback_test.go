@@ -0,0 +1,81 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFallbackWhenResponderDoesNotReply(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	silent := engageAs(t, dispatch, "silent", "responder")
+	quick := engageAs(t, dispatch, "quick", "responder")
+
+	register := func(source, regex string, opts map[string]string) {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:   "command",
+			Source: source,
+			To:     "server",
+			Command: &commandBlock{Id: source, Action: "register",
+				Type: "prefix", Data: regex, Map: opts,
+				Array: []string{regex, "test responder"}},
+		}}
+	}
+	register("silent", "^status$", map[string]string{"reply-timeout": "1",
+		"fallback": "Status checker didn't answer"})
+	register("quick", "^ping$", map[string]string{"reply-timeout": "1"})
+
+	ask := func(id, text string) {
+		m := testMessage(text, "ops")
+		m.Id = id
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:    "message",
+			Source:  "chat",
+			Message: m,
+		}}
+	}
+
+	ask("m-1", "pris status")
+	silent.next(t, "message")
+	asked := time.Now()
+	q := adapter.next(t, "message")
+	if q.Message.Message != "Status checker didn't answer" ||
+		q.Message.Room != "ops" {
+
+		t.Fatal("Unexpected fallback:", *q.Message)
+	}
+	if waited := time.Since(asked); waited < 900*time.Millisecond {
+		t.Fatal("Fallback sent before the timeout:", waited)
+	}
+
+	ask("m-2", "pris ping")
+	quick.next(t, "message")
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "message",
+		Source: "quick",
+		To:     "chat",
+		Message: &messageBlock{Message: "pong", Room: "ops",
+			ReplyTo: "m-2"},
+	}}
+	if q := adapter.next(t, "message"); q.Message.Message != "pong" {
+		t.Fatal("Unexpected reply:", *q.Message)
+	}
+
+	// a responder that replied gets no fallback sent for it
+	time.Sleep(1200 * time.Millisecond)
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:    "message",
+		Source:  "quick",
+		To:      "chat",
+		Message: &messageBlock{Message: "marker", Room: "ops"},
+	}}
+	if q := adapter.next(t, "message"); q.Message.Message != "marker" {
+		t.Fatal("Fallback sent after a reply:", *q.Message)
+	}
+
+	done := make(chan struct{})
+	workers.submit("chat", func() { close(done) })
+	<-done
+}
@@ -0,0 +1,25 @@
+package main
+
+// followUpScope limits a follow-up responder to one conversation, the next
+// matching message from anywhere else goes through normal matching
+type followUpScope struct {
+	adapter string
+	room    string
+	user    string
+}
+
+// newFollowUpScope reads the conversation from the register command's map,
+// the adapter defaults to any, room and user to the ones given
+func newFollowUpScope(m map[string]string) *followUpScope {
+	return &followUpScope{
+		adapter: m["adapter"],
+		room:    m["room"],
+		user:    m["user"],
+	}
+}
+
+func (s *followUpScope) matches(source string, m *messageBlock) bool {
+	return (s.adapter == "" || s.adapter == source) &&
+		(s.room == "" || s.room == m.Room) &&
+		(s.user == "" || s.user == m.From)
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"regexp"
+)
+
+type outboundConfig struct {
+	Prefix        string `yaml:"prefix"`
+	Suffix        string `yaml:"suffix"`
+	StripMarkdown bool   `yaml:"strip-markdown"`
+}
+
+// outboundConfigs are keyed by source id or "label:<name>"
+type outboundConfigs map[string]*outboundConfig
+
+// markdown constructs stripped from replies to plain text rooms, in order,
+// each one is replaced with its text
+var markdownRules = []struct {
+	regex   *regexp.Regexp
+	replace string
+}{
+	{regexp.MustCompile("(?s)```[a-z]*\n?(.*?)```"), "$1"},
+	{regexp.MustCompile("`([^`]+)`"), "$1"},
+	{regexp.MustCompile(`!?\[([^\]]*)\]\(([^)\s]+)\)`), "$1 ($2)"},
+	{regexp.MustCompile(`(?m)^#{1,6}\s+`), ""},
+	{regexp.MustCompile(`(?m)^>\s?`), ""},
+	{regexp.MustCompile(`(\*\*|__)(\S|\S.*?\S)(\*\*|__)`), "$2"},
+	{regexp.MustCompile(`~~(\S|\S.*?\S)~~`), "$1"},
+	{regexp.MustCompile(`(^|[^\w*])[*_](\S|\S.*?\S)[*_]($|[^\w*])`),
+		"$1$2$3"},
+}
+
+func stripMarkdown(text string) string {
+	for _, rule := range markdownRules {
+		text = rule.regex.ReplaceAllString(text, rule.replace)
+	}
+	return text
+}
+
+// applyRoomFormat downgrades the message to plain text if its room is
+// configured as a plain text room, rich rooms get the message as is
+func (m *messageBlock) applyRoomFormat() {
+	if conf.RoomFormats[m.Room] != "plain" || m.Format == "plain" {
+		return
+	}
+
+	m.Message = stripMarkdown(m.Message)
+	m.Format = "plain"
+}
+
+// lookup finds the transform for messages to the connection, configured for
+// its source id or, failing that, one of its auth hook labels
+func (o outboundConfigs) lookup(source string,
+	labels []string) *outboundConfig {
+
+	if oc, ok := o[source]; ok {
+		return oc
+	}
+
+	for _, label := range labels {
+		if oc, ok := o["label:"+label]; ok {
+			return oc
+		}
+	}
+	return nil
+}
+
+// applyOutbound applies the connection's transform on top of the room format,
+// the prefix and suffix are added after markdown is stripped so they're sent
+// as configured
+func (m *messageBlock) applyOutbound(oc *outboundConfig) {
+	if oc == nil {
+		return
+	}
+
+	if oc.StripMarkdown && m.Format != "plain" {
+		m.Message = stripMarkdown(m.Message)
+		m.Format = "plain"
+	}
+
+	if m.Message != "" {
+		m.Message = oc.Prefix + m.Message + oc.Suffix
+	}
+}
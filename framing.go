@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"net"
+)
+
+// queryEncoder writes queries to a connection, json.Encoder is the default
+// streaming encoding, frameEncoder is used by connections that negotiated
+// length-prefixed framing at engagement
+type queryEncoder interface {
+	Encode(v interface{}) error
+}
+
+type queryDecoder interface {
+	Decode(v interface{}) error
+}
+
+var (
+	errFrameTooLarge   = errors.New("Frame exceeds max-frame-size")
+	errMessageTooLarge = errors.New("Query exceeds max-message-bytes")
+)
+
+// every frame is a 4 byte big-endian length followed by a JSON body of that
+// length
+type frameEncoder struct {
+	w io.Writer
+}
+
+type frameDecoder struct {
+	r   io.Reader
+	max uint32
+}
+
+func newFrameEncoder(w io.Writer) *frameEncoder {
+	return &frameEncoder{w: w}
+}
+
+func newFrameDecoder(r io.Reader, max int) *frameDecoder {
+	return &frameDecoder{r: r, max: uint32(max)}
+}
+
+func (e *frameEncoder) Encode(v interface{}) error {
+	body, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+
+	// header and body in a single write so frames never interleave
+	_, err = e.w.Write(frame)
+	return err
+}
+
+// Decode reads the next frame into v, a frame over the size limit is skipped
+// and reported with errFrameTooLarge, the connection stays usable
+func (d *frameDecoder) Decode(v interface{}) error {
+	var header [4]byte
+	if _, err := io.ReadFull(d.r, header[:]); err != nil {
+		return frameReadError(err)
+	}
+
+	size := binary.BigEndian.Uint32(header[:])
+	if size > d.max {
+		if _, err := io.CopyN(ioutil.Discard, d.r, int64(size)); err != nil {
+			return frameReadError(err)
+		}
+		return errFrameTooLarge
+	}
+
+	body := make([]byte, size)
+	if _, err := io.ReadFull(d.r, body); err != nil {
+		return frameReadError(err)
+	}
+
+	return json.Unmarshal(body, v)
+}
+
+// messageLimiter caps how much is read from a connection for a single query,
+// so nothing gets buffered without bound while decoding, reset is called
+// before every query
+type messageLimiter struct {
+	r    io.Reader
+	max  int64
+	read int64
+}
+
+func newMessageLimiter(r io.Reader, max int) *messageLimiter {
+	return &messageLimiter{r: r, max: int64(max)}
+}
+
+func (l *messageLimiter) Read(p []byte) (int, error) {
+	if l.max < 0 {
+		return l.r.Read(p)
+	}
+	if l.read >= l.max {
+		return 0, errMessageTooLarge
+	}
+	if int64(len(p)) > l.max-l.read {
+		p = p[:l.max-l.read]
+	}
+	n, err := l.r.Read(p)
+	l.read += int64(n)
+	return n, err
+}
+
+func (l *messageLimiter) reset() {
+	l.read = 0
+}
+
+// frameReadError reports a connection closed mid-frame as EOF, same as one
+// closed between frames
+func frameReadError(err error) error {
+	if err == io.ErrUnexpectedEOF {
+		return io.EOF
+	}
+	return err
+}
+
+// decodeRecoverable tells whether the connection can still be read after the
+// decode error, the decoder has to know where the next query starts
+func decodeRecoverable(err error, framed bool) bool {
+	switch err.(type) {
+	case *json.UnmarshalTypeError:
+		// the whole value was read, only its content was wrong
+		return true
+	case *json.SyntaxError:
+		// a frame is skipped as a whole, the stream has no way to resync
+		return framed
+	}
+
+	if err == errFrameTooLarge {
+		return true
+	}
+
+	// a timeout in the middle of a frame loses its length
+	return isTimeout(err) && !framed
+}
+
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
+
+// wantsFraming tells whether the engagement negotiates length-prefixed
+// framing
+func (c *commandBlock) wantsFraming() bool {
+	for _, option := range c.Options {
+		if option == "framed" {
+			return true
+		}
+	}
+	return false
+}
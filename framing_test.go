@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+)
+
+func writeFrame(t *testing.T, conn net.Conn, body string) {
+	t.Helper()
+
+	frame := make([]byte, 4+len(body))
+	binary.BigEndian.PutUint32(frame, uint32(len(body)))
+	copy(frame[4:], body)
+	if _, err := conn.Write(frame); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFramedExchange(t *testing.T) {
+	setupTest(t, "")
+	conf.MaxFrameSize = 256
+
+	port := freePort(t)
+	server, err := newServerListener(
+		listenConfig{ip: "127.0.0.1", port: port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := make(chan *dispatcherRequest, 10)
+	server.start(dispatch)
+	defer server.Close()
+
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	fmt.Fprint(conn, `{"type": "command", "source": "adapter", `+
+		`"command": {"action": "engage", "type": "adapter", `+
+		`"options": ["framed"]}}`)
+	req := nextRequest(t, dispatch, "engage", "adapter")
+	if req.Framed == nil {
+		t.Fatal("Framing not negotiated")
+	}
+
+	// server to client, one length-prefixed JSON body per query
+	req.Framed.Encode(&query{Type: "message", Source: "server",
+		To: "adapter", Message: &messageBlock{Message: "hi", Room: "room"}})
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		t.Fatal(err)
+	}
+	body := make([]byte, binary.BigEndian.Uint32(header[:]))
+	if _, err := io.ReadFull(conn, body); err != nil {
+		t.Fatal(err)
+	}
+	q := new(query)
+	if err := json.Unmarshal(body, q); err != nil {
+		t.Fatal("Frame body isn't a single query:", err)
+	}
+	if q.Message == nil || q.Message.Message != "hi" {
+		t.Fatal("Unexpected query framed:", string(body))
+	}
+
+	// client to server, a frame over the limit is skipped and the next one
+	// still gets through
+	message := `{"type": "message", "source": "adapter", ` +
+		`"message": {"message": "%s", "room": "room"}}`
+	writeFrame(t, conn, fmt.Sprintf(message,
+		string(bytes.Repeat([]byte("x"), 256))))
+	writeFrame(t, conn, fmt.Sprintf(message, "after"))
+
+	req = nextRequest(t, dispatch, "message", "")
+	if req.Query.Message.Message != "after" {
+		t.Fatal("Oversized frame not skipped:", req.Query.Message.Message)
+	}
+
+	hangUp(t, dispatch, conn)
+}
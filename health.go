@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// health is what the probes report, the flags are set by the goroutines
+// they describe
+var health struct {
+	dispatching int32
+	accepting   int32
+}
+
+func setHealth(flag *int32, up bool) {
+	if up {
+		atomic.StoreInt32(flag, 1)
+	} else {
+		atomic.StoreInt32(flag, 0)
+	}
+}
+
+// serveHealth exposes /healthz, ok while the dispatcher runs, and /readyz,
+// ok while connections are being accepted too, on its own port
+func serveHealth(port int) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", func(w http.ResponseWriter, r *http.Request) {
+		probe(w, atomic.LoadInt32(&health.dispatching) == 1)
+	})
+	mux.HandleFunc("/readyz", func(w http.ResponseWriter, r *http.Request) {
+		probe(w, atomic.LoadInt32(&health.dispatching) == 1 &&
+			atomic.LoadInt32(&health.accepting) == 1)
+	})
+
+	go func() {
+		err := http.Serve(listener, mux)
+		logger.Error.Println("Health endpoint stopped:", err)
+	}()
+	return nil
+}
+
+func probe(w http.ResponseWriter, ok bool) {
+	if !ok {
+		http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	w.Write([]byte("ok\n"))
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type heartbeatConfig struct {
+	Interval int `yaml:"interval"`
+	Timeout  int `yaml:"timeout"`
+}
+
+// touch records that a query was just read from the connection
+func (c *connIdentity) touch() {
+	atomic.StoreInt64(&c.seen, time.Now().UnixNano())
+}
+
+func (c *connIdentity) lastSeen() time.Time {
+	return time.Unix(0, atomic.LoadInt64(&c.seen))
+}
+
+// heartbeat has the dispatcher check the connections for idle and
+// unresponsive ones every timeout
+func heartbeat(hc *heartbeatConfig, dispatch chan<- *dispatcherRequest) {
+	for range time.Tick(time.Duration(hc.Timeout) * time.Second) {
+		dispatch <- &dispatcherRequest{
+			Query: &query{
+				Type:    "command",
+				Source:  "server",
+				Command: &commandBlock{Action: "heartbeat"},
+			},
+		}
+	}
+}
+
+// heartbeats returns the connections idle long enough to be pinged and the
+// ones that haven't sent anything within timeout of their ping, any query
+// counts as the answer, not only a pong
+func (r *connRegistry) heartbeats(idle, timeout time.Duration,
+	now time.Time) (ping, dead []string) {
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for id, entry := range r.conns {
+		if r.aliases[id] || entry.id == nil {
+			continue
+		}
+		seen := entry.id.lastSeen()
+
+		if !entry.pinged.IsZero() && seen.After(entry.pinged) {
+			entry.pinged = time.Time{}
+		}
+
+		switch {
+		case entry.pinged.IsZero() && now.Sub(seen) >= idle:
+			entry.pinged = now
+			ping = append(ping, id)
+		case !entry.pinged.IsZero() && now.Sub(entry.pinged) >= timeout:
+			dead = append(dead, id)
+		}
+	}
+
+	return ping, dead
+}
+
+// checkHeartbeats pings the idle connections and closes the ones that
+// didn't answer, their serve() disengages them
+func checkHeartbeats(connMap *connRegistry) {
+	ping, dead := connMap.heartbeats(
+		time.Duration(conf.Heartbeat.Interval)*time.Second,
+		time.Duration(conf.Heartbeat.Timeout)*time.Second, time.Now())
+
+	for _, id := range ping {
+		if encoder, ok := connMap.get(id); ok {
+			encoder.Encode(pingQuery(id, generateId()))
+		}
+	}
+
+	for _, id := range dead {
+		logger.Warn.Println("No answer to ping from", id+",",
+			"closing connection")
+		connMap.close(id)
+	}
+}
+
+// pingWaiter lets a server ping wait for its pong, pings are told apart by
+// their random id
+type pingWaiter struct {
+	lock    sync.Mutex
+	pending map[string]chan struct{}
+}
+
+var pings = &pingWaiter{pending: make(map[string]chan struct{})}
+
+// ping sends a ping to the connection, the returned channel is closed when
+// it's answered, forget has to be called if it never is
+func (w *pingWaiter) ping(encoder queryEncoder, to string) (string,
+	<-chan struct{}) {
+
+	id := generateId()
+	answered := make(chan struct{})
+
+	w.lock.Lock()
+	w.pending[id] = answered
+	w.lock.Unlock()
+
+	encoder.Encode(pingQuery(to, id))
+	return id, answered
+}
+
+// answered is called by the dispatcher for every pong
+func (w *pingWaiter) answered(id string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	if answered, ok := w.pending[id]; ok {
+		close(answered)
+		delete(w.pending, id)
+	}
+}
+
+func (w *pingWaiter) forget(id string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	delete(w.pending, id)
+}
+
+func pingQuery(to, id string) *query {
+	return &query{
+		Type:   "command",
+		Source: "server",
+		To:     to,
+		Command: &commandBlock{
+			Id:     id,
+			Action: "ping",
+		},
+	}
+}
+
+func pongReply(to, id string) *query {
+	q := pingQuery(to, id)
+	q.Command.Action = "pong"
+	return q
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// maxHTTPReply is the most read from the response of an http responder
+const maxHTTPReply = 1 << 20
+
+var httpMethods = map[string]bool{
+	"GET":    true,
+	"POST":   true,
+	"PUT":    true,
+	"PATCH":  true,
+	"DELETE": true,
+}
+
+// httpStatusError is a response outside of 2xx from an http responder
+type httpStatusError struct {
+	code   int
+	status string
+}
+
+func (e *httpStatusError) Error() string {
+	return "Unexpected response: " + e.status
+}
+
+// setupHTTP validates a responder with "type: http", it's called instead of
+// the checks for "cmd"
+func (pr *passiveResponderConfig) setupHTTP() error {
+	if pr.Cmd != "" {
+		return configError("Responder", pr.Name, "can't have both cmd and url")
+	}
+
+	if pr.ArgsJson != "" || len(pr.Args) > 0 || len(pr.Env) > 0 ||
+		pr.Workdir != "" {
+
+		return configError("Responder", pr.Name, "is http, args, args-json,",
+			"env and workdir only apply to commands")
+	}
+
+	if !strings.HasPrefix(pr.Url, "http://") &&
+		!strings.HasPrefix(pr.Url, "https://") {
+
+		return configError("Responder", pr.Name, "needs an http(s) url")
+	}
+
+	pr.Method = strings.ToUpper(pr.Method)
+	if pr.Method == "" {
+		pr.Method = "POST"
+	}
+	if !httpMethods[pr.Method] {
+		return configError("Unsupported method for responder:", pr.Name,
+			pr.Method)
+	}
+
+	if pr.Headers == nil {
+		pr.Headers = make(map[string]string)
+	}
+	contentType := ""
+	for name, value := range pr.Headers {
+		if name == "" || strings.ContainsAny(name, ": \r\n") {
+			return configError("Malformed header for responder",
+				pr.Name+":", name)
+		}
+		if strings.EqualFold(name, "Content-Type") {
+			contentType = value
+		}
+	}
+	if pr.Body != "" && contentType == "" {
+		contentType = "application/json"
+		pr.Headers["Content-Type"] = contentType
+	}
+	pr.jsonBody = strings.Contains(contentType, "json")
+
+	values := []string{pr.Url, pr.Body}
+	for _, value := range pr.Headers {
+		values = append(values, value)
+	}
+	for _, value := range values {
+		for _, name := range namedSubRegex.FindAllStringSubmatch(value, -1) {
+			if !pr.hasGroup(name[1]) {
+				return configError("No capture group named", name[1],
+					"in the patterns of responder:", pr.Name)
+			}
+		}
+	}
+
+	if pr.Timeout == 0 {
+		pr.Timeout = 10
+	}
+	pr.client = &http.Client{
+		Timeout: time.Duration(pr.Timeout) * time.Second,
+	}
+
+	return nil
+}
+
+// httpArgs stands in for the args and env of a command, the url and the body
+// are the args and the headers the env, so caching and retries apply to http
+// responders unchanged
+func (pr *passiveResponderConfig) httpArgs(match []string,
+	captured map[string]string, m *messageBlock, source string) ([]string,
+	[]string) {
+
+	var escape func(string) string
+	if pr.jsonBody {
+		escape = jsonEscape
+	}
+
+	args := []string{
+		expandValue(pr.Url, match, captured, m, source, urlEscape),
+		expandValue(pr.Body, match, captured, m, source, escape),
+	}
+	return args, pr.expandPairs(pr.Headers, ": ", match, captured, m, source)
+}
+
+// httpOutput sends the request and returns the response body as the output,
+// the request is given up on at the deadline
+func (pr *passiveResponderConfig) httpOutput(args, headers []string,
+	deadline time.Time) ([]byte, error) {
+
+	var body io.Reader
+	if args[1] != "" {
+		body = strings.NewReader(args[1])
+	}
+
+	req, err := http.NewRequest(pr.Method, args[0], body)
+	if err != nil {
+		return nil, err
+	}
+	if !deadline.IsZero() {
+		ctx, cancel := context.WithDeadline(context.Background(), deadline)
+		defer cancel()
+		req = req.WithContext(ctx)
+	}
+
+	for _, header := range headers {
+		if i := strings.Index(header, ": "); i > 0 {
+			req.Header.Set(header[:i], header[i+2:])
+		}
+	}
+
+	resp, err := pr.client.Do(req)
+	if err != nil {
+		if isTimeout(err) {
+			return nil, errCommandTimeout
+		}
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	output, err := ioutil.ReadAll(io.LimitReader(resp.Body, maxHTTPReply))
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return output, &httpStatusError{
+			code:   resp.StatusCode,
+			status: resp.Status,
+		}
+	}
+
+	return output, err
+}
+
+// urlEscape keeps substitutions from changing the url's structure, spaces
+// are %20 so it works in the path as well as the query
+func urlEscape(s string) string {
+	return strings.Replace(url.QueryEscape(s), "+", "%20", -1)
+}
+
+// jsonEscape makes the substitution safe inside a JSON string in the body
+func jsonEscape(s string) string {
+	encoded, _ := json.Marshal(s)
+	return string(encoded[1 : len(encoded)-1])
+}
+
+func (e *httpStatusError) notice(name string) string {
+	return fmt.Sprintf("%s failed with HTTP status %d", name, e.code)
+}
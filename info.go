@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"time"
+)
+
+type infoRequestsConfig struct {
+	Allow []string `yaml:"allow"`
+	Rate  int      `yaml:"rate"`
+}
+
+// infoGuard decides which responders may send info requests to adapters and
+// rate limits them per responder, it's only used by the dispatcher
+type infoGuard struct {
+	allow   map[string]bool
+	rate    int
+	buckets map[string]*infoBucket
+}
+
+var infoAccess *infoGuard
+
+// infoBucket is a token bucket holding up to rate requests, refilled at rate
+// requests per minute
+type infoBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newInfoGuard(ic *infoRequestsConfig) (*infoGuard, error) {
+	g := &infoGuard{buckets: make(map[string]*infoBucket)}
+
+	if ic == nil {
+		return g, nil
+	}
+
+	if ic.Rate < 0 {
+		return nil, errors.New("Info request rate can't be negative")
+	}
+	g.rate = ic.Rate
+
+	if len(ic.Allow) > 0 {
+		g.allow = make(map[string]bool)
+		for _, source := range ic.Allow {
+			g.allow[source] = true
+		}
+	}
+
+	return g, nil
+}
+
+// check returns an error if the source may not send an info request now,
+// every source is allowed unless there's an allow list, and unlimited unless
+// there's a rate. The allow list can name sources, or labels given by the
+// auth hook as "label:<name>".
+func (g *infoGuard) check(source string, labels []string) error {
+	if g.allow != nil && !g.allow[source] {
+		allowed := false
+		for _, label := range labels {
+			if g.allow["label:"+label] {
+				allowed = true
+				break
+			}
+		}
+
+		if !allowed {
+			return errors.New("Not allowed to send info requests")
+		}
+	}
+
+	if g.rate == 0 {
+		return nil
+	}
+
+	now := time.Now()
+	b, ok := g.buckets[source]
+	if !ok {
+		b = &infoBucket{tokens: float64(g.rate), last: now}
+		g.buckets[source] = b
+	}
+
+	b.tokens += now.Sub(b.last).Minutes() * float64(g.rate)
+	if b.tokens > float64(g.rate) {
+		b.tokens = float64(g.rate)
+	}
+	b.last = now
+
+	if b.tokens < 1 {
+		return errors.New("Info request rate limit exceeded")
+	}
+	b.tokens--
+
+	return nil
+}
+
+// reset clears the rate limit of the source, or of every source if it's
+// empty, their next requests start from a full bucket
+func (g *infoGuard) reset(source string) {
+	if source == "" {
+		g.buckets = make(map[string]*infoBucket)
+		return
+	}
+	delete(g.buckets, source)
+}
+
+func (g *infoGuard) forget(source string) {
+	delete(g.buckets, source)
+}
+
+// rename keeps the rate limit of a connection across id rotation
+func (g *infoGuard) rename(old, id string) {
+	if b, ok := g.buckets[old]; ok {
+		g.buckets[id] = b
+		delete(g.buckets, old)
+	}
+}
+
+// checkRequest validates a request a responder sends to an adapter, it needs
+// an id no other request to the adapter is using, so the response can be
+// matched to it
+func (q *query) checkRequest(connMap *connRegistry,
+	requests *routeTracker) error {
+
+	c := q.Command
+	switch {
+	case c.Action == "info":
+		return errors.New("Only adapters can send info responses")
+	case q.To == "" || q.To == "server":
+		return errors.New("Missing destination")
+	case c.Id == "":
+		return errors.New("Missing request id")
+	case c.Action == "delete" && c.Data == "":
+		return errors.New("Missing message id")
+	case requests.pending(q.To, c.Id):
+		return errors.New("Request id already in use: " + c.Id)
+	}
+
+	if _, ok := connMap.get(q.To); !ok {
+		return errors.New("Destination doesn't exist: " + q.To)
+	}
+
+	return nil
+}
+
+// rejectRequest is the reply to a request that wasn't forwarded
+func rejectRequest(to string, c *commandBlock, err error) *query {
+	return &query{
+		Type:   "command",
+		Source: "server",
+		To:     to,
+		Command: &commandBlock{
+			Id:     c.Id,
+			Action: c.Action,
+			Type:   c.Type,
+			Error:  err.Error(),
+		},
+	}
+}
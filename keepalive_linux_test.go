@@ -0,0 +1,81 @@
+package main
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// sockopt reads an integer socket option of the connection
+func sockopt(t *testing.T, conn *net.TCPConn, level, opt int) int {
+	t.Helper()
+
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var value int
+	var optErr error
+	err = raw.Control(func(fd uintptr) {
+		value, optErr = syscall.GetsockoptInt(int(fd), level, opt)
+	})
+	if err != nil || optErr != nil {
+		t.Fatal("Unable to read socket option:", err, optErr)
+	}
+	return value
+}
+
+func TestKeepAliveOnAcceptedConnections(t *testing.T) {
+	setupTest(t, "keepalive: 45\n")
+
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	listener := keepAliveListener{l}
+
+	for _, test := range []struct {
+		keepAlive int
+		enabled   int
+	}{
+		{45, 1},
+		{-1, 0},
+	} {
+		conf.KeepAlive = test.keepAlive
+
+		client, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		conn, err := listener.Accept()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tcpConn := conn.(*net.TCPConn)
+		enabled := sockopt(t, tcpConn, syscall.SOL_SOCKET,
+			syscall.SO_KEEPALIVE)
+		if enabled != test.enabled {
+			t.Errorf("keepalive %d: SO_KEEPALIVE is %d", test.keepAlive,
+				enabled)
+		}
+		if test.enabled == 1 {
+			idle := sockopt(t, tcpConn, syscall.IPPROTO_TCP,
+				syscall.TCP_KEEPIDLE)
+			if idle != test.keepAlive {
+				t.Errorf("Keepalive period is %ds, expected %ds", idle,
+					test.keepAlive)
+			}
+		}
+
+		client.Close()
+		conn.Close()
+	}
+
+	// only TCP connections are touched
+	client, server := net.Pipe()
+	setKeepAlive(server)
+	client.Close()
+	server.Close()
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+)
+
+// listenConfig is the part of the config the listener is built from
+type listenConfig struct {
+	ip   string
+	port int
+	cert string
+	key  string
+	ca   string
+}
+
+func listenConfigOf(c *config) listenConfig {
+	lc := listenConfig{
+		ip:   c.Ip,
+		port: c.Port,
+		cert: c.TlsCert,
+		key:  c.TlsKey,
+		ca:   c.TlsCa,
+	}
+	if lc.port == 0 {
+		lc.port = 4517
+	}
+	return lc
+}
+
+func (lc listenConfig) addr() string {
+	return fmt.Sprintf("%s:%d", lc.ip, lc.port)
+}
+
+// serverListener accepts the client connections, a reload can move it to
+// another address or change its TLS settings without touching the
+// connections already accepted
+type serverListener struct {
+	lock     sync.Mutex
+	conf     listenConfig
+	tcp      net.Listener
+	tls      *tls.Config
+	dispatch chan *dispatcherRequest
+	closed   bool
+}
+
+func newServerListener(lc listenConfig,
+	tc *tls.Config) (*serverListener, error) {
+
+	tcp, err := bind(lc)
+	if err != nil {
+		return nil, err
+	}
+
+	return &serverListener{conf: lc, tcp: tcp, tls: tc}, nil
+}
+
+func bind(lc listenConfig) (net.Listener, error) {
+	listener, err := net.Listen("tcp", lc.addr())
+	if err != nil {
+		return nil, err
+	}
+
+	tcpListener, ok := listener.(*net.TCPListener)
+	if !ok {
+		listener.Close()
+		return nil, errors.New("Listener isn't TCP")
+	}
+
+	return keepAliveListener{tcpListener}, nil
+}
+
+// start begins accepting connections
+func (s *serverListener) start(dispatch chan *dispatcherRequest) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.dispatch = dispatch
+	s.logListening()
+	setHealth(&health.accepting, true)
+	go listen(&acceptor{s.tcp, s}, dispatch)
+}
+
+// rebind applies the listen settings of a reloaded config. A new address is
+// bound before the old listener is closed, so there's no gap in accepting,
+// TLS changes apply to the connections accepted from then on. The running
+// listener is kept if the new settings can't be applied
+func (s *serverListener) rebind(lc listenConfig) error {
+	tc, err := tlsConfig(lc)
+	if err != nil {
+		return err
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.closed || lc == s.conf {
+		return nil
+	}
+
+	if lc.addr() != s.conf.addr() {
+		tcp, err := bind(lc)
+		if err != nil {
+			return err
+		}
+
+		// closing a listener leaves the connections it accepted alone
+		s.tcp.Close()
+		s.tcp = tcp
+		go listen(&acceptor{tcp, s}, s.dispatch)
+	}
+
+	s.conf, s.tls = lc, tc
+	s.logListening()
+	return nil
+}
+
+// Close stops accepting connections for shutdown, a reload doesn't reopen it
+func (s *serverListener) Close() error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.closed = true
+	setHealth(&health.accepting, false)
+	return s.tcp.Close()
+}
+
+func (s *serverListener) logListening() {
+	if s.tls == nil {
+		logger.Info.Println("Listening on", s.conf.addr())
+		return
+	}
+	logger.Info.Println("Listening on", s.conf.addr(), "with TLS, client",
+		"certificates required:", s.tls.ClientCAs != nil)
+}
+
+// acceptor wraps the connections accepted by one of the listener's bindings
+// in the TLS config current at the time
+type acceptor struct {
+	net.Listener
+	server *serverListener
+}
+
+func (a *acceptor) Accept() (net.Conn, error) {
+	conn, err := a.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+
+	a.server.lock.Lock()
+	tc := a.server.tls
+	a.server.lock.Unlock()
+
+	if tc != nil {
+		return tls.Server(conn, tc), nil
+	}
+	return conn, nil
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+)
+
+func freePort(t *testing.T) int {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+// nextRequest waits for the dispatcher request of the given query type or
+// command action, engagements are accepted under the id given
+func nextRequest(t *testing.T, dispatch <-chan *dispatcherRequest,
+	kind, id string) *dispatcherRequest {
+
+	t.Helper()
+
+	for {
+		select {
+		case req := <-dispatch:
+			if req.EngageResp != nil {
+				req.EngageResp <- id
+			}
+			if req.Query.Type == kind || (req.Query.Command != nil &&
+				req.Query.Command.Action == kind) {
+
+				return req
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No", kind, "query dispatched")
+		}
+	}
+}
+
+func engage(t *testing.T, port int) net.Conn {
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal("Unable to connect:", err)
+	}
+	fmt.Fprint(conn, `{"type": "command", "source": "adapter", `+
+		`"command": {"action": "engage", "type": "adapter"}}`)
+	return conn
+}
+
+// hangUp closes the connections and waits for them to be disengaged, so
+// their serve() is done with the config before the next test replaces it
+func hangUp(t *testing.T, dispatch <-chan *dispatcherRequest,
+	conns ...net.Conn) {
+
+	for _, conn := range conns {
+		conn.Close()
+		nextRequest(t, dispatch, "disengage", "")
+	}
+}
+
+func TestReloadMovesListener(t *testing.T) {
+	setupTest(t, "")
+
+	oldPort, newPort := freePort(t), freePort(t)
+	file, err := ioutil.TempFile("", "priscilla-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	fmt.Fprintf(file, "ip: 127.0.0.1\nport: %d\n", newPort)
+	file.Close()
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	server, err := newServerListener(
+		listenConfig{ip: "127.0.0.1", port: oldPort}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server.start(dispatch)
+	defer server.Close()
+
+	existing := engage(t, oldPort)
+	nextRequest(t, dispatch, "engage", "existing")
+
+	reload(file.Name(), server, dispatch)
+	if req := nextRequest(t, dispatch, "reload", ""); req.Reload == nil {
+		t.Fatal("Responders not reloaded")
+	}
+
+	if conn, err := net.Dial("tcp",
+		fmt.Sprintf("127.0.0.1:%d", oldPort)); err == nil {
+
+		conn.Close()
+		t.Fatal("Old port still accepting")
+	}
+
+	conn := engage(t, newPort)
+	nextRequest(t, dispatch, "engage", "new")
+
+	// the connection accepted before the reload is still served
+	fmt.Fprint(existing, `{"type": "message", "source": "existing", `+
+		`"message": {"message": "still here", "room": "room"}}`)
+	req := nextRequest(t, dispatch, "message", "")
+	if req.Query.Message.Message != "still here" {
+		t.Fatal("Unexpected message:", req.Query.Message)
+	}
+
+	hangUp(t, dispatch, existing, conn)
+}
+
+func TestRebindKeepsListenerOnBadSettings(t *testing.T) {
+	setupTest(t, "")
+
+	port := freePort(t)
+	lc := listenConfig{ip: "127.0.0.1", port: port}
+	server, err := newServerListener(lc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := make(chan *dispatcherRequest, 10)
+	server.start(dispatch)
+	defer server.Close()
+
+	bad := lc
+	bad.port, bad.cert, bad.key = freePort(t), "/nonexistent.crt",
+		"/nonexistent.key"
+	if err := server.rebind(bad); err == nil {
+		t.Fatal("Missing certificate accepted")
+	}
+
+	conn := engage(t, port)
+	nextRequest(t, dispatch, "engage", "adapter")
+	hangUp(t, dispatch, conn)
+}
+
+func TestUnknownTypePolicy(t *testing.T) {
+	for _, policy := range []string{"drop", "error", "disconnect"} {
+		setupTest(t, "unknown-type: "+policy+"\n")
+
+		port := freePort(t)
+		server, err := newServerListener(
+			listenConfig{ip: "127.0.0.1", port: port}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dispatch := make(chan *dispatcherRequest, 10)
+		server.start(dispatch)
+
+		conn := engage(t, port)
+		// the dispatcher would set the id when it accepts the engagement
+		nextRequest(t, dispatch, "engage", "adapter").Identity.set("adapter")
+		fmt.Fprint(conn, `{"type": "presence", "source": "adapter"}`+
+			`{"type": "message", "source": "adapter", `+
+			`"message": {"message": "after", "room": "room"}}`)
+
+		req := <-dispatch
+		switch policy {
+		case "drop":
+			if req.Query.Type != "message" {
+				t.Error("drop: unknown type not dropped:", req.Query)
+			}
+		case "error", "disconnect":
+			action := map[string]string{"error": "error",
+				"disconnect": "terminate"}[policy]
+			if !req.Reply || req.Query.To != "adapter" ||
+				req.Query.Command.Action != action ||
+				req.Close != (policy == "disconnect") {
+
+				t.Errorf("%s: unexpected reply %+v: %+v", policy, req,
+					req.Query.Command)
+			}
+			// not disconnected by the server itself, the dispatcher closes
+			// the connection once the terminate is written
+			req = nextRequest(t, dispatch, "message", "")
+			if req.Query.Message.Message != "after" {
+				t.Error(policy+": unexpected message:", req.Query.Message)
+			}
+		}
+
+		hangUp(t, dispatch, conn)
+		server.Close()
+	}
+}
+
+// monitors counts the goroutines logging raw connection input
+func monitors() int {
+	buf := make([]byte, 1<<20)
+	return strings.Count(string(buf[:runtime.Stack(buf, true)]),
+		"priscilla.monitorRaw(")
+}
+
+func TestDebugMonitorEndsWithConnection(t *testing.T) {
+	setupTest(t, "")
+	logOutput = ioutil.Discard
+	defer setLogLevel("error")
+	if err := setLogLevel("debug"); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	server, err := newServerListener(
+		listenConfig{ip: "127.0.0.1", port: port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := make(chan *dispatcherRequest, 10)
+	server.start(dispatch)
+	defer server.Close()
+
+	before := monitors()
+	conn := engage(t, port)
+	nextRequest(t, dispatch, "engage", "adapter")
+	if got := monitors(); got != before+1 {
+		t.Fatal("Expected a monitor for the connection, got:", got-before)
+	}
+
+	hangUp(t, dispatch, conn)
+	for wait := time.Now().Add(2 * time.Second); monitors() > before; {
+		if time.Now().After(wait) {
+			t.Fatal("Monitor outlived its connection")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestReloadAppliesLogLevel(t *testing.T) {
+	setupTest(t, "")
+	out := &syncBuffer{}
+	logOutput = out
+	defer func() {
+		logOutput = ioutil.Discard
+		setLogLevel("error")
+	}()
+	if err := setLogLevel("error"); err != nil {
+		t.Fatal(err)
+	}
+
+	port := freePort(t)
+	file, err := ioutil.TempFile("", "priscilla-conf")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	write := func(level string) {
+		t.Helper()
+		err := ioutil.WriteFile(file.Name(), []byte(fmt.Sprintf(
+			"ip: 127.0.0.1\nport: %d\nloglevel: %s\n", port, level)), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	server, err := newServerListener(
+		listenConfig{ip: "127.0.0.1", port: port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer server.Close()
+
+	logger.Debug.Println("before the reload")
+	write("debug")
+	reload(file.Name(), server, dispatch)
+	nextRequest(t, dispatch, "reload", "")
+	logger.Debug.Println("after the reload")
+
+	logged := out.String()
+	if strings.Contains(logged, "before the reload") ||
+		!strings.Contains(logged, "after the reload") {
+
+		t.Fatal("Level not applied on reload:\n" + logged)
+	}
+
+	write("loud")
+	reload(file.Name(), server, dispatch)
+	select {
+	case req := <-dispatch:
+		t.Fatal("Reload with a bad level applied:", req.Query.Command)
+	default:
+	}
+	if logLevel() != "debug" {
+		t.Fatal("Level changed by a rejected reload:", logLevel())
+	}
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"container/list"
+)
+
+// responderListing describes a registered responder to clients debugging
+// their setup, nothing from the config beyond what matches is included
+type responderListing struct {
+	Name     string   `json:"name,omitempty"`
+	Source   string   `json:"source"`
+	Type     string   `json:"type"`
+	Patterns []string `json:"patterns"`
+	Help     string   `json:"help,omitempty"`
+}
+
+// listResponders is the reply to list-responders, passive responders are
+// listed with "server" as their source
+func listResponders(to, id string) *query {
+	listings := make([]*responderListing, 0)
+
+	routeLock.RLock()
+	for _, group := range []struct {
+		kind string
+		prl  *list.List
+	}{
+		{"prefix", prefixPResponders},
+		{"noprefix", noPrefixPResponders},
+		{"mention", mentionPResponders},
+		{"attachment", attachmentPResponders},
+	} {
+		for epr := group.prl.Front(); epr != nil; epr = epr.Next() {
+			listings = append(listings,
+				epr.Value.(*passiveResponderConfig).listing(group.kind))
+		}
+	}
+
+	for _, group := range []struct {
+		kind string
+		arl  *list.List
+	}{
+		{"prefix", prefixAResponders},
+		{"noprefix", noPrefixAResponders},
+		{"mention", mentionAResponders},
+		{"unhandled", unhandledAResponders},
+	} {
+		for eAr := group.arl.Front(); eAr != nil; eAr = eAr.Next() {
+			ar := eAr.Value.(*activeResponderConfig)
+			listings = append(listings, &responderListing{
+				Name:     ar.id,
+				Source:   ar.source,
+				Type:     group.kind,
+				Patterns: []string{ar.regex.String()},
+				Help:     ar.help,
+			})
+		}
+	}
+	routeLock.RUnlock()
+
+	return &query{
+		Type:   "command",
+		Source: "server",
+		To:     to,
+		Command: &commandBlock{
+			Id:         id,
+			Action:     "list-responders",
+			Responders: listings,
+		},
+	}
+}
+
+func (pr *passiveResponderConfig) listing(kind string) *responderListing {
+	patterns := pr.Match
+	switch kind {
+	case "mention":
+		patterns = pr.MentionMatch
+	case "attachment":
+		patterns = append(append([]string{}, pr.AttachmentMatch.Name...),
+			pr.AttachmentMatch.Mime...)
+	}
+
+	return &responderListing{
+		Name:     pr.Name,
+		Source:   "server",
+		Type:     kind,
+		Patterns: patterns,
+		Help:     pr.Help,
+	}
+}
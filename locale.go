@@ -0,0 +1,52 @@
+package main
+
+import (
+	"strings"
+)
+
+// normalizeLocale makes "pt_BR" and "pt-br" the same locale
+func normalizeLocale(locale string) string {
+	return strings.ToLower(strings.Replace(locale, "_", "-", -1))
+}
+
+func localeLanguage(locale string) string {
+	if i := strings.Index(locale, "-"); i >= 0 {
+		return locale[:i]
+	}
+	return locale
+}
+
+// localeMatches tells whether locale is one of locales, an entry without a
+// region ("pt") matches every region of the language ("pt-BR")
+func localeMatches(locales []string, locale string) bool {
+	locale = normalizeLocale(locale)
+	if locale == "" {
+		return false
+	}
+
+	for _, l := range locales {
+		l = normalizeLocale(l)
+		if l == locale || l == localeLanguage(locale) {
+			return true
+		}
+	}
+	return false
+}
+
+// localized picks the text for locale, falling back to the text for its
+// language and then to def
+func localized(texts map[string]string, locale, def string) string {
+	if len(texts) == 0 || locale == "" {
+		return def
+	}
+
+	locale = normalizeLocale(locale)
+	for _, candidate := range []string{locale, localeLanguage(locale)} {
+		for l, text := range texts {
+			if normalizeLocale(l) == candidate {
+				return text
+			}
+		}
+	}
+	return def
+}
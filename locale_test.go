@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocaleRouting(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: salut
+    match: ["^hello$"]
+    cmd: /bin/echo
+    args: ["salut"]
+    locales: ["fr"]
+    help: say hello
+    help-locales:
+      fr: dire bonjour
+    help-commands: ["hello"]
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+    args: ["hello"]
+    locales: ["en"]
+    help: say hello
+    help-commands: ["hello"]
+`)
+	dispatch := make(chan *dispatcherRequest, 10)
+
+	for _, test := range []struct {
+		locale, reply string
+	}{
+		{"fr", "salut"},
+		{"fr_CA", "salut"},
+		{"en-US", "hello"},
+		{"de", ""},
+	} {
+		m := testMessage("pris hello", "room")
+		m.Locale = test.locale
+		m.handleMessage("adapter", dispatch)
+
+		got := collectReplies(t, dispatch, 1, 500*time.Millisecond)
+		if test.reply == "" && len(got) != 0 ||
+			test.reply != "" && (len(got) != 1 || got[0] != test.reply) {
+
+			t.Errorf("Locale %s got %v, expected %q", test.locale, got,
+				test.reply)
+		}
+	}
+
+	for _, test := range []struct {
+		locale, shown, hidden string
+	}{
+		{"fr-FR", "dire bonjour", "say hello"},
+		{"en", "say hello", "dire bonjour"},
+	} {
+		if text := showHelp("", test.locale); !strings.Contains(text,
+			test.shown) || strings.Contains(text, test.hidden) {
+
+			t.Errorf("Help for %s:\n%s", test.locale, text)
+		}
+	}
+
+	// a locale without its own text falls back to the default
+	texts := map[string]string{"fr": "dire bonjour"}
+	if got := localized(texts, "es", "say hello"); got != "say hello" {
+		t.Error("Expected the default help, got:", got)
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+)
+
+type lockoutConfig struct {
+	Failures int `yaml:"failures"`
+	Window   int `yaml:"window"`
+	Cooldown int `yaml:"cooldown"`
+}
+
+var errLockedOut = errors.New(
+	"Too many failed engagements, try again later")
+
+// engageLockout counts failed engagements per remote ip, an ip that fails
+// too often within the window can't engage until the cooldown is over. A
+// connection checks it before the auth hook runs, the dispatcher checks it
+// again and records the outcome
+type engageLockout struct {
+	lock     sync.Mutex
+	conf     *lockoutConfig
+	failures map[string][]time.Time
+	locked   map[string]time.Time
+}
+
+// engageLocks is nil unless "engage-lockout" is configured
+var engageLocks *engageLockout
+
+func newEngageLockout(lc *lockoutConfig) *engageLockout {
+	return &engageLockout{
+		conf:     lc,
+		failures: make(map[string][]time.Time),
+		locked:   make(map[string]time.Time),
+	}
+}
+
+// check returns errLockedOut while the ip is in its cooldown
+func (l *engageLockout) check(ip string, now time.Time) error {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	until, ok := l.locked[ip]
+	if !ok {
+		return nil
+	}
+	if now.Before(until) {
+		return errLockedOut
+	}
+	delete(l.locked, ip)
+	return nil
+}
+
+// fail records a failed engagement and locks the ip out once it reaches the
+// limit
+func (l *engageLockout) fail(ip string, now time.Time) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	window := time.Duration(l.conf.Window) * time.Second
+	l.prune(now.Add(-window))
+
+	l.failures[ip] = append(l.failures[ip], now)
+	if len(l.failures[ip]) < l.conf.Failures {
+		return
+	}
+
+	logger.Warn.Println("Locking out", ip, "after", len(l.failures[ip]),
+		"failed engagements")
+	l.locked[ip] = now.Add(time.Duration(l.conf.Cooldown) * time.Second)
+	delete(l.failures, ip)
+}
+
+func (l *engageLockout) reset(ip string) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+
+	delete(l.failures, ip)
+}
+
+// prune forgets failures older than the window, so ips that stopped trying
+// don't stay around, the caller holds the lock
+func (l *engageLockout) prune(cutoff time.Time) {
+	for ip, times := range l.failures {
+		i := 0
+		for i < len(times) && !times[i].After(cutoff) {
+			i++
+		}
+		if i == len(times) {
+			delete(l.failures, ip)
+		} else {
+			l.failures[ip] = times[i:]
+		}
+	}
+}
+
+// remoteIP is the address a connection's lockout is tracked by
+func remoteIP(addr net.Addr) string {
+	if addr == nil {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// recordEncoder keeps what's written to a connection
+type recordEncoder struct {
+	sent []*query
+}
+
+func (e *recordEncoder) Encode(v interface{}) error {
+	e.sent = append(e.sent, v.(*query))
+	return nil
+}
+
+func TestLockoutCheckedBeforeAuthHook(t *testing.T) {
+	setupTest(t, "")
+
+	dir, err := ioutil.TempDir("", "priscilla-lockout")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	ran := filepath.Join(dir, "hook-ran")
+	conf.AuthHook = &authHookConfig{Cmd: "/bin/touch", Args: []string{ran}}
+
+	engageLocks = newEngageLockout(
+		&lockoutConfig{Failures: 2, Window: 60, Cooldown: 300})
+	for i := 0; i < 2; i++ {
+		engageLocks.fail("192.0.2.1", time.Now())
+	}
+
+	encoder := &recordEncoder{}
+	_, err = initialize(&query{
+		Type:    "command",
+		Source:  "adapter",
+		Command: &commandBlock{Action: "engage", Type: "adapter"},
+	}, encoder, nil, nil, nil, "192.0.2.1", nil)
+
+	if err != errLockedOut {
+		t.Fatal("Locked out ip not refused:", err)
+	}
+	if _, err := os.Stat(ran); !os.IsNotExist(err) {
+		t.Fatal("Auth hook ran for a locked out ip")
+	}
+	if len(encoder.sent) != 1 ||
+		encoder.sent[0].Command.Action != "terminate" {
+
+		t.Fatal("Locked out ip wasn't sent terminate:", encoder.sent)
+	}
+}
+
+func TestLockoutCooldown(t *testing.T) {
+	l := newEngageLockout(
+		&lockoutConfig{Failures: 3, Window: 60, Cooldown: 300})
+	now := time.Now()
+
+	for i := 0; i < 3; i++ {
+		if err := l.check("192.0.2.1", now); err != nil {
+			t.Fatal("Locked out before the limit:", i)
+		}
+		l.fail("192.0.2.1", now)
+	}
+	if l.check("192.0.2.1", now) != errLockedOut {
+		t.Fatal("Not locked out at the limit")
+	}
+	if l.check("192.0.2.2", now) != nil {
+		t.Fatal("Lockout applied to another ip")
+	}
+	if l.check("192.0.2.1", now.Add(301*time.Second)) != nil {
+		t.Fatal("Still locked out after the cooldown")
+	}
+}
@@ -0,0 +1,239 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logLevels = []string{"debug", "info", "warn", "error"}
+
+func levelRank(level string) int {
+	for i, l := range logLevels {
+		if l == level {
+			return i
+		}
+	}
+	return -1
+}
+
+func levelLogger(level string) *log.Logger {
+	switch level {
+	case "debug":
+		return logger.Debug
+	case "info":
+		return logger.Info
+	case "warn":
+		return logger.Warn
+	default:
+		return logger.Error
+	}
+}
+
+type logLine struct {
+	level string
+	text  string
+}
+
+// logRing keeps the most recent log lines in memory so they can be tailed
+// over the protocol, secrets are redacted before lines are stored
+type logRing struct {
+	lock    sync.Mutex
+	lines   []logLine
+	next    int
+	full    bool
+	secrets []string
+}
+
+type logRingWriter struct {
+	ring  *logRing
+	level string
+}
+
+var logBuffer *logRing
+
+// logOutput is where enabled loggers write, logLock guards changes to the
+// log level
+var logOutput io.Writer
+var logLock sync.Mutex
+
+// logJSON is set when logformat is json, lines go out as JSON objects
+var logJSON bool
+
+// jsonLogWriter turns every line a logger writes into a JSON object, the
+// loggers' own prefix and timestamp are turned off when it's in use
+type jsonLogWriter struct {
+	out   io.Writer
+	level string
+}
+
+func (w *jsonLogWriter) Write(p []byte) (int, error) {
+	line, err := json.Marshal(map[string]string{
+		"time":    time.Now().Format(time.RFC3339Nano),
+		"level":   w.level,
+		"message": strings.TrimRight(string(p), "\n"),
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := w.out.Write(append(line, '\n')); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// useJSONLogs switches the loggers to JSON output, setLogLevel does the
+// wrapping
+func useJSONLogs() {
+	logJSON = true
+	for _, l := range logLevels {
+		levelLogger(l).SetFlags(0)
+		levelLogger(l).SetPrefix("")
+	}
+}
+
+func newLogRing(size int, secrets ...string) *logRing {
+	r := &logRing{lines: make([]logLine, size)}
+	r.redact(secrets...)
+	return r
+}
+
+// redact adds to the secrets kept out of the buffer
+func (r *logRing) redact(secrets ...string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, secret := range secrets {
+		if secret != "" {
+			r.secrets = append(r.secrets, secret)
+		}
+	}
+}
+
+// minSecretLen is the shortest config value redacted from the log buffer
+// when it isn't known to be a secret, shorter ones like "1" or "prod" would
+// garble every line they appear in
+const minSecretLen = 6
+
+// responderSecrets lists the values of the passive responders' env and http
+// headers that may hold credentials
+func responderSecrets(rc *responderConfig) []string {
+	secrets := make([]string, 0)
+	for _, pr := range rc.Passive {
+		for _, values := range []map[string]string{pr.Env, pr.Headers} {
+			for _, value := range values {
+				if len(value) >= minSecretLen {
+					secrets = append(secrets, value)
+				}
+			}
+		}
+	}
+	return secrets
+}
+
+// hookSecrets lists the auth hook args long enough to be credentials
+func hookSecrets(hc *authHookConfig) []string {
+	secrets := make([]string, 0)
+	if hc == nil {
+		return secrets
+	}
+	for _, arg := range hc.Args {
+		if len(arg) >= minSecretLen {
+			secrets = append(secrets, arg)
+		}
+	}
+	return secrets
+}
+
+// setLogLevel enables the loggers at or above level, they write to
+// logOutput and to the log buffer if there's one, the ones below are
+// discarded. Loggers are safe to repoint while in use, logLock keeps the
+// level consistent with them.
+func setLogLevel(level string) error {
+	min := levelRank(level)
+	if min < 0 {
+		return errors.New("Invalid log level: " + level)
+	}
+
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	for i, l := range logLevels {
+		var w io.Writer = ioutil.Discard
+		if i >= min {
+			w = logOutput
+			if logJSON {
+				w = &jsonLogWriter{out: logOutput, level: l}
+			}
+			if logBuffer != nil {
+				w = io.MultiWriter(w,
+					&logRingWriter{ring: logBuffer, level: l})
+			}
+		}
+		levelLogger(l).SetOutput(w)
+	}
+	logger.Level = level
+
+	return nil
+}
+
+func logLevel() string {
+	logLock.Lock()
+	defer logLock.Unlock()
+
+	return logger.Level
+}
+
+func (w *logRingWriter) Write(p []byte) (int, error) {
+	w.ring.add(w.level, strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+func (r *logRing) add(level, text string) {
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	for _, secret := range r.secrets {
+		text = strings.Replace(text, secret, "[REDACTED]", -1)
+	}
+
+	r.lines[r.next] = logLine{level: level, text: text}
+	r.next = (r.next + 1) % len(r.lines)
+	if r.next == 0 {
+		r.full = true
+	}
+}
+
+// tail returns up to n of the most recent lines logged at level or above
+func (r *logRing) tail(n int, level string) []string {
+	min := levelRank(level)
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+
+	start, count := 0, r.next
+	if r.full {
+		start, count = r.next, len(r.lines)
+	}
+
+	tail := make([]string, 0)
+	for i := count - 1; i >= 0 && len(tail) < n; i-- {
+		line := r.lines[(start+i)%len(r.lines)]
+		if levelRank(line.level) >= min {
+			tail = append(tail, line.text)
+		}
+	}
+
+	// collected newest first, return them in the order they were logged
+	for i, j := 0, len(tail)-1; i < j; i, j = i+1, j-1 {
+		tail[i], tail[j] = tail[j], tail[i]
+	}
+
+	return tail
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"container/list"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"testing"
+	"time"
+
+	"github.com/priscillachat/prislog"
+)
+
+func TestMain(m *testing.M) {
+	logger, _ = prislog.NewLogger(ioutil.Discard, "error")
+	os.Exit(m.Run())
+}
+
+// setupTest loads raw as the config and sets up what main() would for it,
+// the server state left by earlier tests is reset, auto-help is on so test
+// responders don't need help entries
+func setupTest(t testing.TB, raw string) {
+	t.Helper()
+
+	conf = config{}
+	if err := parseConfig([]byte(raw), &conf); err != nil {
+		t.Fatal("Bad test config:", err)
+	}
+
+	conf.AutoHelp = true
+	conf.Prefix = "pris "
+	conf.prefixes = []string{conf.Prefix}
+	conf.location = time.UTC
+	conf.helpRegex = regexp.MustCompile(`^help\s*(\w)*`)
+	if conf.MentionMatch == "" {
+		conf.MentionMatch = "all"
+	}
+	if conf.MatchTimeout == 0 {
+		conf.MatchTimeout = 200
+	}
+	conf.FollowUpTimeout = 60
+	conf.SendQueue = 256
+	conf.MaxMessageBytes = 16 << 20
+	conf.MaintenanceMsg = "maintenance"
+	conf.ReplyFallback = "no response"
+	if conf.Responders == nil {
+		conf.Responders = new(responderConfig)
+	}
+
+	subRegex = regexp.MustCompile("__([[:digit:]])__")
+	prefixAResponders = list.New()
+	noPrefixAResponders = list.New()
+	mentionAResponders = list.New()
+	unhandledAResponders = list.New()
+	help = nil
+
+	maintenance = conf.Maintenance
+	disabledRooms = make(map[string]map[string]bool)
+	commandSlots = nil
+	engageLocks = nil
+	stateStore = nil
+	onboarding = nil
+	webhook = nil
+	infoAccess, _ = newInfoGuard(nil)
+	workers = newWorkerPool(2, 1000)
+
+	set, err := buildPassive(conf.Responders)
+	if err != nil {
+		t.Fatal("Bad test responders:", err)
+	}
+	set.install()
+}
+
+// collectReplies gathers the messages sent to the dispatcher until there are
+// n of them or the timeout passes
+func collectReplies(t testing.TB, dispatch <-chan *dispatcherRequest, n int,
+	timeout time.Duration) []string {
+
+	t.Helper()
+
+	got := make([]string, 0, n)
+	deadline := time.After(timeout)
+	for len(got) < n {
+		select {
+		case req := <-dispatch:
+			if req.Query.Type == "message" {
+				got = append(got, req.Query.Message.Message)
+			}
+		case <-deadline:
+			return got
+		}
+	}
+	return got
+}
+
+func testMessage(text, room string) *messageBlock {
+	return &messageBlock{
+		Message:  text,
+		Stripped: text,
+		From:     "tester",
+		Room:     room,
+	}
+}
+
+// authData is what a client sends as "data" to authenticate as source
+func authData(now int64, source, secret string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	fmt.Fprintf(mac, "%d%s%s", now, source, secret)
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
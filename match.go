@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"regexp"
+	"time"
+)
+
+var errMatchTimeout = errors.New("Match timed out")
+
+// maxPendingMatches caps the matches running in the background, including
+// the ones given up on that haven't finished yet, so a flood of slow matches
+// can't pile up goroutines
+const maxPendingMatches = 64
+
+var matchSlots = make(chan struct{}, maxPendingMatches)
+
+// boundedMatch runs a match of user input against a pattern, giving up after
+// match-timeout, waiting for a free slot included. The abandoned match still
+// runs to completion in the background since regexp can't be interrupted, it
+// keeps its slot until then. Every match of message text goes through it
+func boundedMatch(match func()) error {
+	if conf.MatchTimeout < 0 {
+		match()
+		return nil
+	}
+
+	timer := time.NewTimer(time.Duration(conf.MatchTimeout) * time.Millisecond)
+	defer timer.Stop()
+
+	select {
+	case matchSlots <- struct{}{}:
+	case <-timer.C:
+		return errMatchTimeout
+	}
+
+	done := make(chan struct{})
+	go func() {
+		defer func() { <-matchSlots }()
+		match()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+		return nil
+	case <-timer.C:
+		return errMatchTimeout
+	}
+}
+
+// findMatch returns the submatches of the first match of the pattern in the
+// text, nil if there's none
+func findMatch(rg *regexp.Regexp, text string) ([]string, error) {
+	var match []string
+	if err := boundedMatch(func() {
+		match = rg.FindStringSubmatch(text)
+	}); err != nil {
+		return nil, err
+	}
+	return match, nil
+}
+
+// matchString tells whether the pattern matches the text
+func matchString(rg *regexp.Regexp, text string) (bool, error) {
+	var matched bool
+	if err := boundedMatch(func() {
+		matched = rg.MatchString(text)
+	}); err != nil {
+		return false, err
+	}
+	return matched, nil
+}
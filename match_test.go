@@ -0,0 +1,96 @@
+package main
+
+import (
+	"regexp"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fillMatchSlots takes every background match slot with a match that hangs
+// until the returned function is called
+func fillMatchSlots(t *testing.T) func() {
+	hang := make(chan struct{})
+	for i := 0; i < maxPendingMatches; i++ {
+		if err := boundedMatch(func() { <-hang }); err != errMatchTimeout {
+			t.Fatal("Hanging match didn't time out:", err)
+		}
+	}
+	return func() {
+		close(hang)
+		waitMatchSlots()
+	}
+}
+
+// waitMatchSlots waits for the abandoned matches to give their slots back,
+// so they don't hold up later tests
+func waitMatchSlots() {
+	for len(matchSlots) > 0 {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestPendingMatchesBounded(t *testing.T) {
+	setupTest(t, "")
+	conf.MatchTimeout = 20
+
+	var lock sync.Mutex
+	running, most := 0, 0
+	hang := make(chan struct{})
+
+	var wg sync.WaitGroup
+	for i := 0; i < maxPendingMatches*3; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			boundedMatch(func() {
+				lock.Lock()
+				running++
+				if running > most {
+					most = running
+				}
+				lock.Unlock()
+				<-hang
+			})
+		}()
+	}
+	wg.Wait()
+	close(hang)
+	waitMatchSlots()
+
+	lock.Lock()
+	defer lock.Unlock()
+	if most > maxPendingMatches {
+		t.Fatal("Background matches past the limit:", most)
+	}
+}
+
+func TestUserInputMatchesTimeOut(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy (\\S+)$"]
+    cmd: /bin/true
+    arg-schema:
+    - group: 0
+      pattern: "^[a-z]+$"
+`)
+	conf.MatchTimeout = 20
+	release := fillMatchSlots(t)
+	defer release()
+
+	pr := findPassiveResponder("deploy")
+	if _, err := findMatch(pr.regex[0], "deploy web"); err != errMatchTimeout {
+		t.Error("findMatch didn't time out:", err)
+	}
+	if anyMatch([]*regexp.Regexp{pr.regex[0]}, "deploy web") {
+		t.Error("anyMatch matched with no slot free")
+	}
+	if err := pr.checkArgs([]string{"deploy web", "web"}); err == nil {
+		t.Error("checkArgs passed with no slot free")
+	}
+	if checkHelp("help", "adapter", testMessage("help", "room"), nil) {
+		t.Error("Help matched with no slot free")
+	}
+}
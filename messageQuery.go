@@ -1,17 +1,38 @@
 package main
 
 import (
+	"fmt"
+	"regexp"
 	"strings"
+	"time"
 )
 
 type messageBlock struct {
-	Message       string    `json:"message,omitempty"`
-	From          string    `json:"from,omitempty"`
-	Room          string    `json:"room,omitempty"`
-	Mentioned     bool      `json:"mentioned,omitempty"`
-	Stripped      string    `json:"stripped,omitempty"`
-	MentionNotify []string  `json:"mentionnotify,omitempty"`
-	User          *UserInfo `json:"user,omitempty"`
+	Id            string        `json:"id,omitempty"`
+	Message       string        `json:"message,omitempty"`
+	From          string        `json:"from,omitempty"`
+	Room          string        `json:"room,omitempty"`
+	Mentioned     bool          `json:"mentioned,omitempty"`
+	Stripped      string        `json:"stripped,omitempty"`
+	MentionNotify []string      `json:"mentionnotify,omitempty"`
+	User          *UserInfo     `json:"user,omitempty"`
+	Attachments   []*Attachment `json:"attachments,omitempty"`
+	IsDM          bool          `json:"is_dm,omitempty"`
+	IsBot         bool          `json:"is_bot,omitempty"`
+	Visibility    string        `json:"visibility,omitempty"`
+	Format        string        `json:"format,omitempty"`
+	Time          int64         `json:"time,omitempty"`
+	Thread        string        `json:"thread,omitempty"`
+	DMUser        string        `json:"dm_user,omitempty"`
+	Locale        string        `json:"locale,omitempty"`
+	React         string        `json:"react,omitempty"`
+	ReplyTo       string        `json:"reply_to,omitempty"`
+	// Priority lets the message overtake lower priority ones waiting to be
+	// sent to the same connection
+	Priority int `json:"priority,omitempty"`
+	// Metadata carries adapter specific hints on replies, the server never
+	// looks at it
+	Metadata map[string]interface{} `json:"metadata,omitempty"`
 }
 
 type UserInfo struct {
@@ -21,6 +42,47 @@ type UserInfo struct {
 	Email   string `string:"email,omitempty"`
 }
 
+type Attachment struct {
+	Id   string `json:"id,omitempty"`
+	Name string `json:"name,omitempty"`
+	Mime string `json:"mime,omitempty"`
+	Url  string `json:"url,omitempty"`
+	Size int64  `json:"size,omitempty"`
+	// Data is the content of attachments the server sends, base64 encoded
+	Data []byte `json:"data,omitempty"`
+}
+
+// ref is what commands get to locate the attachment, the url if the adapter
+// provided one, otherwise its id
+func (a *Attachment) ref() string {
+	if a.Url != "" {
+		return a.Url
+	}
+	return a.Id
+}
+
+// checkClock applies the clock skew policy to the message's timestamp, it
+// returns an error if the message should be dropped
+func (m *messageBlock) checkClock(now time.Time) error {
+	if m.Time == 0 || conf.ClockSkew < 0 {
+		return nil
+	}
+
+	skew := m.Time - now.Unix()
+	if skew <= int64(conf.ClockSkew) && skew >= -int64(conf.ClockSkew) {
+		return nil
+	}
+
+	if conf.ClockSkewPolicy == "reject" {
+		return fmt.Errorf("Timestamp %d off by %ds", m.Time, skew)
+	}
+
+	logger.Warn.Println("Message timestamp", m.Time, "off by", skew,
+		"seconds, clamped to", now.Unix())
+	m.Time = now.Unix()
+	return nil
+}
+
 func (m *messageBlock) handleMessage(source string,
 	dispatch chan<- *dispatcherRequest) {
 
@@ -29,50 +91,200 @@ func (m *messageBlock) handleMessage(source string,
 	logger.Debug.Println("From: ", m.From)
 	logger.Debug.Println("Room: ", m.Room)
 
-	prefixMatch := false
+	if err := m.checkClock(time.Now()); err != nil {
+		logger.Warn.Println("Message from", source, "dropped:", err)
+		return
+	}
+
+	if onboarding != nil {
+		onboarding.greet(source, m, dispatch)
+	}
+
+	matched := m.route(source, dispatch)
+
+	countMetric("messages.received", 1)
+	if matched {
+		countMetric("messages.matched", 1)
+	} else {
+		countMetric("messages.unmatched", 1)
+	}
+
+	if webhook != nil {
+		webhook.post(source, m, matched)
+	}
+}
+
+// route runs the message through help and the responder lists, it returns
+// whether anything handled the message
+func (m *messageBlock) route(source string,
+	dispatch chan<- *dispatcherRequest) bool {
+
+	matched := false
 
-	if len(m.Stripped) > conf.prefixLen &&
-		m.Stripped[0:conf.prefixLen] == conf.Prefix {
+	// the passive lists are swapped on reload, take them all at once
+	routeLock.RLock()
+	prefixP, noPrefixP := prefixPResponders, noPrefixPResponders
+	mentionP, attachmentP := mentionPResponders, attachmentPResponders
+	routeLock.RUnlock()
 
-		prefixMatch = true
+	if len(m.Attachments) > 0 {
+		logger.Debug.Println("Attachments: ", len(m.Attachments))
+		matched = triggerAttachmentResponders(attachmentP, m, source, dispatch)
 	}
 
-	if prefixMatch {
+	if trimmed, prefixMatch := stripPrefix(m.Stripped); prefixMatch {
 		logger.Debug.Println("Prefix matched!")
-		trimmed := strings.TrimLeft(m.Stripped[conf.prefixLen:], " ")
 
-		if !checkHelp(trimmed, source, m.Room, dispatch) {
-			if !triggerActiveResponders(prefixAResponders, trimmed, source, m,
+		if checkHelp(trimmed, source, m, dispatch) ||
+			triggerActiveResponders(prefixAResponders, trimmed, source, m,
+				false, dispatch) ||
+			triggerPassiveResponders(prefixP, trimmed, source, m,
 				false, dispatch) {
 
-				triggerPassiveResponders(prefixPResponders, trimmed, source,
-					m.Room, m.From, false, dispatch)
-			}
+			return true
 		}
-	} else {
-		logger.Debug.Println("No prefix match, try non-prefix match")
 
-		if !triggerActiveResponders(noPrefixAResponders, m.Stripped, source, m,
-			false, dispatch) {
+		if conf.SuggestDistance > 0 {
+			checkSuggestion(trimmed, source, m.Room, dispatch)
+		}
+		return matched
+	}
+
+	logger.Debug.Println("No prefix match, try non-prefix match")
+
+	if triggerActiveResponders(noPrefixAResponders, m.Stripped, source, m,
+		false, dispatch) {
+
+		logger.Debug.Println("Non-prefix match triggered, no more checking")
+		return true
+	}
+
+	if triggerPassiveResponders(noPrefixP, m.Stripped, source, m,
+		false, dispatch) {
+
+		return true
+	}
+
+	if !m.Mentioned {
+		return matched
+	}
+
+	trimmed := strings.TrimLeft(m.Stripped, " ")
+
+	if checkHelp(trimmed, source, m, dispatch) {
+		return true
+	}
+
+	logger.Debug.Println("Mention match triggered!")
+
+	return triggerActiveResponders(mentionAResponders, m.Stripped, source, m,
+		true, dispatch) ||
+		triggerPassiveResponders(mentionP, trimmed, source, m,
+			true, dispatch) ||
+		matched
+}
+
+// stripPrefix returns the text following the main prefix or any of the
+// alternate ones, and whether there was one
+func stripPrefix(text string) (string, bool) {
+	for _, prefix := range conf.prefixes {
+		if len(text) > len(prefix) && text[:len(prefix)] == prefix {
+			return strings.TrimLeft(text[len(prefix):], " "), true
+		}
+	}
+	return text, false
+}
+
+// dryRun reports what every passive responder would do with the message
+// without running anything, and why the ones that wouldn't fire are skipped
+func (m *messageBlock) dryRun() []string {
+	report := make([]string, 0)
+
+	text, prefixed := stripPrefix(m.Stripped)
+
+	if prefixed || m.Mentioned {
+		if help, _ := matchString(conf.helpRegex, text); help {
+			report = append(report,
+				"help: would reply, nothing else is checked")
+		}
+	}
+
+	for _, pr := range conf.Responders.Passive {
+		report = append(report, "passive "+pr.Name+": "+
+			pr.dryRunResult(m, text, prefixed))
+	}
+
+	return report
+}
+
+func (pr *passiveResponderConfig) dryRunResult(m *messageBlock, text string,
+	prefixed bool) string {
+
+	patterns := make([]*regexp.Regexp, 0)
+
+	switch {
+	case len(pr.regex) == 0 && len(pr.mRegex) == 0:
+		return "skipped, attachment responder"
+	case prefixed && !pr.NoPrefix:
+		patterns = pr.regex
+	case !prefixed && pr.NoPrefix:
+		patterns = pr.regex
+	}
+
+	if m.Mentioned && !prefixed {
+		patterns = append(patterns, pr.mRegex...)
+		text = strings.TrimLeft(text, " ")
+	}
+
+	if len(patterns) == 0 {
+		if prefixed {
+			return "skipped, prefix not expected"
+		}
+		return "skipped, prefix missing"
+	}
+
+	if reason := pr.skipReason(m); reason != "" {
+		return "skipped, " + reason
+	}
+
+	if rg := pr.excludedBy(text); rg != nil {
+		return "skipped, excluded by " + rg.String()
+	}
 
-			matched := triggerPassiveResponders(noPrefixPResponders, m.Stripped,
-				source, m.Room, m.From, false, dispatch)
-			if !matched && m.Mentioned {
-				trimmed := strings.TrimLeft(m.Stripped, " ")
+	if pr.MatchMode == "all" {
+		for _, rg := range patterns {
+			if match, _ := findMatch(rg, text); match == nil {
+				return "skipped, " + rg.String() + " didn't match"
+			}
+		}
+	}
+
+	for _, rg := range patterns {
+		match, err := findMatch(rg, text)
+		if err != nil {
+			return "skipped, " + err.Error()
+		}
+		if match == nil {
+			continue
+		}
 
-				if !checkHelp(trimmed, source, m.Room, dispatch) {
-					logger.Debug.Println("Mention match triggered!")
+		if err := pr.checkArgs(match); err != nil {
+			return "would reply with usage, " + err.Error()
+		}
 
-					if !triggerActiveResponders(mentionAResponders, m.Stripped,
-						source, m, true, dispatch) {
+		if pr.StateChanging && inMaintenance() {
+			return "would reply with maintenance message, maintenance mode"
+		}
 
-						triggerPassiveResponders(mentionPResponders, trimmed,
-							source, m.Room, m.From, true, dispatch)
-					}
-				}
+		if pr.Schedule != nil && !pr.Schedule.open(time.Now()) {
+			if pr.Schedule.Message == "" {
+				return "skipped, outside of schedule"
 			}
-		} else {
-			logger.Debug.Println("Non-prefix match triggered, no more checking")
+			return "would reply with schedule message, outside of schedule"
 		}
+
+		return "would fire, matched " + rg.String()
 	}
+
+	return "skipped, no pattern matched"
 }
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestClockSkewPolicy(t *testing.T) {
+	setupTest(t, `
+clock-skew: 60
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+    args: ["hi"]
+`)
+	now := time.Now()
+
+	for _, test := range []struct {
+		policy   string
+		offset   int64
+		rejected bool
+		time     int64
+	}{
+		{"clamp", 30, false, now.Unix() + 30},
+		{"clamp", 3600, false, now.Unix()},
+		{"clamp", -3600, false, now.Unix()},
+		{"reject", 30, false, now.Unix() + 30},
+		{"reject", 3600, true, now.Unix() + 3600},
+	} {
+		conf.ClockSkewPolicy = test.policy
+		m := testMessage("pris hello", "room")
+		m.Time = now.Unix() + test.offset
+
+		err := m.checkClock(now)
+		if (err != nil) != test.rejected || m.Time != test.time {
+			t.Errorf("%s %+ds: error %v, time %d", test.policy, test.offset,
+				err, m.Time-now.Unix())
+		}
+	}
+
+	// a rejected message isn't routed at all
+	dispatch := make(chan *dispatcherRequest, 10)
+	m := testMessage("pris hello", "room")
+	m.Time = now.Unix() + 3600
+	m.handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 500*time.Millisecond)
+	if len(got) > 0 {
+		t.Fatal("Rejected message was answered:", got)
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"time"
+)
+
+// metricsSink receives the server's counters, gauges and timers, every
+// enabled sink gets every metric, labels come in name, value pairs
+type metricsSink interface {
+	count(name string, value int64, labels []string)
+	gauge(name string, value int64)
+	timing(name string, d time.Duration)
+}
+
+// metricSinks is set up at startup and only read afterwards
+var metricSinks []metricsSink
+
+func countMetric(name string, value int64, labels ...string) {
+	for _, sink := range metricSinks {
+		sink.count(name, value, labels)
+	}
+}
+
+func gaugeMetric(name string, value int64) {
+	for _, sink := range metricSinks {
+		sink.gauge(name, value)
+	}
+}
+
+func timeMetric(name string, d time.Duration) {
+	for _, sink := range metricSinks {
+		sink.timing(name, d)
+	}
+}
@@ -2,22 +2,30 @@ package main
 
 import (
 	"fmt"
+	"path/filepath"
+	"regexp/syntax"
 	"strings"
 )
 
-func checkHelp(msg, source, room string, dp chan<- *dispatcherRequest) bool {
+func checkHelp(msg, source string, m *messageBlock,
+	dp chan<- *dispatcherRequest) bool {
+
 	logger.Debug.Println("Checking help command:", msg)
 
-	matches := conf.helpRegex.FindAllStringSubmatch(msg, 1)
+	match, err := findMatch(conf.helpRegex, msg)
+	if err != nil {
+		logger.Warn.Println("Skipping help:", err)
+		return false
+	}
 
-	if len(matches) == 0 {
+	if match == nil {
 		logger.Debug.Println("No help match found")
 		return false
 	}
 
 	section := ""
-	if len(matches[0]) > 1 {
-		section = matches[0][1]
+	if len(match) > 1 {
+		section = match[1]
 	}
 
 	dp <- &dispatcherRequest{
@@ -26,8 +34,8 @@ func checkHelp(msg, source, room string, dp chan<- *dispatcherRequest) bool {
 			Source: "Internal: help",
 			To:     source,
 			Message: &messageBlock{
-				Message: strings.Trim(showHelp(section), " \n"),
-				Room:    room,
+				Message: strings.Trim(showHelp(section, m.Locale), " \n"),
+				Room:    m.Room,
 			},
 		},
 	}
@@ -35,22 +43,230 @@ func checkHelp(msg, source, room string, dp chan<- *dispatcherRequest) bool {
 	return true
 }
 
-func showHelp(cmdPrefix string) string {
+// showHelp lists the help entries in the requester's locale, entries of
+// responders limited to other locales are left out
+func showHelp(cmdPrefix, locale string) string {
+
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+
+	if help.Len() == 0 {
+		return "No commands available right now."
+	}
 
 	helpMsg := "Here is what I can do:\n"
 	for helpE := help.Front(); helpE != nil; helpE = helpE.Next() {
 		h := helpE.Value.(*helpInfo)
 
+		if len(h.locales) > 0 && !localeMatches(h.locales, locale) {
+			continue
+		}
+		text := localized(h.helpLocales, locale, h.helpMsg)
+
 		if h.mention {
 			helpMsg += fmt.Sprintf("(when mentioned) %s - %s\n", h.helpCmd,
-				h.helpMsg)
+				text)
 		} else if h.noPrefix {
-			helpMsg += fmt.Sprintf("%s - %s\n", h.helpCmd, h.helpMsg)
+			helpMsg += fmt.Sprintf("%s - %s\n", h.helpCmd, text)
 		} else {
 			helpMsg += fmt.Sprintf("%s %s - %s\n", conf.Prefix, h.helpCmd,
-				h.helpMsg)
+				text)
 		}
 	}
 
+	if len(conf.PrefixAlt) > 0 {
+		helpMsg += fmt.Sprintf("Commands also work with %s instead of %s\n",
+			strings.Join(conf.PrefixAlt, ", "), strings.Trim(conf.Prefix, " "))
+	}
+
 	return helpMsg
 }
+
+func checkSuggestion(msg, source, room string, dp chan<- *dispatcherRequest) {
+	suggestion := suggestCommand(msg)
+
+	if suggestion == "" {
+		logger.Debug.Println("No suggestion found for:", msg)
+		return
+	}
+
+	dp <- &dispatcherRequest{
+		Query: &query{
+			Type:   "message",
+			Source: "Internal: suggestion",
+			To:     source,
+			Message: &messageBlock{
+				Message: fmt.Sprintf("Did you mean '%s'?", suggestion),
+				Room:    room,
+			},
+		},
+	}
+}
+
+// suggestCommand finds the prefix help command closest to the first word of
+// msg, only commands within conf.SuggestDistance edits are suggested
+func suggestCommand(msg string) string {
+	words := strings.Fields(msg)
+	if len(words) == 0 {
+		return ""
+	}
+
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+
+	best := ""
+	bestDist := conf.SuggestDistance + 1
+	for helpE := help.Front(); helpE != nil; helpE = helpE.Next() {
+		h := helpE.Value.(*helpInfo)
+
+		if h.mention || h.noPrefix {
+			continue
+		}
+
+		cmdWords := strings.Fields(h.helpCmd)
+		if len(cmdWords) == 0 {
+			continue
+		}
+
+		dist := levenshtein(words[0], cmdWords[0])
+
+		// an exact match means the command exists, the arguments are what
+		// didn't match, a suggestion wouldn't help
+		if dist == 0 {
+			return ""
+		}
+
+		if dist < bestDist {
+			best = cmdWords[0]
+			bestDist = dist
+		}
+	}
+
+	return best
+}
+
+func levenshtein(a, b string) int {
+	ra, rb := []rune(a), []rune(b)
+
+	prev := make([]int, len(rb)+1)
+	cur := make([]int, len(rb)+1)
+	for j := range prev {
+		prev[j] = j
+	}
+
+	for i := 1; i <= len(ra); i++ {
+		cur[0] = i
+		for j := 1; j <= len(rb); j++ {
+			cost := 1
+			if ra[i-1] == rb[j-1] {
+				cost = 0
+			}
+
+			cur[j] = prev[j-1] + cost
+			if prev[j]+1 < cur[j] {
+				cur[j] = prev[j] + 1
+			}
+			if cur[j-1]+1 < cur[j] {
+				cur[j] = cur[j-1] + 1
+			}
+		}
+		prev, cur = cur, prev
+	}
+
+	return prev[len(rb)]
+}
+
+// autoHelp fills in the help of a passive responder that doesn't have any,
+// the help commands are built from the match patterns and the help message
+// from the command it runs
+func (pr *passiveResponderConfig) autoHelp() {
+	if len(pr.HelpCmds) == 0 {
+		for _, pattern := range pr.Match {
+			if synopsis := patternSynopsis(pattern); synopsis != "" {
+				pr.HelpCmds = append(pr.HelpCmds, synopsis)
+			}
+		}
+	}
+
+	if len(pr.HelpMentionCmds) == 0 {
+		for _, pattern := range pr.MentionMatch {
+			if synopsis := patternSynopsis(pattern); synopsis != "" {
+				pr.HelpMentionCmds = append(pr.HelpMentionCmds, synopsis)
+			}
+		}
+	}
+
+	if pr.Help == "" {
+		args := make([]string, len(pr.Args))
+		for i, arg := range pr.Args {
+			args[i] = namedSubRegex.ReplaceAllString(
+				subRegex.ReplaceAllString(arg, "<arg$1>"), "<$1>")
+		}
+		pr.Help = strings.TrimSpace("runs " + filepath.Base(pr.Cmd) + " " +
+			strings.Join(args, " "))
+	}
+
+	logger.Debug.Println("Auto generated help for", pr.Name+":", pr.HelpCmds,
+		pr.HelpMentionCmds, pr.Help)
+}
+
+// patternSynopsis renders a match pattern as the command a user would type,
+// captures become <name> for named groups and <argN> otherwise, matching
+// the __N__ substitution index
+func patternSynopsis(pattern string) string {
+	re, err := syntax.Parse(pattern, syntax.Perl)
+	if err != nil {
+		return ""
+	}
+
+	return strings.Join(strings.Fields(renderSynopsis(re)), " ")
+}
+
+func renderSynopsis(re *syntax.Regexp) string {
+	switch re.Op {
+	case syntax.OpLiteral:
+		return string(re.Rune)
+	case syntax.OpCapture:
+		if re.Name != "" {
+			return "<" + re.Name + ">"
+		}
+		return fmt.Sprintf("<arg%d>", re.Cap-1)
+	case syntax.OpConcat:
+		rendered := ""
+		for _, sub := range re.Sub {
+			rendered += renderSynopsis(sub)
+		}
+		return rendered
+	case syntax.OpAlternate:
+		alternatives := make([]string, len(re.Sub))
+		for i, sub := range re.Sub {
+			alternatives[i] = renderSynopsis(sub)
+		}
+		return "(" + strings.Join(alternatives, "|") + ")"
+	case syntax.OpQuest:
+		// the space before an optional word goes outside the brackets
+		sub := renderSynopsis(re.Sub[0])
+		word := strings.TrimLeft(sub, " ")
+		return sub[:len(sub)-len(word)] + "[" + word + "]"
+	case syntax.OpStar, syntax.OpPlus, syntax.OpRepeat:
+		if sub := renderSynopsis(re.Sub[0]); strings.TrimSpace(sub) == "" {
+			return " "
+		}
+		return "..."
+	case syntax.OpCharClass:
+		// a whitespace class separates words, anything else is a character
+		for i := 0; i+1 < len(re.Rune); i += 2 {
+			if re.Rune[i] < '\t' || re.Rune[i+1] > ' ' ||
+				(re.Rune[i] > '\r' && re.Rune[i] < ' ') {
+
+				return "?"
+			}
+		}
+		return " "
+	case syntax.OpAnyChar, syntax.OpAnyCharNotNL:
+		return "?"
+	default:
+		// anchors, word boundaries and empty matches don't show
+		return ""
+	}
+}
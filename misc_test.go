@@ -0,0 +1,85 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSuggestNearMiss(t *testing.T) {
+	setupTest(t, `
+suggest-distance: 2
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy (\\S+)$"]
+    cmd: /bin/true
+    help: deploy a service
+    help-commands: [deploy]
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris delpoy web", "room").handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, time.Second)
+	if len(got) != 1 || got[0] != "Did you mean 'deploy'?" {
+		t.Fatal("Expected a suggestion, got:", got)
+	}
+
+	testMessage("pris restart web", "room").handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, time.Second); len(got) != 0 {
+		t.Fatal("Far miss got a suggestion:", got)
+	}
+}
+
+func TestAutoHelpSynopsis(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ['^deploy (?P<svc>\S+) to (\w+)(?: now)?$']
+    cmd: /usr/local/bin/deploy
+    args: ["--env", "__1__"]
+  - name: status
+    match: ['^status$']
+    cmd: /bin/true
+    help: show the status
+    help-commands: ["status [service]"]
+`)
+
+	pr := findPassiveResponder("deploy")
+	if len(pr.HelpCmds) != 1 ||
+		pr.HelpCmds[0] != "deploy <svc> to <arg1> [now]" {
+
+		t.Error("Unexpected help commands:", pr.HelpCmds)
+	}
+	if pr.Help != "runs deploy --env <arg1>" {
+		t.Error("Unexpected help:", pr.Help)
+	}
+
+	pr = findPassiveResponder("status")
+	if pr.Help != "show the status" || len(pr.HelpCmds) != 1 ||
+		pr.HelpCmds[0] != "status [service]" {
+
+		t.Error("Explicit help replaced:", pr.Help, pr.HelpCmds)
+	}
+}
+
+func TestHelpWithoutCommands(t *testing.T) {
+	setupTest(t, "")
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris help", "room").handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "No commands available right now." {
+		t.Fatal("Unexpected help reply:", got)
+	}
+
+	// a registered active responder shows up again
+	addActiveResponder("prefix", &activeResponderConfig{source: "deployer",
+		helpCmd: "deploy <service>", help: "deploy a service"}, true)
+	testMessage("pris help", "room").handleMessage("adapter", dispatch)
+	got = collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || !strings.Contains(got[0], "deploy <service>") {
+		t.Fatal("Unexpected help reply:", got)
+	}
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+)
+
+type onboardingConfig struct {
+	Message  string `yaml:"message"`
+	DM       bool   `yaml:"dm"`
+	Rate     int    `yaml:"rate"`
+	SeenFile string `yaml:"seen-file"`
+}
+
+type onboardingData struct {
+	Name string
+	From string
+	Room string
+}
+
+// onboarder greets every user the first time they're seen talking, users are
+// remembered per adapter, in memory and in the seen file if there's one. Only
+// rate greetings go out per minute, users seen over the limit (i.e. while an
+// adapter backfills history) are remembered without being greeted.
+type onboarder struct {
+	lock   sync.Mutex
+	conf   *onboardingConfig
+	tmpl   *template.Template
+	seen   map[string]bool
+	file   *os.File
+	window time.Time
+	sent   int
+}
+
+var onboarding *onboarder
+
+func newOnboarder(oc *onboardingConfig) (*onboarder, error) {
+	if oc.Message == "" {
+		return nil, errors.New("Missing onboarding message")
+	}
+
+	if oc.Rate < 0 {
+		return nil, errors.New("Onboarding rate can't be negative")
+	}
+	if oc.Rate == 0 {
+		oc.Rate = 10
+	}
+
+	tmpl, err := template.New("onboarding").Parse(oc.Message)
+	if err != nil {
+		return nil, err
+	}
+
+	o := &onboarder{conf: oc, tmpl: tmpl, seen: make(map[string]bool)}
+
+	if oc.SeenFile != "" {
+		o.file, err = os.OpenFile(oc.SeenFile,
+			os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(o.file)
+		for scanner.Scan() {
+			o.seen[scanner.Text()] = true
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return o, nil
+}
+
+// greet sends the onboarding message if this is the first message seen from
+// the sender
+func (o *onboarder) greet(source string, m *messageBlock,
+	dispatch chan<- *dispatcherRequest) {
+
+	if m.IsBot || m.From == "" {
+		return
+	}
+
+	user, name := m.From, m.From
+	if m.User != nil && m.User.Id != "" {
+		user = m.User.Id
+	}
+	if m.User != nil && m.User.Name != "" {
+		name = m.User.Name
+	}
+
+	if !o.firstSeen(source + "/" + strings.Replace(user, "\n", " ", -1)) {
+		return
+	}
+
+	var buf bytes.Buffer
+	err := o.tmpl.Execute(&buf, &onboardingData{
+		Name: name,
+		From: m.From,
+		Room: m.Room,
+	})
+	if err != nil {
+		logger.Error.Println("Unable to render onboarding message:", err)
+		return
+	}
+
+	reply := &messageBlock{Message: buf.String(), Room: m.Room}
+	if o.conf.DM {
+		reply.DMUser = m.From
+	}
+
+	logger.Info.Println("Onboarding", user, "on", source)
+	dispatch <- &dispatcherRequest{
+		Query: &query{
+			Type:    "message",
+			Source:  "server",
+			To:      source,
+			Message: reply,
+		},
+	}
+}
+
+// firstSeen marks the user seen, it tells whether they haven't been before
+// and can be greeted within the rate limit
+func (o *onboarder) firstSeen(key string) bool {
+	o.lock.Lock()
+	defer o.lock.Unlock()
+
+	if o.seen[key] {
+		return false
+	}
+	o.seen[key] = true
+
+	if o.file != nil {
+		if _, err := o.file.WriteString(key + "\n"); err != nil {
+			logger.Error.Println("Unable to record seen user:", err)
+		}
+	}
+
+	now := time.Now()
+	if now.Sub(o.window) >= time.Minute {
+		o.window, o.sent = now, 0
+	}
+	if o.sent >= o.conf.Rate {
+		logger.Warn.Println("Onboarding rate exceeded, not greeting", key)
+		return false
+	}
+	o.sent++
+
+	return true
+}
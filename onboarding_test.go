@@ -0,0 +1,59 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOnboardingGreetsOnce(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-onboarding")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	seenFile := filepath.Join(dir, "seen")
+
+	o, err := newOnboarder(&onboardingConfig{Message: "Welcome {{.Name}}!",
+		Rate: 2, SeenFile: seenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	greetings := func(o *onboarder, users ...string) []string {
+		dispatch := make(chan *dispatcherRequest, 10)
+		for _, user := range users {
+			m := testMessage("hello", "lobby")
+			m.From = user
+			o.greet("chat", m, dispatch)
+		}
+		close(dispatch)
+
+		got := make([]string, 0)
+		for req := range dispatch {
+			got = append(got, req.Query.Message.Message)
+		}
+		return got
+	}
+
+	// carol is past the rate, remembered without being greeted
+	got := greetings(o, "alice", "alice", "bob", "alice", "carol")
+	if len(got) != 2 || got[0] != "Welcome alice!" || got[1] != "Welcome bob!" {
+		t.Fatal("Unexpected greetings:", got)
+	}
+	o.file.Close()
+
+	// a restart remembers them from the seen file
+	o, err = newOnboarder(&onboardingConfig{Message: "Welcome {{.Name}}!",
+		SeenFile: seenFile})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.file.Close()
+	if got := greetings(o, "alice", "carol", "dave"); len(got) != 1 ||
+		got[0] != "Welcome dave!" {
+
+		t.Fatal("Unexpected greetings after the restart:", got)
+	}
+}
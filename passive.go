@@ -0,0 +1,556 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/signal"
+	"regexp"
+	"runtime"
+	"strings"
+	"syscall"
+	"text/template"
+)
+
+// passiveSet is the passive responders of a config, validated and sorted
+// into their lists, ready to be installed
+type passiveSet struct {
+	responders *responderConfig
+	prefix     *list.List
+	noPrefix   *list.List
+	mention    *list.List
+	attachment *list.List
+	help       []*helpInfo
+}
+
+// hasGroup tells whether any of the responder's patterns has the named group
+func (pr *passiveResponderConfig) hasGroup(name string) bool {
+	for _, rg := range append(pr.regex, pr.mRegex...) {
+		for _, group := range rg.SubexpNames() {
+			if group == name {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// configError formats the error the way the logger would format it
+func configError(v ...interface{}) error {
+	return errors.New(strings.TrimSpace(fmt.Sprintln(v...)))
+}
+
+func buildPassive(responders *responderConfig) (*passiveSet, error) {
+	set := &passiveSet{
+		responders: responders,
+		prefix:     list.New(),
+		noPrefix:   list.New(),
+		mention:    list.New(),
+		attachment: list.New(),
+	}
+
+	// names show up in logs, admin commands and snapshots, they have to
+	// tell responders apart
+	names := make(map[string]string)
+	for i, pr := range responders.Passive {
+		if pr.Name == "" {
+			return nil, configError(pr.origin(i), "has no name")
+		}
+		if other, ok := names[pr.Name]; ok {
+			return nil, configError("Passive responder name", pr.Name,
+				"used twice, by", other, "and", pr.origin(i))
+		}
+		names[pr.Name] = pr.origin(i)
+
+		if err := pr.setup(); err != nil {
+			return nil, err
+		}
+		set.add(pr)
+	}
+
+	return set, nil
+}
+
+// origin tells where the responder at index i of the passive list is
+// defined, for config errors
+func (pr *passiveResponderConfig) origin(i int) string {
+	if pr.file != "" {
+		return "passive responder in " + pr.file
+	}
+	return fmt.Sprintf("passive responder %d in the main config", i+1)
+}
+
+// setup validates the responder and compiles its patterns and templates
+func (pr *passiveResponderConfig) setup() error {
+	var err error
+
+	logger.Debug.Println("Passive responder:", *pr)
+
+	if len(pr.Match) == 0 && pr.AttachmentMatch == nil {
+		return configError(
+			"Must specify at least one match for passive responder")
+	}
+
+	pr.regex = make([]*regexp.Regexp, 0)
+	for _, pattern := range pr.Match {
+		rg, err := regexp.Compile(pattern)
+		if err != nil {
+			return configError("Unable to parse expression:", pattern)
+		}
+		pr.regex = append(pr.regex, rg)
+	}
+
+	pr.mRegex = make([]*regexp.Regexp, 0)
+	for _, pattern := range pr.MentionMatch {
+		rg, err := regexp.Compile(pattern)
+		if err != nil {
+			return configError("Unable to parse expression:", pattern)
+		}
+		pr.mRegex = append(pr.mRegex, rg)
+	}
+
+	pr.exclude = make([]*regexp.Regexp, 0)
+	for _, pattern := range pr.Exclude {
+		rg, err := regexp.Compile(pattern)
+		if err != nil {
+			return configError("Unable to parse expression:", pattern)
+		}
+		pr.exclude = append(pr.exclude, rg)
+	}
+
+	if pr.AttachmentMatch != nil {
+		pr.nameRegex = make([]*regexp.Regexp, 0)
+		for _, pattern := range pr.AttachmentMatch.Name {
+			rg, err := regexp.Compile(pattern)
+			if err != nil {
+				return configError("Unable to parse expression:", pattern)
+			}
+			pr.nameRegex = append(pr.nameRegex, rg)
+		}
+
+		pr.mimeRegex = make([]*regexp.Regexp, 0)
+		for _, pattern := range pr.AttachmentMatch.Mime {
+			rg, err := regexp.Compile(pattern)
+			if err != nil {
+				return configError("Unable to parse expression:", pattern)
+			}
+			pr.mimeRegex = append(pr.mimeRegex, rg)
+		}
+
+		if len(pr.nameRegex) == 0 && len(pr.mimeRegex) == 0 {
+			return configError("Empty attachmentmatch:", pr.Name)
+		}
+	}
+
+	if len(pr.regex) == 0 && pr.AttachmentMatch == nil {
+		return configError("Missing match or multimatch:", pr.Name)
+	}
+
+	for _, schema := range pr.ArgSchema {
+		if schema.Group < 0 || schema.Group > 9 {
+			return configError("Bad arg-schema group for responder:",
+				pr.Name, schema.Group)
+		}
+		if schema.Pattern != "" {
+			// the whole argument has to match, not just a substring
+			rg, err := regexp.Compile("^(?:" + schema.Pattern + ")$")
+			if err != nil {
+				return configError("Unable to parse expression:",
+					schema.Pattern)
+			}
+			schema.regex = rg
+		}
+	}
+
+	switch pr.Type {
+	case "", "exec":
+		if pr.Cmd == "" {
+			return configError(
+				"Passive Responder must have 'cmd' paramenter")
+		}
+	case "http":
+		if err := pr.setupHTTP(); err != nil {
+			return err
+		}
+	default:
+		return configError("Unsupported type for responder:", pr.Name,
+			pr.Type)
+	}
+
+	pr.exitTmpl = make(map[int]*template.Template)
+	for code, msg := range pr.ExitMessages {
+		pr.exitTmpl[code], err = template.New(pr.Name).Parse(msg)
+		if err != nil {
+			return configError("Bad exit message for responder:", pr.Name,
+				err)
+		}
+	}
+
+	if pr.DefaultExitMsg != "" {
+		pr.defaultExitTmpl, err =
+			template.New(pr.Name).Parse(pr.DefaultExitMsg)
+		if err != nil {
+			return configError("Bad default exit message for responder:",
+				pr.Name, err)
+		}
+	}
+
+	if pr.SignalMsg != "" {
+		pr.signalTmpl, err = template.New(pr.Name).Parse(pr.SignalMsg)
+		if err != nil {
+			return configError("Bad signal message for responder:",
+				pr.Name, err)
+		}
+	}
+
+	if pr.Cache != nil {
+		if pr.Cache.Ttl <= 0 {
+			return configError("Cache ttl must be positive for responder:",
+				pr.Name)
+		}
+		if pr.Cache.Size <= 0 {
+			pr.Cache.Size = 100
+		}
+		pr.cache = newOutputCache(pr.Cache)
+	}
+
+	switch pr.MaxInputPolicy {
+	case "":
+		pr.MaxInputPolicy = "truncate"
+	case "truncate", "reject":
+	default:
+		return configError("Unsupported max-input-policy for responder:",
+			pr.Name, pr.MaxInputPolicy)
+	}
+
+	if pr.Weight < 0 {
+		return configError("Responder weight can't be negative:", pr.Name)
+	}
+	if pr.Weight == 0 {
+		pr.Weight = 1
+	}
+
+	if pr.OutputTemplate != "" {
+		if _, ok := pr.ExitMessages[0]; ok {
+			return configError("Responder can't have both output-template",
+				"and an exit message for 0:", pr.Name)
+		}
+
+		pr.outputTmpl, err =
+			template.New(pr.Name).Parse(pr.OutputTemplate)
+		if err != nil {
+			return configError("Bad output template for responder:",
+				pr.Name, err)
+		}
+	}
+
+	if pr.OutputActions &&
+		(pr.OutputTemplate != "" || pr.OutputAttach != nil) {
+
+		return configError("Responder with output-actions can't have",
+			"output-template or output-attachment:", pr.Name)
+	}
+
+	pr.sanitizer = pr.Sanitize.resolve(conf.Sanitize)
+
+	if pr.Serialize != nil {
+		if pr.Serialize.MaxKeys < 0 {
+			return configError("Serialize max-keys can't be negative:",
+				pr.Name)
+		}
+		if pr.Serialize.MaxKeys == 0 {
+			pr.Serialize.MaxKeys = 100
+		}
+		pr.serial = newSerialLocks(pr.Serialize.MaxKeys)
+	}
+
+	if pr.Schedule != nil {
+		if err := pr.Schedule.parse(); err != nil {
+			return configError("Bad schedule for responder:", pr.Name, err)
+		}
+	}
+
+	if oa := pr.OutputAttach; oa != nil {
+		if oa.Name == "" {
+			return configError("Missing output attachment name:", pr.Name)
+		}
+		if pr.OutputTemplate != "" {
+			return configError("Responder can't have both output-template",
+				"and output-attachment:", pr.Name)
+		}
+		if oa.Mime == "" {
+			oa.Mime = "application/octet-stream"
+		}
+		if oa.MaxSize < 0 {
+			return configError("Output attachment size can't be negative:",
+				pr.Name)
+		}
+		if oa.MaxSize == 0 {
+			oa.MaxSize = 512 * 1024
+		}
+	}
+
+	if r := pr.Restrict; r != nil {
+		if r.MaxCpu < 0 || r.MaxMemory < 0 {
+			return configError("Resource limits can't be negative:",
+				pr.Name)
+		}
+		if runtime.GOOS == "windows" &&
+			(r.Nice != 0 || r.MaxCpu > 0 || r.MaxMemory > 0) {
+
+			return configError("Resource limits aren't supported on",
+				runtime.GOOS+":", pr.Name)
+		}
+	}
+
+	if pr.Retries < 0 || pr.RetryBackoff < 0 {
+		return configError("Retries and retry-backoff can't be negative:",
+			pr.Name)
+	}
+
+	if pr.Retries > 0 && pr.RetryBackoff == 0 {
+		pr.RetryBackoff = 500
+	}
+
+	switch pr.MatchMode {
+	case "":
+		pr.MatchMode = "any"
+	case "any", "all":
+	default:
+		return configError("Unsupported match-mode for responder:", pr.Name,
+			pr.MatchMode)
+	}
+
+	if pr.Timeout < 0 {
+		return configError("Timeout can't be negative:", pr.Name)
+	}
+
+	if pr.Workdir != "" {
+		if info, err := os.Stat(pr.Workdir); err != nil || !info.IsDir() {
+			return configError("Workdir of responder", pr.Name,
+				"isn't a directory:", pr.Workdir)
+		}
+	}
+
+	if pr.ArgsJson != "" && pr.ArgsJson != "arg" && pr.ArgsJson != "env" {
+		return configError("Unsupported args-json mode for responder:",
+			pr.Name, pr.ArgsJson)
+	}
+
+	if err := pr.checkEnv(); err != nil {
+		return err
+	}
+
+	pr.substitute = make(map[int]bool)
+	pr.namedParam = make(map[int]bool)
+	pr.roomParam = make(map[int]bool)
+	pr.userParam = make(map[int]bool)
+	pr.sourceParam = make(map[int]bool)
+	pr.attachParam = make(map[int]bool)
+	for i, arg := range pr.Args {
+		if ms := subRegex.MatchString(arg); ms {
+			logger.Debug.Println("Substitution found:", arg)
+			pr.substitute[i] = true
+		}
+		for _, name := range namedSubRegex.FindAllStringSubmatch(arg, -1) {
+			if !pr.hasGroup(name[1]) {
+				return configError("No capture group named", name[1],
+					"in the patterns of responder:", pr.Name)
+			}
+			pr.namedParam[i] = true
+		}
+		if rs := roomRegex.MatchString(arg); rs {
+			pr.roomParam[i] = true
+			logger.Debug.Println("Room substitution found:", arg)
+		}
+		if userRegex.MatchString(arg) {
+			pr.userParam[i] = true
+			logger.Debug.Println("User substitution found:", arg)
+		}
+		if sourceRegex.MatchString(arg) {
+			pr.sourceParam[i] = true
+			logger.Debug.Println("Source substitution found:", arg)
+		}
+		if as := attachRegex.MatchString(arg); as {
+			pr.attachParam[i] = true
+			logger.Debug.Println("Attachment substitution found:", arg)
+		}
+	}
+
+	if conf.AutoHelp {
+		pr.autoHelp()
+	}
+
+	if pr.Help == "" || len(pr.HelpCmds) == 0 {
+		return configError(
+			"Missing help or help-commands for passive responder: ",
+			pr.Name)
+	}
+
+	return nil
+}
+
+func (set *passiveSet) add(pr *passiveResponderConfig) {
+	// attachment only responders have no text pattern to match
+	if len(pr.regex) > 0 {
+		if pr.NoPrefix {
+			logger.Debug.Println("Registered NoPrefix responder:",
+				pr.Name)
+			insertByPriority(set.noPrefix, pr, pr.Priority)
+		} else {
+			logger.Debug.Println("Registered Prefix responder:",
+				pr.Name)
+			insertByPriority(set.prefix, pr, pr.Priority)
+		}
+	}
+
+	if pr.AttachmentMatch != nil {
+		logger.Debug.Println("Registered Attachment responder:", pr.Name)
+		insertByPriority(set.attachment, pr, pr.Priority)
+	}
+
+	if len(pr.mRegex) != 0 {
+		logger.Debug.Println("Registered Mention responder:", pr.Name)
+		// in "first" mode the config order decides which responder gets the
+		// mention, "priority" is there to have priorities decide instead
+		if conf.MentionMatch == "first" {
+			set.mention.PushBack(pr)
+		} else {
+			insertByPriority(set.mention, pr, pr.Priority)
+		}
+	}
+
+	for _, cmd := range pr.HelpCmds {
+		info := &helpInfo{
+			helpCmd:     cmd,
+			helpMsg:     pr.Help,
+			helpLocales: pr.HelpLocales,
+			locales:     pr.Locales,
+		}
+
+		if pr.NoPrefix {
+			info.noPrefix = true
+		}
+
+		set.help = append(set.help, info)
+	}
+
+	for _, cmd := range pr.HelpMentionCmds {
+		set.help = append(set.help, &helpInfo{
+			helpCmd:     cmd,
+			helpMsg:     pr.Help,
+			mention:     true,
+			helpLocales: pr.HelpLocales,
+			locales:     pr.Locales,
+		})
+	}
+}
+
+// install swaps the passive responders and their help entries in, the help
+// entries of active responders are kept
+func (set *passiveSet) install() {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	prefixPResponders = set.prefix
+	noPrefixPResponders = set.noPrefix
+	mentionPResponders = set.mention
+	attachmentPResponders = set.attachment
+
+	newHelp := list.New()
+	for _, info := range set.help {
+		newHelp.PushBack(info)
+	}
+	if help != nil {
+		for helpE := help.Front(); helpE != nil; helpE = helpE.Next() {
+			if info := helpE.Value.(*helpInfo); info.active != nil {
+				newHelp.PushBack(info)
+			}
+		}
+	}
+	help = newHelp
+
+	conf.Responders = set.responders
+
+	if logBuffer != nil {
+		logBuffer.redact(responderSecrets(set.responders)...)
+	}
+}
+
+// readConfig reads the config file again for a reload, with the
+// responders in "responder-dir" added, nothing is applied
+func readConfig(confFile string) (*config, error) {
+	raw, err := ioutil.ReadFile(confFile)
+	if err != nil {
+		return nil, err
+	}
+
+	c := new(config)
+	if err := parseConfig(raw, c); err != nil {
+		return nil, err
+	}
+
+	if err := loadResponders(c); err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// handleReload reloads the passive responders and the listen settings on
+// SIGHUP
+func handleReload(confFile string, server *serverListener,
+	dispatch chan<- *dispatcherRequest) {
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP)
+
+	for range signals {
+		logger.Warn.Println("Received SIGHUP, reloading passive responders",
+			"and listen settings")
+		reload(confFile, server, dispatch)
+	}
+}
+
+// reload applies the config file again, the new responders are installed by
+// the dispatcher. A config with errors is rejected and the running
+// responders are kept, listen settings that can't be applied keep the running
+// listener without holding up the responders
+func reload(confFile string, server *serverListener,
+	dispatch chan<- *dispatcherRequest) {
+
+	c, err := readConfig(confFile)
+	if err == nil && c.LogLevel != "" && levelRank(c.LogLevel) < 0 {
+		err = errors.New("Invalid log level: " + c.LogLevel)
+	}
+	var set *passiveSet
+	if err == nil {
+		set, err = buildPassive(c.Responders)
+	}
+	if err != nil {
+		logger.Error.Println("Reload rejected, keeping the running",
+			"responders:", err)
+		return
+	}
+
+	// a config without a level keeps the running one, i.e. set by an admin
+	if c.LogLevel != "" {
+		setLogLevel(c.LogLevel)
+	}
+
+	if err := server.rebind(listenConfigOf(c)); err != nil {
+		logger.Error.Println("Keeping the running listener, unable to apply",
+			"the new listen settings:", err)
+	}
+
+	dispatch <- &dispatcherRequest{
+		Query: &query{
+			Type:    "command",
+			Source:  "server",
+			Command: &commandBlock{Action: "reload"},
+		},
+		Reload: set,
+	}
+}
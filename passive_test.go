@@ -0,0 +1,230 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDuplicateResponderNames(t *testing.T) {
+	setupTest(t, "")
+	var c config
+	if err := parseConfig([]byte(`
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/true
+  - name: status
+    match: ["^status$"]
+    cmd: /bin/true
+  - name: deploy
+    match: ["^ship$"]
+    cmd: /bin/true
+`), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := buildPassive(c.Responders)
+	if err == nil {
+		t.Fatal("Duplicate name accepted")
+	}
+	for _, part := range []string{"deploy", "responder 1 in the main config",
+		"responder 3 in the main config"} {
+
+		if !strings.Contains(err.Error(), part) {
+			t.Errorf("Error doesn't mention %q: %s", part, err)
+		}
+	}
+}
+
+func TestDuplicateResponderNameInResponderDir(t *testing.T) {
+	setupTest(t, "")
+
+	dir, err := ioutil.TempDir("", "priscilla-responders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	file := filepath.Join(dir, "deploy.yaml")
+	err = ioutil.WriteFile(file, []byte(
+		"match: [\"^deploy$\"]\ncmd: /bin/true\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = loadResponderDir(dir, []*passiveResponderConfig{
+		{Name: "deploy", Match: []string{"^ship$"}, Cmd: "/bin/true"}})
+	if err == nil {
+		t.Fatal("Duplicate name accepted")
+	}
+	if !strings.Contains(err.Error(), file) ||
+		!strings.Contains(err.Error(), "main config") {
+
+		t.Fatal("Error doesn't name both definitions:", err)
+	}
+}
+
+func TestUnnamedResponderRejected(t *testing.T) {
+	setupTest(t, "")
+
+	_, err := buildPassive(&responderConfig{
+		Passive: []*passiveResponderConfig{
+			{Name: "deploy", Match: []string{"^deploy$"}, Cmd: "/bin/true",
+				Help: "deploy", HelpCmds: []string{"deploy"}},
+			{Match: []string{"^ship$"}, Cmd: "/bin/true"},
+		},
+	})
+	if err == nil || !strings.Contains(err.Error(), "responder 2") {
+		t.Fatal("Unnamed responder not rejected:", err)
+	}
+}
+
+func TestReadConfigScansResponderDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-responders")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	write := func(name, body string) {
+		t.Helper()
+		err := ioutil.WriteFile(filepath.Join(dir, name), []byte(body), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	write("priscilla.conf", "responder-dir: "+dir+"\n"+`
+responders:
+  passive:
+  - name: status
+    match: ["^status$"]
+    cmd: /bin/true
+`)
+	write("deploy.yaml", "match: [\"^deploy$\"]\ncmd: /bin/true\n")
+	write("rollback.yaml", "match: [\"^rollback$\"]\ncmd: /bin/true\n")
+	write("scale.yaml", "name: scaler\nmatch: [\"^scale$\"]\ncmd: /bin/true\n")
+	// not a responder file
+	write("README", "responders go in *.yaml\n")
+
+	c, err := readConfig(filepath.Join(dir, "priscilla.conf"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, pr := range c.Responders.Passive {
+		names = append(names, pr.Name)
+	}
+	if strings.Join(names, ",") != "status,deploy,rollback,scaler" {
+		t.Fatal("Unexpected responders loaded:", names)
+	}
+
+	// a reload scans the directory again
+	write("ship.yaml", "name: deploy\nmatch: [\"^ship$\"]\ncmd: /bin/true\n")
+	_, err = readConfig(filepath.Join(dir, "priscilla.conf"))
+	if err == nil || !strings.Contains(err.Error(), "ship.yaml") ||
+		!strings.Contains(err.Error(), "deploy.yaml") {
+
+		t.Fatal("Duplicate name in the directory not reported:", err)
+	}
+}
+
+func TestConfigWithoutResponders(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	confFile := filepath.Join(dir, "priscilla.conf")
+	err = ioutil.WriteFile(confFile, []byte("prefix: pris\nport: 4517\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := readConfig(confFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Responders == nil || len(c.Responders.Passive) != 0 {
+		t.Fatal("Expected an empty responders section:", c.Responders)
+	}
+
+	// the startup steps main() runs with it
+	setupTest(t, "")
+	set, err := buildPassive(c.Responders)
+	if err != nil {
+		t.Fatal(err)
+	}
+	set.install()
+
+	port := freePort(t)
+	server, err := newServerListener(
+		listenConfig{ip: "127.0.0.1", port: port}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dispatch := make(chan *dispatcherRequest, 10)
+	server.start(dispatch)
+	defer server.Close()
+
+	conn := engage(t, port)
+	nextRequest(t, dispatch, "engage", "adapter")
+	hangUp(t, dispatch, conn)
+
+	testMessage("pris status", "room").handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 100*time.Millisecond)
+	if len(got) != 0 {
+		t.Fatal("Unexpected reply without responders:", got)
+	}
+}
+
+func TestMultiDocumentConfig(t *testing.T) {
+	var c config
+	if err := parseConfig([]byte(`port: 4600
+prefix: bot
+--- # responders
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/true
+---
+responders:
+  passive:
+  - name: status
+    match: ["^status$"]
+    cmd: /bin/true
+`), &c); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.Port != 4600 || c.Prefix != "bot" {
+		t.Error("Server settings not applied:", c.Port, c.Prefix)
+	}
+	names := make([]string, 0)
+	for _, pr := range c.Responders.Passive {
+		names = append(names, pr.Name)
+	}
+	if strings.Join(names, ",") != "deploy,status" {
+		t.Error("Unexpected responders:", names)
+	}
+
+	for _, test := range []struct {
+		raw, err string
+	}{
+		{"port: 4600\n---\nprefix: bot\nport: 4601\n",
+			"port is defined in documents 1 and 2"},
+		{"port: 4600\n---\nprefix: [bot\n", "Document 2: "},
+	} {
+		err := parseConfig([]byte(test.raw), &config{})
+		if err == nil || !strings.HasPrefix(err.Error(), test.err) {
+			t.Errorf("Expected %q, got: %v", test.err, err)
+		}
+	}
+}
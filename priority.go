@@ -0,0 +1,27 @@
+package main
+
+import (
+	"container/list"
+)
+
+// insertByPriority adds the responder after every one with the same or a
+// higher priority, so equal priorities keep config and registration order
+func insertByPriority(l *list.List, responder interface{}, priority int) {
+	for e := l.Back(); e != nil; e = e.Prev() {
+		if responderPriority(e.Value) >= priority {
+			l.InsertAfter(responder, e)
+			return
+		}
+	}
+	l.PushFront(responder)
+}
+
+func responderPriority(responder interface{}) int {
+	switch r := responder.(type) {
+	case *passiveResponderConfig:
+		return r.Priority
+	case *activeResponderConfig:
+		return r.priority
+	}
+	return 0
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
 	"flag"
@@ -10,24 +12,79 @@ import (
 	"gopkg.in/yaml.v2"
 	"io"
 	"io/ioutil"
+	"math/rand"
 	"net"
+	"net/http"
 	"os"
+	"path/filepath"
 	"regexp"
+	"runtime"
 	"strings"
+	"sync"
+	"text/template"
+	"time"
 )
 
 type config struct {
-	Port       int              `yaml:"port"`
-	Ip         string           `yaml:"ip,omitempty"`
-	Prefix     string           `yaml:"prefix"`
-	PrefixAlt  []string         `yaml:"prefix-alit"`
-	Help       string           `yaml:"help-command"`
-	Secret     string           `yaml:"secret"`
-	LogLevel   string           `yaml:"loglevel"`
-	LogFile    string           `yaml:"logfile"`
-	Responders *responderConfig `yaml:"responders"`
-	prefixLen  int
-	helpRegex  *regexp.Regexp
+	Port            int                 `yaml:"port"`
+	Ip              string              `yaml:"ip,omitempty"`
+	TlsCert         string              `yaml:"tls-cert"`
+	TlsKey          string              `yaml:"tls-key"`
+	TlsCa           string              `yaml:"tls-ca"`
+	Prefix          string              `yaml:"prefix"`
+	PrefixAlt       []string            `yaml:"prefix-alt"`
+	Help            string              `yaml:"help-command"`
+	Secret          string              `yaml:"secret"`
+	AdminSecret     string              `yaml:"admin-secret"`
+	AdminInject     bool                `yaml:"admin-inject"`
+	LogLevel        string              `yaml:"loglevel"`
+	LogFile         string              `yaml:"logfile"`
+	LogFormat       string              `yaml:"logformat"`
+	LogBuffer       int                 `yaml:"log-buffer"`
+	Workers         int                 `yaml:"workers"`
+	WorkerQueue     int                 `yaml:"worker-queue"`
+	MaxCommands     int                 `yaml:"max-concurrent-commands"`
+	CommandQueue    int                 `yaml:"command-queue"`
+	WriteBuffer     int                 `yaml:"write-buffer"`
+	FlushInterval   int                 `yaml:"flush-interval"`
+	MaxFrameSize    int                 `yaml:"max-frame-size"`
+	MaxMessageBytes int                 `yaml:"max-message-bytes"`
+	SendQueue       int                 `yaml:"send-queue"`
+	KeepAlive       int                 `yaml:"keepalive"`
+	IdleTimeout     int                 `yaml:"idle-timeout"`
+	UnknownType     string              `yaml:"unknown-type"`
+	Timezone        string              `yaml:"timezone"`
+	SuggestDistance int                 `yaml:"suggest-distance"`
+	MentionMatch    string              `yaml:"mention-match"`
+	AutoHelp        bool                `yaml:"auto-help"`
+	Maintenance     bool                `yaml:"maintenance"`
+	MaintenanceMsg  string              `yaml:"maintenance-message"`
+	ReplyFallback   string              `yaml:"reply-fallback"`
+	Responders      *responderConfig    `yaml:"responders"`
+	ResponderDir    string              `yaml:"responder-dir"`
+	Webhook         *webhookConfig      `yaml:"webhook"`
+	InfoRequests    *infoRequestsConfig `yaml:"info-requests"`
+	RoomFormats     map[string]string   `yaml:"room-formats"`
+	Outbound        outboundConfigs     `yaml:"outbound"`
+	ClockSkew       int                 `yaml:"clock-skew"`
+	ClockSkewPolicy string              `yaml:"clock-skew-policy"`
+	MatchTimeout    int                 `yaml:"match-timeout"`
+	FollowUpTimeout int                 `yaml:"follow-up-timeout"`
+	AuthHook        *authHookConfig     `yaml:"auth-hook"`
+	Onboarding      *onboardingConfig   `yaml:"onboarding"`
+	Statsd          *statsdConfig       `yaml:"statsd"`
+	MetricsPort     int                 `yaml:"metrics-port"`
+	HealthPort      int                 `yaml:"health-port"`
+	Sanitize        *sanitizeConfig     `yaml:"sanitize"`
+	RotateIds       *rotateIdsConfig    `yaml:"rotate-ids"`
+	ShutdownTimeout int                 `yaml:"shutdown-timeout"`
+	StateDir        string              `yaml:"state-dir"`
+	EngageLockout   *lockoutConfig      `yaml:"engage-lockout"`
+	Heartbeat       *heartbeatConfig    `yaml:"heartbeat"`
+	MinProtocol     int                 `yaml:"min-protocol"`
+	prefixes        []string
+	helpRegex       *regexp.Regexp
+	location        *time.Location
 }
 
 type responderConfig struct {
@@ -35,20 +92,107 @@ type responderConfig struct {
 }
 
 type passiveResponderConfig struct {
-	Name            string   `yaml:"name"`
-	Match           []string `yaml:"match"`
-	MentionMatch    []string `yaml:"mentionmatch"`
-	NoPrefix        bool     `yaml:"noprefix"`
-	FallThrough     bool     `yaml:"fallthrough"`
-	Cmd             string   `yaml:"cmd"`
-	Args            []string `yaml:"args"`
-	Help            string   `yaml:"help"`
-	HelpCmds        []string `yaml:"help-commands"`
-	HelpMentionCmds []string `yaml:"help-mention-commands"`
+	Name            string                 `yaml:"name"`
+	Match           []string               `yaml:"match"`
+	MentionMatch    []string               `yaml:"mentionmatch"`
+	MatchMode       string                 `yaml:"match-mode"`
+	Exclude         []string               `yaml:"exclude"`
+	Priority        int                    `yaml:"priority"`
+	AttachmentMatch *attachmentMatchConfig `yaml:"attachmentmatch"`
+	NoPrefix        bool                   `yaml:"noprefix"`
+	IgnoreBots      *bool                  `yaml:"ignore-bots"`
+	DMOnly          bool                   `yaml:"dm-only"`
+	Visibility      []string               `yaml:"visibility"`
+	FallThrough     bool                   `yaml:"fallthrough"`
+	Type            string                 `yaml:"type"`
+	Cmd             string                 `yaml:"cmd"`
+	Args            []string               `yaml:"args"`
+	Env             map[string]string      `yaml:"env"`
+	Workdir         string                 `yaml:"workdir"`
+	FailureNotice   bool                   `yaml:"failure-notice"`
+	Url             string                 `yaml:"url"`
+	Method          string                 `yaml:"method"`
+	Headers         map[string]string      `yaml:"headers"`
+	Body            string                 `yaml:"body"`
+	ArgsJson        string                 `yaml:"args-json"`
+	Help            string                 `yaml:"help"`
+	HelpCmds        []string               `yaml:"help-commands"`
+	HelpMentionCmds []string               `yaml:"help-mention-commands"`
+	ArgSchema       []*argSchema           `yaml:"arg-schema"`
+	TestInput       string                 `yaml:"test-input"`
+	StateChanging   bool                   `yaml:"state-changing"`
+	ExitMessages    map[int]string         `yaml:"exit-messages"`
+	DefaultExitMsg  string                 `yaml:"default-exit-message"`
+	SignalMsg       string                 `yaml:"signal-message"`
+	OutputTemplate  string                 `yaml:"output-template"`
+	OutputAttach    *outputAttachConfig    `yaml:"output-attachment"`
+	OutputActions   bool                   `yaml:"output-actions"`
+	Sanitize        *sanitizeConfig        `yaml:"sanitize"`
+	Serialize       *serializeConfig       `yaml:"serialize"`
+	Schedule        *scheduleConfig        `yaml:"schedule"`
+	Restrict        *restrictConfig        `yaml:"restrict"`
+	Group           string                 `yaml:"group"`
+	Weight          int                    `yaml:"weight"`
+	ReplyInThread   bool                   `yaml:"reply-in-thread"`
+	ReplyAsDM       bool                   `yaml:"reply-as-dm"`
+	MaxInputBytes   int                    `yaml:"max-input-bytes"`
+	MaxInputPolicy  string                 `yaml:"max-input-policy"`
+	Cache           *cacheConfig           `yaml:"cache"`
+	Locales         []string               `yaml:"locales"`
+	HelpLocales     map[string]string      `yaml:"help-locales"`
+	Retries         int                    `yaml:"retries"`
+	RetryBackoff    int                    `yaml:"retry-backoff"`
+	TransientCodes  []int                  `yaml:"transient-codes"`
+	Timeout         int                    `yaml:"timeout"`
 	regex           []*regexp.Regexp
 	mRegex          []*regexp.Regexp
+	exclude         []*regexp.Regexp
 	substitute      map[int]bool
+	namedParam      map[int]bool
 	roomParam       map[int]bool
+	userParam       map[int]bool
+	sourceParam     map[int]bool
+	attachParam     map[int]bool
+	nameRegex       []*regexp.Regexp
+	mimeRegex       []*regexp.Regexp
+	exitTmpl        map[int]*template.Template
+	defaultExitTmpl *template.Template
+	signalTmpl      *template.Template
+	outputTmpl      *template.Template
+	cache           *outputCache
+	sanitizer       *sanitizer
+	serial          *serialLocks
+	client          *http.Client
+	jsonBody        bool
+	// file is the responder-dir file the responder was loaded from, empty
+	// for the ones in the main config
+	file string
+}
+
+type outputAttachConfig struct {
+	Name    string `yaml:"name"`
+	Mime    string `yaml:"mime"`
+	MaxSize int    `yaml:"max-size"`
+}
+
+type argSchema struct {
+	Group    int      `yaml:"group"`
+	Pattern  string   `yaml:"pattern"`
+	Enum     []string `yaml:"enum"`
+	Optional bool     `yaml:"optional"`
+	regex    *regexp.Regexp
+}
+
+type restrictConfig struct {
+	CleanEnv  bool  `yaml:"clean-env"`
+	Nice      int   `yaml:"nice"`
+	MaxCpu    int   `yaml:"max-cpu"`
+	MaxMemory int64 `yaml:"max-memory"`
+}
+
+type attachmentMatchConfig struct {
+	Name []string `yaml:"name"`
+	Mime []string `yaml:"mime"`
 }
 
 type activeResponderConfig struct {
@@ -58,6 +202,18 @@ type activeResponderConfig struct {
 	matchNext bool
 	helpCmd   string
 	help      string
+	priority  int
+	// oneShot responders fire at most once, fired is set atomically by the
+	// match that gets to fire it
+	oneShot bool
+	fired   int32
+	// expires is when a responder registered with a ttl stops matching
+	expires time.Time
+	// scope is the conversation a follow-up waits on, nil matches anywhere
+	scope *followUpScope
+	// the room gets fallback if there's no reply within replyTimeout
+	replyTimeout time.Duration
+	fallback     string
 }
 
 type helpInfo struct {
@@ -65,6 +221,11 @@ type helpInfo struct {
 	helpMsg  string
 	noPrefix bool
 	mention  bool
+	// passive responders can have localized help and be limited to locales
+	helpLocales map[string]string
+	locales     []string
+	// active is the active responder the entry is for, nil for passive ones
+	active *activeResponderConfig
 }
 
 var logger *prislog.PrisLog
@@ -73,17 +234,164 @@ var prefixPResponders *list.List
 var noPrefixPResponders *list.List
 var mentionPResponders *list.List
 var unhandledPResponders *list.List
+var attachmentPResponders *list.List
 
+// the active responder lists are created once at startup and only modified
+// in place, under routeLock
 var prefixAResponders *list.List
 var noPrefixAResponders *list.List
 var mentionAResponders *list.List
 var unhandledAResponders *list.List
 
 var subRegex *regexp.Regexp
+var namedSubRegex = regexp.MustCompile("__name:([[:alpha:]_][[:word:]]*)__")
+var roomRegex = regexp.MustCompile("(__room__)")
+var attachRegex = regexp.MustCompile("(__attachment__|__filename__)")
+
+var userRegex = regexp.MustCompile("(__user__)")
+var sourceRegex = regexp.MustCompile("(__source__)")
+
+// a backslash in front of __user__ or __source__ keeps it literal
+var senderRegex = regexp.MustCompile(`\\?__(user|source)__`)
 var help *list.List
 
+// routeLock guards the responder and help lists, they are modified by the
+// dispatcher while workers match messages against them
+var routeLock sync.RWMutex
+
+var workers *workerPool
+
 var version, build string
 
+// loadResponders adds the responders in the responder directory to c, a
+// config without responders is valid, the server still serves adapters and
+// active responders, c.Responders is never nil past here
+func loadResponders(c *config) error {
+	if c.Responders == nil {
+		logger.Info.Println("No responders section in the config,",
+			"no passive responders configured")
+		c.Responders = new(responderConfig)
+	}
+
+	if c.ResponderDir != "" {
+		var err error
+		c.Responders.Passive, err = loadResponderDir(c.ResponderDir,
+			c.Responders.Passive)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// loadResponderDir appends the passive responder defined in each *.yaml file
+// in dir to responders, a file's responder is named after the file unless it
+// names itself, names have to be unique
+func loadResponderDir(dir string,
+	responders []*passiveResponderConfig) ([]*passiveResponderConfig, error) {
+
+	files, err := filepath.Glob(filepath.Join(dir, "*.yaml"))
+	if err != nil {
+		return nil, err
+	}
+
+	names := make(map[string]string)
+	for _, pr := range responders {
+		if pr.Name != "" {
+			names[pr.Name] = "main config"
+		}
+	}
+
+	for _, file := range files {
+		raw, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+
+		pr := new(passiveResponderConfig)
+		if err := yaml.Unmarshal(raw, pr); err != nil {
+			return nil, fmt.Errorf("%s: %s", file, err)
+		}
+
+		if pr.Name == "" {
+			pr.Name = strings.TrimSuffix(filepath.Base(file), ".yaml")
+		}
+
+		if other, ok := names[pr.Name]; ok {
+			return nil, fmt.Errorf("%s: responder name %s already used in %s",
+				file, pr.Name, other)
+		}
+		names[pr.Name] = file
+
+		logger.Info.Println("Loaded passive responder", pr.Name, "from", file)
+		pr.file = file
+		responders = append(responders, pr)
+	}
+
+	return responders, nil
+}
+
+// splitDocuments splits a multi-document YAML file on its "---" separators
+func splitDocuments(raw []byte) [][]byte {
+	docs := make([][]byte, 0)
+	doc := make([]byte, 0, len(raw))
+
+	for _, line := range bytes.SplitAfter(raw, []byte("\n")) {
+		trimmed := bytes.TrimRight(line, " \t\r\n")
+		if bytes.Equal(trimmed, []byte("---")) ||
+			bytes.HasPrefix(trimmed, []byte("--- ")) {
+
+			docs = append(docs, doc)
+			doc = make([]byte, 0, len(raw))
+			continue
+		}
+		doc = append(doc, line...)
+	}
+
+	return append(docs, doc)
+}
+
+// parseConfig reads every document of the config file into c, each setting
+// can only be in one document, except for the passive responders, the lists
+// are joined in document order
+func parseConfig(raw []byte, c *config) error {
+	defined := make(map[string]int)
+
+	for i, doc := range splitDocuments(raw) {
+		keys := make(map[string]interface{})
+		if err := yaml.Unmarshal(doc, &keys); err != nil {
+			return fmt.Errorf("Document %d: %s", i+1, err)
+		}
+
+		for key := range keys {
+			if key == "responders" {
+				continue
+			}
+			if other, ok := defined[key]; ok {
+				return fmt.Errorf("%s is defined in documents %d and %d", key,
+					other, i+1)
+			}
+			defined[key] = i + 1
+		}
+
+		responders := c.Responders
+		c.Responders = nil
+		if err := yaml.Unmarshal(doc, c); err != nil {
+			return fmt.Errorf("Document %d: %s", i+1, err)
+		}
+
+		if responders != nil && c.Responders != nil {
+			c.Responders.Passive = append(responders.Passive,
+				c.Responders.Passive...)
+		} else if responders != nil {
+			c.Responders = responders
+		}
+	}
+
+	return nil
+}
+
 func main() {
 	confFile := flag.String("conf", "", "Conf files, you know, conf files")
 	showversion := flag.Bool("version", false, "show version and exit")
@@ -91,17 +399,9 @@ func main() {
 	flag.Parse()
 
 	if *showversion {
-		if version == "" {
-			fmt.Println("Version: development")
-		} else {
-			fmt.Println("Version:", version)
-		}
-
-		if build == "" {
-			fmt.Println("Build: development")
-		} else {
-			fmt.Println("Build:", build)
-		}
+		v, b := versionInfo()
+		fmt.Println("Version:", v)
+		fmt.Println("Build:", b)
 		os.Exit(0)
 	}
 
@@ -119,13 +419,18 @@ func main() {
 		os.Exit(1)
 	}
 
-	err = yaml.Unmarshal(confRaw, &conf)
+	err = parseConfig(confRaw, &conf)
 
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "Error parsing config file: ", err)
 		os.Exit(1)
 	}
 
+	// the secret doesn't have to be kept in the config file
+	if conf.Secret == "" {
+		conf.Secret = os.Getenv("PRISCILLA_SECRET")
+	}
+
 	var logwriter *os.File
 
 	if conf.LogFile == "" || conf.LogFile == "STDOUT" {
@@ -152,6 +457,33 @@ func main() {
 		os.Exit(1)
 	}
 
+	if conf.LogBuffer == 0 {
+		conf.LogBuffer = 1000
+	}
+
+	if conf.LogBuffer > 0 {
+		secrets := []string{conf.Secret, conf.AdminSecret}
+		if conf.Webhook != nil {
+			secrets = append(secrets, conf.Webhook.Secret)
+		}
+		secrets = append(secrets, hookSecrets(conf.AuthHook)...)
+		logBuffer = newLogRing(conf.LogBuffer, secrets...)
+	}
+
+	// route the loggers through setLogLevel so the level can be changed at
+	// runtime, and so the enabled ones feed the log buffer
+	logOutput = logwriter
+	switch conf.LogFormat {
+	case "", "text":
+	case "json":
+		useJSONLogs()
+	default:
+		logger.Error.Fatal("Unsupported logformat:", conf.LogFormat)
+	}
+	if err := setLogLevel(conf.LogLevel); err != nil {
+		logger.Warn.Println("Log level can't be changed at runtime:", err)
+	}
+
 	if conf.Help == "" {
 		conf.Help = "help"
 	}
@@ -164,110 +496,115 @@ func main() {
 
 	logger.Debug.Println("Help command:", conf.helpRegex)
 
-	logger.Debug.Println("Config loaded:", conf)
+	maintenance = conf.Maintenance
+	if conf.ReplyFallback == "" {
+		conf.ReplyFallback = "Sorry, no response, please try again later."
+	}
 
-	prefixPResponders = list.New()
-	noPrefixPResponders = list.New()
-	mentionPResponders = list.New()
+	if conf.MaintenanceMsg == "" {
+		conf.MaintenanceMsg =
+			"Sorry, I'm in maintenance mode right now, please try again later."
+	}
 
-	prefixAResponders = list.New()
-	noPrefixAResponders = list.New()
-	mentionAResponders = list.New()
-	unhandledAResponders = list.New()
+	switch conf.MentionMatch {
+	case "":
+		conf.MentionMatch = "all"
+	case "all", "first", "priority":
+	default:
+		logger.Error.Fatal("Unsupported mention-match mode:", conf.MentionMatch)
+	}
 
-	subRegex = regexp.MustCompile("__([[:digit:]])__")
-	roomRegex := regexp.MustCompile("(__room__)")
+	if conf.AuthHook != nil {
+		if conf.AuthHook.Cmd == "" {
+			logger.Error.Fatal("Auth hook must have 'cmd' parameter")
+		}
+		if conf.AuthHook.Timeout <= 0 {
+			conf.AuthHook.Timeout = 5
+		}
+	}
 
-	help = list.New()
+	switch conf.UnknownType {
+	case "":
+		conf.UnknownType = "drop"
+	case "drop", "error", "disconnect":
+	default:
+		logger.Error.Fatal("Unsupported unknown-type policy:", conf.UnknownType)
+	}
 
-	for _, pr := range conf.Responders.Passive {
-		logger.Debug.Println("Passive responder:", *pr)
+	if conf.ClockSkew == 0 {
+		conf.ClockSkew = 300
+	}
 
-		if len(pr.Match) == 0 {
-			logger.Error.Fatal(
-				"Must specify at least one match for passive responder")
-		}
+	if conf.MatchTimeout == 0 {
+		conf.MatchTimeout = 200
+	}
 
-		pr.regex = make([]*regexp.Regexp, 0)
-		for _, pattern := range pr.Match {
-			rg, err := regexp.Compile(pattern)
-			if err != nil {
-				logger.Error.Fatal("Unable to parse expression:", pattern)
-			}
-			pr.regex = append(pr.regex, rg)
-		}
+	if conf.FollowUpTimeout <= 0 {
+		conf.FollowUpTimeout = 60
+	}
 
-		pr.mRegex = make([]*regexp.Regexp, 0)
-		for _, pattern := range pr.MentionMatch {
-			rg, err := regexp.Compile(pattern)
-			if err != nil {
-				logger.Error.Fatal("Unable to parse expression:", pattern)
-			}
-			pr.mRegex = append(pr.mRegex, rg)
-		}
+	switch conf.ClockSkewPolicy {
+	case "":
+		conf.ClockSkewPolicy = "clamp"
+	case "clamp", "reject":
+	default:
+		logger.Error.Fatal("Unsupported clock-skew-policy:",
+			conf.ClockSkewPolicy)
+	}
 
-		if len(pr.regex) == 0 {
-			logger.Error.Fatal("Missing match or multimatch:", pr.Name)
+	for room, format := range conf.RoomFormats {
+		if format != "plain" && format != "rich" {
+			logger.Error.Fatal("Unsupported format for room", room+":", format)
 		}
+	}
 
-		if pr.Cmd == "" {
-			logger.Error.Fatal(
-				"Passive Responder must have 'cmd' paramenter")
-		}
+	if conf.MaxFrameSize <= 0 {
+		conf.MaxFrameSize = 1 << 20
+	}
 
-		pr.substitute = make(map[int]bool)
-		pr.roomParam = make(map[int]bool)
-		for i, arg := range pr.Args {
-			if ms := subRegex.MatchString(arg); ms {
-				logger.Debug.Println("Substitution found:", arg)
-				pr.substitute[i] = true
-			}
-			if rs := roomRegex.MatchString(arg); rs {
-				pr.roomParam[i] = true
-				logger.Debug.Println("Room substitution found:", arg)
-			}
-		}
+	if conf.MaxMessageBytes == 0 {
+		conf.MaxMessageBytes = 16 << 20
+	}
 
-		if pr.NoPrefix {
-			logger.Debug.Println("Registered NoPrefix responder:", pr.Name)
-			noPrefixPResponders.PushBack(pr)
-		} else {
-			logger.Debug.Println("Registered Prefix responder:", pr.Name)
-			prefixPResponders.PushBack(pr)
-		}
+	if conf.SendQueue <= 0 {
+		conf.SendQueue = 256
+	}
 
-		if len(pr.mRegex) != 0 {
-			logger.Debug.Println("Registered Mention responder:", pr.Name)
-			mentionPResponders.PushBack(pr)
-		}
+	if conf.MinProtocol > protocolVersion {
+		logger.Error.Fatal("min-protocol is above the server's protocol",
+			"version", protocolVersion)
+	}
 
-		if pr.Help == "" || len(pr.HelpCmds) == 0 {
-			logger.Error.Fatal(
-				"Missing help or help-commands for passive responder: ",
-				pr.Name)
+	if conf.Timezone == "" {
+		conf.location = time.Local
+	} else {
+		conf.location, err = time.LoadLocation(conf.Timezone)
+		if err != nil {
+			logger.Error.Fatal("Bad timezone:", err)
 		}
+	}
 
-		for _, cmd := range pr.HelpCmds {
-			info := &helpInfo{
-				helpCmd: cmd,
-				helpMsg: pr.Help,
-			}
+	if err := loadResponders(&conf); err != nil {
+		logger.Error.Fatal("Error loading responder directory:", err)
+	}
 
-			if pr.NoPrefix {
-				info.noPrefix = true
-			}
+	logger.Debug.Println("Config loaded:", conf)
 
-			help.PushBack(info)
-		}
+	prefixAResponders = list.New()
+	noPrefixAResponders = list.New()
+	mentionAResponders = list.New()
+	unhandledAResponders = list.New()
 
-		for _, cmd := range pr.HelpMentionCmds {
-			help.PushBack(&helpInfo{
-				helpCmd: cmd,
-				helpMsg: pr.Help,
-				mention: true,
-			})
-		}
+	// responder groups choose their member at random
+	rand.Seed(time.Now().UnixNano())
+
+	subRegex = regexp.MustCompile("__([[:digit:]])__")
+
+	passive, err := buildPassive(conf.Responders)
+	if err != nil {
+		logger.Error.Fatal("Bad passive responder config:", err)
 	}
+	passive.install()
 
 	if conf.Port == 0 {
 		logger.Warn.Println("No port specified, using default: 4517")
@@ -281,21 +618,154 @@ func main() {
 		conf.Prefix = "pris"
 	}
 	conf.Prefix += " "
-	conf.prefixLen = len(conf.Prefix)
+	// main prefix first, alternates after it, all with the trailing space
+	conf.prefixes = []string{conf.Prefix}
+
+	alts := make([]string, 0, len(conf.PrefixAlt))
+	for _, alt := range conf.PrefixAlt {
+		alt = strings.Trim(alt, " ")
+		if alt == "" || alt+" " == conf.Prefix {
+			continue
+		}
+		alts = append(alts, alt)
+		conf.prefixes = append(conf.prefixes, alt+" ")
+	}
+	conf.PrefixAlt = alts
 
-	serverListener, err :=
-		net.Listen("tcp", fmt.Sprintf("%s:%d", conf.Ip, conf.Port))
+	lc := listenConfigOf(&conf)
+	tc, err := tlsConfig(lc)
+	if err != nil {
+		logger.Error.Fatal("Bad TLS config:", err)
+	}
 
+	server, err := newServerListener(lc, tc)
 	if err != nil {
 		logger.Error.Println("Error opening socket for listening: ", err)
 		os.Exit(5)
 	}
 
-	server, ok := serverListener.(*net.TCPListener)
+	if conf.Webhook != nil {
+		webhook, err = newWebhookSink(conf.Webhook)
+		if err != nil {
+			logger.Error.Fatal("Bad webhook config:", err)
+		}
+		logger.Info.Println("Forwarding", conf.Webhook.Messages,
+			"messages to webhook:", conf.Webhook.Url)
+	}
+
+	if conf.Statsd != nil {
+		sink, err := newStatsdSink(conf.Statsd)
+		if err != nil {
+			logger.Error.Fatal("Bad statsd config:", err)
+		}
+		metricSinks = append(metricSinks, sink)
+	}
+
+	if conf.MetricsPort > 0 {
+		sink := newPromSink()
+		if err := servePrometheus(sink, conf.MetricsPort); err != nil {
+			logger.Error.Fatal("Unable to serve metrics:", err)
+		}
+		logger.Info.Println("Serving Prometheus metrics on port",
+			conf.MetricsPort)
+		metricSinks = append(metricSinks, sink)
+	}
+
+	if conf.Onboarding != nil {
+		onboarding, err = newOnboarder(conf.Onboarding)
+		if err != nil {
+			logger.Error.Fatal("Bad onboarding config:", err)
+		}
+	}
+
+	infoAccess, err = newInfoGuard(conf.InfoRequests)
+	if err != nil {
+		logger.Error.Fatal("Bad info-requests config:", err)
+	}
+
+	if conf.RotateIds != nil {
+		if conf.RotateIds.Interval <= 0 {
+			logger.Error.Fatal("Id rotation interval must be positive")
+		}
+		if conf.RotateIds.Grace < 0 {
+			logger.Error.Fatal("Id rotation grace can't be negative")
+		}
+		if conf.RotateIds.Grace == 0 {
+			conf.RotateIds.Grace = 30
+		}
+	}
+
+	if conf.Heartbeat != nil {
+		if conf.Heartbeat.Interval <= 0 {
+			logger.Error.Fatal("Heartbeat interval must be positive")
+		}
+		if conf.Heartbeat.Timeout < 0 {
+			logger.Error.Fatal("Heartbeat timeout can't be negative")
+		}
+		if conf.Heartbeat.Timeout == 0 {
+			conf.Heartbeat.Timeout = 10
+		}
+	}
+
+	if conf.EngageLockout != nil {
+		lc := conf.EngageLockout
+		if lc.Failures < 0 || lc.Window < 0 || lc.Cooldown < 0 {
+			logger.Error.Fatal("Engage lockout settings can't be negative")
+		}
+		if lc.Failures == 0 {
+			lc.Failures = 5
+		}
+		if lc.Window == 0 {
+			lc.Window = 60
+		}
+		if lc.Cooldown == 0 {
+			lc.Cooldown = 300
+		}
+		engageLocks = newEngageLockout(lc)
+	}
+
+	if conf.StateDir != "" {
+		stateStore, err = newFileStore(conf.StateDir)
+		if err != nil {
+			logger.Error.Fatal("Unable to use state-dir:", err)
+		}
+		if err := loadDisabledRooms(); err != nil {
+			logger.Error.Println("Unable to load disabled rooms:", err)
+		}
+	}
+
+	if conf.ShutdownTimeout <= 0 {
+		conf.ShutdownTimeout = 10
+	}
 
-	if !ok {
-		logger.Error.Println("Listner isn't TCP? This is weird...")
-		os.Exit(6)
+	if conf.WriteBuffer > 0 && conf.FlushInterval <= 0 {
+		conf.FlushInterval = 10
+	}
+
+	if conf.Workers == 0 {
+		conf.Workers = runtime.NumCPU()
+	}
+	if conf.WorkerQueue <= 0 {
+		conf.WorkerQueue = 1000
+	}
+	logger.Info.Println("Dispatch workers:", conf.Workers)
+	workers = newWorkerPool(conf.Workers, conf.WorkerQueue)
+
+	if conf.MaxCommands < 0 || conf.CommandQueue < 0 {
+		logger.Error.Fatal("max-concurrent-commands and command-queue can't",
+			"be negative")
+	}
+	if conf.MaxCommands > 0 {
+		if conf.CommandQueue == 0 {
+			conf.CommandQueue = 100
+		}
+		commandSlots = newCommandLimiter(conf.MaxCommands, conf.CommandQueue)
+	}
+
+	if conf.HealthPort > 0 {
+		if err := serveHealth(conf.HealthPort); err != nil {
+			logger.Error.Fatal("Unable to serve health checks:", err)
+		}
 	}
 
 	quitChan := make(chan bool)
@@ -304,9 +774,19 @@ func main() {
 
 	go dispatcher(dispatcherChan, quitChan)
 
+	if conf.RotateIds != nil {
+		go rotateIds(conf.RotateIds, dispatcherChan)
+	}
+
+	if conf.Heartbeat != nil {
+		go heartbeat(conf.Heartbeat, dispatcherChan)
+	}
+
 	logger.Info.Println("Server starting, entering main loop...")
 
-	go listen(server, dispatcherChan)
+	server.start(dispatcherChan)
+	go handleSignals(server, dispatcherChan)
+	go handleReload(*confFile, server, dispatcherChan)
 
 	<-quitChan
 	logger.Warn.Println("Termination requtested")
@@ -314,56 +794,156 @@ func main() {
 	logger.Warn.Println("Exited normally")
 }
 
-func listen(server *net.TCPListener, dispatcherChan chan *dispatcherRequest) {
-
+// listen accepts connections until the listener is closed, for shutdown or
+// because a reload moved it to another address
+func listen(server net.Listener, dispatcherChan chan *dispatcherRequest) {
 	for {
-		conn, err := server.AcceptTCP()
+		conn, err := server.Accept()
 		if err == nil {
 			go serve(conn, dispatcherChan)
+		} else if connClosed(err) {
+			return
+		} else {
+			logger.Error.Println("Error accepting connection:", err)
 		}
 	}
 }
 
-func serve(conn *net.TCPConn, dispatcherChan chan *dispatcherRequest) {
+// setKeepAlive applies the keepalive config to the connection, it only
+// applies to TCP connections
+func setKeepAlive(conn net.Conn) {
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok || conf.KeepAlive == 0 {
+		return
+	}
+
+	if conf.KeepAlive < 0 {
+		tcpConn.SetKeepAlive(false)
+		return
+	}
+
+	if err := tcpConn.SetKeepAlive(true); err != nil {
+		logger.Warn.Println("Unable to enable TCP keepalive:", err)
+		return
+	}
+	tcpConn.SetKeepAlivePeriod(time.Duration(conf.KeepAlive) * time.Second)
+}
+
+func serve(conn net.Conn, dispatcherChan chan *dispatcherRequest) {
+
+	// a failed handshake would fail every read after it
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn.SetDeadline(time.Now().Add(handshakeTimeout()))
+		if err := tlsConn.Handshake(); err != nil {
+			logger.Error.Println("TLS handshake failed:", err)
+			conn.Close()
+			return
+		}
+		conn.SetDeadline(time.Time{})
+	}
+
+	limiter := newMessageLimiter(conn, conf.MaxMessageBytes)
 
 	var streamIn io.Reader
-	if logger.Level == "debug" {
+	if logLevel() == "debug" {
 		debugReader, debugWriter := io.Pipe()
-		streamIn = io.TeeReader(conn, debugWriter)
+		// unblocks monitorRaw once the connection is done being read
+		defer debugWriter.Close()
+		streamIn = io.TeeReader(limiter, debugWriter)
 		go monitorRaw(debugReader)
 	} else {
-		streamIn = conn
+		streamIn = limiter
+	}
+
+	var streamOut io.Writer = conn
+	if conf.WriteBuffer > 0 {
+		flusher := newFlushWriter(conn, conf.WriteBuffer,
+			time.Duration(conf.FlushInterval)*time.Millisecond)
+		defer flusher.Flush()
+		streamOut = flusher
 	}
 
-	decoder := json.NewDecoder(streamIn)
-	encoder := json.NewEncoder(conn)
+	jsonDecoder := json.NewDecoder(streamIn)
+	encoder := json.NewEncoder(streamOut)
+
+	var decoder queryDecoder = jsonDecoder
+	framing := false
 
 	var q *query
 	id := ""
+	// the id can change after engagement when ids are rotated
+	identity := &connIdentity{}
 	isAdapter := false
 	for {
 		q = new(query)
+		limiter.reset()
+		if conf.IdleTimeout > 0 {
+			conn.SetReadDeadline(time.Now().Add(
+				time.Duration(conf.IdleTimeout) * time.Second))
+		}
 		err := decoder.Decode(q)
 
 		if err != nil {
 			logger.Error.Println(err)
-			if err.Error() == "EOF" {
-				dispatcherChan <- &dispatcherRequest{
-					Query: &query{
-						Type:   "command",
-						Source: id,
-						Command: &commandBlock{
-							Action: "disengage",
-						},
-					},
+
+			// the idle deadline is the only one set on reads
+			idle := conf.IdleTimeout > 0 && isTimeout(err)
+			if idle {
+				logger.Warn.Println("Connection", identity.get(), "idle for",
+					conf.IdleTimeout, "seconds")
+			}
+
+			if !idle && decodeRecoverable(err, framing) {
+				if !framing && isTimeout(err) {
+					// json.Decoder keeps failing after a read error, resume
+					// from what it had buffered with a new one
+					jsonDecoder = json.NewDecoder(
+						io.MultiReader(jsonDecoder.Buffered(), streamIn))
+					decoder = jsonDecoder
 				}
-				break
+				continue
+			}
+
+			if err == errMessageTooLarge {
+				logger.Error.Println("Query from", identity.get(), "over",
+					conf.MaxMessageBytes, "bytes")
 			}
+
+			if err.Error() != "EOF" && !connClosed(err) {
+				logger.Error.Println("Unable to read from", identity.get()+",",
+					"closing connection")
+				if flusher, ok := streamOut.(*flushWriter); ok {
+					flusher.Flush()
+				}
+				conn.Close()
+			}
+
+			dispatcherChan <- &dispatcherRequest{
+				Query: &query{
+					Type:   "command",
+					Source: identity.get(),
+					Command: &commandBlock{
+						Action: "disengage",
+					},
+				},
+			}
+			break
 		} else {
+			identity.touch()
 			if id == "" {
-				id, err = initialize(q, encoder, dispatcherChan)
+				var framed queryEncoder
+				if q.Command != nil && q.Command.wantsFraming() {
+					framed = newFrameEncoder(streamOut)
+				}
+
+				id, err = initialize(q, encoder, framed,
+					&connCloser{conn: conn, out: streamOut}, identity,
+					remoteIP(conn.RemoteAddr()), dispatcherChan)
 				if err != nil {
 					logger.Error.Println("Failed to engage:", err)
+					if flusher, ok := streamOut.(*flushWriter); ok {
+						flusher.Flush()
+					}
 					conn.Close()
 					break
 				}
@@ -371,18 +951,29 @@ func serve(conn *net.TCPConn, dispatcherChan chan *dispatcherRequest) {
 				if q.Command.Type == "adapter" {
 					isAdapter = true
 				}
+
+				if framed != nil {
+					// whatever the JSON decoder read ahead belongs to the
+					// first frame
+					decoder = newFrameDecoder(
+						io.MultiReader(jsonDecoder.Buffered(), streamIn),
+						conf.MaxFrameSize)
+					framing = true
+				}
 			} else {
 				if err := q.validate(); err == nil {
 					// ignore the source identifier from the client, we'll
 					// use the identifier assigned during engagement
-					q.Source = id
+					q.Source = identity.get()
 
 					// if message is from adapter, ignore the value of the "to"
 					// field, it should always be empty or "server"
 					if isAdapter {
-						// only info reply allowed to pass directly from adapter
-						// to responder
-						if q.Type != "command" || q.Command.Action != "info" {
+						// only info and delete replies allowed to pass directly
+						// from adapter to responder
+						if q.Type != "command" || (q.Command.Action != "info" &&
+							q.Command.Action != "delete") {
+
 							q.To = ""
 						}
 
@@ -409,6 +1000,18 @@ func serve(conn *net.TCPConn, dispatcherChan chan *dispatcherRequest) {
 						Query:   q,
 						Encoder: encoder,
 					}
+				} else if err == errUnknownType {
+					logger.Error.Println("Unknown query type from",
+						identity.get()+":", q.Type)
+					if conf.UnknownType != "drop" {
+						q.Source = identity.get()
+						dispatcherChan <- &dispatcherRequest{
+							Query: q.rejectUnknown(
+								conf.UnknownType == "disconnect"),
+							Reply: true,
+							Close: conf.UnknownType == "disconnect",
+						}
+					}
 				} else {
 					logger.Error.Println("Failed to validate query:", err)
 				}
@@ -417,19 +1020,57 @@ func serve(conn *net.TCPConn, dispatcherChan chan *dispatcherRequest) {
 	}
 }
 
-func initialize(q *query, encoder *json.Encoder,
+// connClosed tells whether the read failed because the server closed the
+// connection, i.e. when it was kicked by an admin
+func connClosed(err error) bool {
+	opErr, ok := err.(*net.OpError)
+	return ok && strings.Contains(opErr.Err.Error(),
+		"use of closed network connection")
+}
+
+func initialize(q *query, encoder, framed queryEncoder, closer io.Closer,
+	identity *connIdentity, remote string,
 	dispatcherChan chan *dispatcherRequest) (string, error) {
 
 	if err := q.checkEngagement(); err != nil {
 		return "", err
 	}
 
+	// a locked out ip doesn't get to run the auth hook
+	if engageLocks != nil {
+		if err := engageLocks.check(remote, time.Now()); err != nil {
+			countMetric("connections.rejected", 1)
+			encoder.Encode(&query{
+				Type:   "command",
+				Source: "server",
+				To:     q.Source,
+				Command: &commandBlock{
+					Action: "terminate",
+					Data:   err.Error(),
+				},
+			})
+			return "", err
+		}
+	}
+
+	// the auth hook runs here rather than in the dispatcher so a slow hook
+	// only holds up this connection
+	var auth *authResult
+	if conf.AuthHook != nil {
+		auth = conf.AuthHook.authenticate(q.Command, q.Source)
+	}
+
 	resp := make(chan string)
 
 	dispatcherChan <- &dispatcherRequest{
 		Query:      q,
 		Encoder:    encoder,
+		Framed:     framed,
 		EngageResp: resp,
+		Auth:       auth,
+		Closer:     closer,
+		Identity:   identity,
+		Remote:     remote,
 	}
 
 	id := <-resp
@@ -447,15 +1088,15 @@ func monitorRaw(debugReader io.Reader) {
 
 	for {
 		count, err := debugReader.Read(buf)
-
-		if err == nil {
+		if count > 0 {
 			logger.Debug.Println("Received: ", string(buf[:count]))
-		} else {
-			logger.Error.Println(err)
-			if err.Error() == "EOF" {
-				logger.Warn.Println("EOF detected")
-				break
+		}
+
+		if err != nil {
+			if err != io.EOF {
+				logger.Error.Println(err)
 			}
+			break
 		}
 	}
 }
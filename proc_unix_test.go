@@ -0,0 +1,65 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// running tells if the process is alive, a killed child nobody reaped yet
+// is a zombie and doesn't count
+func running(pid int) bool {
+	stat, err := ioutil.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return false
+	}
+	fields := strings.Fields(string(stat))
+	return len(fields) > 2 && fields[2] != "Z"
+}
+
+func TestTimeoutKillsProcessGroup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-group")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	pidFile := filepath.Join(dir, "child")
+
+	setupTest(t, `
+responders:
+  passive:
+  - name: spawn
+    match: ["^spawn$"]
+    cmd: /bin/sh
+    args: ["-c", "sleep 30 & echo $! > `+pidFile+`; wait"]
+    timeout: 1
+`)
+
+	pr := findPassiveResponder("spawn")
+	if _, err := pr.execute(pr.Args, nil); err != errCommandTimeout {
+		t.Fatal("Expected the command to time out, got:", err)
+	}
+
+	raw, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid, err := strconv.Atoi(strings.TrimSpace(string(raw)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for wait := time.Now().Add(2 * time.Second); running(pid); {
+		if time.Now().After(wait) {
+			t.Fatal("Child", pid, "outlived the timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
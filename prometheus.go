@@ -0,0 +1,111 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// promSink keeps the metrics for Prometheus to scrape, in the text
+// exposition format, counters get a _total suffix and timers are exposed as
+// summaries in seconds
+type promSink struct {
+	lock     sync.Mutex
+	counters map[string]float64
+	gauges   map[string]float64
+	sums     map[string]float64
+	counts   map[string]int64
+}
+
+func newPromSink() *promSink {
+	return &promSink{
+		counters: make(map[string]float64),
+		gauges:   make(map[string]float64),
+		sums:     make(map[string]float64),
+		counts:   make(map[string]int64),
+	}
+}
+
+// label values only have backslash, quote and newline escaped
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// promName turns a metric name like messages.received into
+// priscilla_messages_received
+func promName(name string) string {
+	return "priscilla_" + strings.NewReplacer(".", "_", "-", "_").Replace(name)
+}
+
+func (p *promSink) count(name string, value int64, labels []string) {
+	series := promName(name) + "_total"
+	if len(labels) > 1 {
+		pairs := make([]string, 0, len(labels)/2)
+		for i := 1; i < len(labels); i += 2 {
+			pairs = append(pairs, labels[i-1]+"=\""+
+				labelEscaper.Replace(labels[i])+"\"")
+		}
+		series += "{" + strings.Join(pairs, ",") + "}"
+	}
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.counters[series] += float64(value)
+}
+
+func (p *promSink) gauge(name string, value int64) {
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.gauges[promName(name)] = float64(value)
+}
+
+func (p *promSink) timing(name string, d time.Duration) {
+	series := promName(name) + "_seconds"
+
+	p.lock.Lock()
+	defer p.lock.Unlock()
+	p.sums[series] += d.Seconds()
+	p.counts[series]++
+}
+
+func (p *promSink) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.lock.Lock()
+	lines := make([]string, 0,
+		len(p.counters)+len(p.gauges)+2*len(p.sums))
+	for series, value := range p.counters {
+		lines = append(lines, fmt.Sprintf("%s %g", series, value))
+	}
+	for series, value := range p.gauges {
+		lines = append(lines, fmt.Sprintf("%s %g", series, value))
+	}
+	for series, sum := range p.sums {
+		lines = append(lines, fmt.Sprintf("%s_sum %g", series, sum),
+			fmt.Sprintf("%s_count %d", series, p.counts[series]))
+	}
+	p.lock.Unlock()
+
+	sort.Strings(lines)
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprintln(w, strings.Join(lines, "\n"))
+}
+
+// servePrometheus exposes the sink on /metrics, the listener is opened
+// before returning so a port that's taken fails the startup
+func servePrometheus(sink *promSink, port int) error {
+	listener, err := net.Listen("tcp", ":"+strconv.Itoa(port))
+	if err != nil {
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", sink)
+
+	go func() {
+		err := http.Serve(listener, mux)
+		logger.Error.Println("Metrics endpoint stopped:", err)
+	}()
+	return nil
+}
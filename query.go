@@ -12,6 +12,17 @@ type query struct {
 	Message *messageBlock `json:"message"`
 }
 
+var errUnknownType = errors.New("Invalid query type")
+
+// priority orders the query in its connection's send queue, only messages
+// carry one
+func (q *query) priority() int {
+	if q.Message == nil {
+		return 0
+	}
+	return q.Message.Priority
+}
+
 func (q *query) validate() error {
 	switch {
 	case q.Type == "command" && q.Command == nil:
@@ -19,12 +30,36 @@ func (q *query) validate() error {
 	case q.Type == "message" && q.Message == nil:
 		return errors.New("Missing message block")
 	case q.Type != "command" && q.Type != "message":
-		return errors.New("Invalid query type")
+		return errUnknownType
 	default:
 		return nil
 	}
 }
 
+// rejectUnknown is what the sender of a query with an unknown type gets, an
+// error command, or a terminate if it's being disconnected for it
+func (q *query) rejectUnknown(disconnect bool) *query {
+	reply := &query{
+		Type:   "command",
+		Source: "server",
+		To:     q.Source,
+		Command: &commandBlock{
+			Action: "error",
+			Type:   "unknown_type",
+			Error:  errUnknownType.Error() + ": " + q.Type,
+		},
+	}
+
+	if disconnect {
+		reply.Command = &commandBlock{
+			Action: "terminate",
+			Data:   errUnknownType.Error() + ": " + q.Type,
+		}
+	}
+
+	return reply
+}
+
 func (q *query) checkEngagement() error {
 	switch {
 	case q.Type != "command":
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"strings"
+)
+
+// reactions a responder asked for on its own messages are tracked until the
+// adapter's delivery result tells the message's id on the chat service, the
+// tracked value is the room and the reaction
+func pendingReaction(m *messageBlock) string {
+	return m.Room + "\x00" + m.React
+}
+
+// react turns the delivery result of a message with a pending reaction into
+// the request for the adapter to add it, the reaction is dropped if the
+// message didn't make it or the adapter didn't tell its posted id
+func (c *commandBlock) react(adapter, pending string) *query {
+	if c.Type != "success" {
+		logger.Debug.Println("Reaction dropped, delivery failed:", c.Data)
+		return nil
+	}
+
+	postedId := c.Map["posted_id"]
+	if postedId == "" {
+		logger.Warn.Println("Reaction dropped, no posted id for:", c.Data)
+		return nil
+	}
+
+	parts := strings.SplitN(pending, "\x00", 2)
+	return reactRequest("server", adapter, postedId, parts[0], parts[1])
+}
+
+// reactRequest asks the adapter to add the reaction to the message with the
+// chat service's id in room
+func reactRequest(source, adapter, id, room, reaction string) *query {
+	return &query{
+		Type:   "command",
+		Source: source,
+		To:     adapter,
+		Command: &commandBlock{
+			Action: "react",
+			Type:   "add",
+			Data:   id,
+			Map: map[string]string{
+				"room":     room,
+				"reaction": reaction,
+			},
+		},
+	}
+}
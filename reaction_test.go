@@ -0,0 +1,42 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSelfReactionAfterDelivery(t *testing.T) {
+	setupTest(t, "")
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	engageAs(t, dispatch, "poller", "responder")
+
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "message",
+		Source: "poller",
+		To:     "chat",
+		Message: &messageBlock{Id: "poll-1", Message: "lunch?",
+			Room: "general", React: "thumbsup"},
+	}}
+	q := adapter.next(t, "message")
+	if q.Message.Id != "poll-1" || q.Message.React != "" {
+		t.Fatal("Unexpected message delivered:", *q.Message)
+	}
+
+	// the chat service's id for the message comes with the delivery result
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:   "command",
+		Source: "chat",
+		Command: &commandBlock{Action: "delivery", Type: "success",
+			Data: "poll-1", Map: map[string]string{"posted_id": "C01.1234"}},
+	}}
+
+	q = adapter.next(t, "react")
+	if q.To != "chat" || q.Command.Type != "add" ||
+		q.Command.Data != "C01.1234" ||
+		q.Command.Map["room"] != "general" ||
+		q.Command.Map["reaction"] != "thumbsup" {
+
+		t.Fatal("Unexpected reaction request:", q.To, *q.Command)
+	}
+}
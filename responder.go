@@ -1,147 +1,1155 @@
 package main
 
 import (
+	"bytes"
 	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
 	"os/exec"
 	"regexp"
 	"strconv"
 	"strings"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
 )
 
+var errCommandTimeout = errors.New("Command timed out")
+
 func triggerActiveResponders(responders *list.List, trimmed, source string,
 	m *messageBlock, metionMode bool, dispatch chan<- *dispatcherRequest) bool {
 
+	// collect the matches first, the dispatcher needs the write lock to
+	// register responders, so we can't be sending to it while holding the
+	// read lock, the source is read under it too, handoff and id rotation
+	// change it
+	type target struct {
+		source string
+		ar     *activeResponderConfig
+	}
+	targets := make([]target, 0)
+	fired := make([]*activeResponderConfig, 0)
+	handled := false
+	now := time.Now()
+
+	routeLock.RLock()
 	for eAr := responders.Front(); eAr != nil; eAr = eAr.Next() {
 		ar := eAr.Value.(*activeResponderConfig)
-		if ar.regex.MatchString(trimmed) {
-			q := &query{
-				Type:    "message",
-				Source:  source,
-				To:      ar.source,
-				Message: m,
+		if !ar.expires.IsZero() && now.After(ar.expires) {
+			continue
+		}
+
+		if ar.scope != nil && !ar.scope.matches(source, m) {
+			continue
+		}
+
+		match, err := findMatch(ar.regex, trimmed)
+		if err != nil {
+			logger.Warn.Println("Skipping active responder", ar.helpCmd,
+				"from", ar.source+":", err)
+			continue
+		}
+
+		if match != nil {
+			if ar.oneShot {
+				// another worker may be matching the same responder
+				if !atomic.CompareAndSwapInt32(&ar.fired, 0, 1) {
+					continue
+				}
+				fired = append(fired, ar)
 			}
 
-			logger.Debug.Println("Active responder match for:", ar.source)
-			dispatch <- &dispatcherRequest{Query: q}
+			targets = append(targets, target{ar.source, ar})
 
 			if !ar.matchNext {
-				return true
+				handled = true
+				break
 			}
 		}
 	}
-	return false
+	routeLock.RUnlock()
+
+	for _, ar := range fired {
+		removeResponder(responders, ar)
+	}
+
+	for _, t := range targets {
+		q := &query{
+			Type:    "message",
+			Source:  source,
+			To:      t.source,
+			Message: m,
+		}
+
+		if t.ar.replyTimeout > 0 {
+			replies.watch(t.source, t.ar, source, m, dispatch)
+		}
+
+		// delivered as is, only replies headed to adapters get the
+		// outbound treatment
+		logger.Debug.Println("Active responder match for:", t.source)
+		countMetric("responders.matched", 1, "kind", "active", "responder",
+			t.source)
+		dispatch <- &dispatcherRequest{Query: q, Reply: true}
+	}
+	return handled
 }
 
-func triggerPassiveResponders(responders *list.List, message,
-	source, room, from string, mentionMode bool,
+func triggerPassiveResponders(responders *list.List, message, source string,
+	m *messageBlock, mentionMode bool,
 	dispatch chan<- *dispatcherRequest) (matched bool) {
 
+	chosen := chooseAlternatives(responders, message, m, mentionMode)
+
 ResponderLoop:
 	for epr := responders.Front(); epr != nil; epr = epr.Next() {
 		pr := epr.Value.(*passiveResponderConfig)
 
-		var patterns []*regexp.Regexp
-		if mentionMode {
-			logger.Debug.Println("Using mention pattern")
-			patterns = pr.mRegex
-		} else {
-			logger.Debug.Println("Using regular pattern")
-			patterns = pr.regex
+		if reason := pr.skipReason(m); reason != "" {
+			logger.Debug.Println("Skipping responder", pr.Name+":", reason)
+			continue
+		}
+
+		if pr.Group != "" && chosen[pr.Group] != pr {
+			logger.Debug.Println("Skipping responder", pr.Name+":",
+				"not chosen in group", pr.Group)
+			continue
+		}
+
+		if rg := pr.excludedBy(message); rg != nil {
+			logger.Debug.Println("Skipping responder", pr.Name+":",
+				"excluded by", rg)
+			continue
+		}
+
+		var named map[string]string
+		if pr.MatchMode == "all" {
+			var ok bool
+			if named, ok = pr.matchAll(message, mentionMode); !ok {
+				continue
+			}
 		}
 
-		for _, rg := range patterns {
+		for _, rg := range pr.patterns(mentionMode) {
 			logger.Debug.Println("Trying to match:", pr.Name)
 			logger.Debug.Println("Pattern:", *rg)
 
-			matches := rg.FindAllStringSubmatch(message, 1)
-			if len(matches) == 0 {
+			match, err := findMatch(rg, message)
+			if err != nil {
+				logger.Warn.Println("Skipping responder", pr.Name+":", err)
+				continue ResponderLoop
+			}
+			if match == nil {
 				continue
 			}
-			match := matches[0]
+			countMetric("responders.matched", 1, "kind", "passive",
+				"responder", pr.Name)
 
 			logger.Debug.Println("Match:", match)
 
-			var output []byte
-			var err error
-
-			var subArgs []string
-			subbed := false
-			// submatch, may need to substitute
-
 			logger.Debug.Println("Match len:", len(match))
-			logger.Debug.Println("Substitution:", len(pr.substitute))
-			logger.Debug.Println("Room substitution:", len(pr.roomParam))
 
-			if len(match) >= 1 &&
-				(len(pr.substitute) > 0 || len(pr.roomParam) > 0) {
-
-				logger.Debug.Println("Substitution necessary")
+			match, err = pr.limitInput(match)
+			if err != nil {
+				logger.Info.Println("Input rejected for", pr.Name+":", err)
+				replyPassive(pr, err.Error(), source, m, mentionMode, dispatch)
+				matched = true
+				continue ResponderLoop
+			}
 
-				subArgs = make([]string, len(pr.Args))
-				copy(subArgs, pr.Args)
-				for i, _ := range pr.substitute {
-					logger.Debug.Println("Try sub:", subArgs[i])
+			if err := pr.checkArgs(match); err != nil {
+				logger.Debug.Println("Argument validation failed:", err)
+				replyPassive(pr, pr.usage(err), source, m, mentionMode,
+					dispatch)
+				matched = true
+				continue ResponderLoop
+			}
 
-					matchIds :=
-						subRegex.FindAllStringSubmatch(subArgs[i], -1)
-					logger.Debug.Println("MatchIds:", matchIds)
+			if pr.StateChanging && inMaintenance() {
+				logger.Info.Println("Blocked by maintenance mode:", pr.Name)
+				replyPassive(pr, conf.MaintenanceMsg, source, m, mentionMode,
+					dispatch)
+				matched = true
+				continue ResponderLoop
+			}
 
-					for _, matchId := range matchIds {
-						logger.Debug.Println("MatchId:", matchId)
+			if closed, replied := pr.outsideSchedule(source, m, mentionMode,
+				dispatch); closed {
 
-						mId, _ := strconv.Atoi(matchId[1])
-						if mId < len(match)-1 {
-							logger.Debug.Println("Subbed:", match[mId+1])
+				matched = matched || replied
+				continue ResponderLoop
+			}
 
-							subArgs[i] = strings.Replace(subArgs[i],
-								"__"+matchId[1]+"__", match[mId+1], -1)
-							subbed = true
-						}
-					}
-				}
-				for i, _ := range pr.roomParam {
-					logger.Debug.Println("Room substitution")
-					subArgs[i] =
-						strings.Replace(subArgs[i], "__room__", room, -1)
-					subbed = true
+			captured := captures(rg, match)
+			for name, value := range named {
+				if _, ok := captured[name]; !ok {
+					captured[name] = value
 				}
 			}
+			args, env := pr.invocation(match, captured, m, source, nil)
 
-			if subbed {
-				output, err = exec.Command(pr.Cmd, subArgs...).Output()
+			if pr.serial != nil {
+				pr.serialRun(captured[pr.Serialize.Group], func() {
+					runPassiveResponder(pr, args, env, source, m, mentionMode,
+						dispatch)
+				})
 			} else {
-				output, err = exec.Command(pr.Cmd, pr.Args...).Output()
+				go runPassiveResponder(pr, args, env, source, m,
+					mentionMode, dispatch)
 			}
 			matched = true
 
-			if err != nil {
-				logger.Error.Println("Passive responder error:", err)
+			// in "first" and "priority" modes the first mention responder to
+			// match handles the message, unless it's set to fall through
+			if mentionMode && conf.MentionMatch != "all" && !pr.FallThrough {
+				return
+			}
+
+			// one regex in the match is good, continue onto next responder
+			continue ResponderLoop
+		}
+	}
+	return
+}
+
+func (pr *passiveResponderConfig) patterns(
+	mentionMode bool) []*regexp.Regexp {
+
+	if mentionMode {
+		logger.Debug.Println("Using mention pattern")
+		return pr.mRegex
+	}
+	logger.Debug.Println("Using regular pattern")
+	return pr.regex
+}
+
+// matchesText tells whether any of the patterns match, a pattern that times
+// out counts as no match
+func (pr *passiveResponderConfig) matchesText(message string,
+	mentionMode bool) bool {
+
+	if pr.excludedBy(message) != nil {
+		return false
+	}
+
+	if pr.MatchMode == "all" {
+		_, ok := pr.matchAll(message, mentionMode)
+		return ok
+	}
+
+	for _, rg := range pr.patterns(mentionMode) {
+		match, err := findMatch(rg, message)
+		if err != nil {
+			logger.Warn.Println("Skipping responder", pr.Name+":", err)
+			return false
+		}
+		if match != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// excludedBy returns the exclude pattern matching the message, if any, an
+// excluded responder is passed over as if it didn't match
+func (pr *passiveResponderConfig) excludedBy(message string) *regexp.Regexp {
+	for _, rg := range pr.exclude {
+		match, err := findMatch(rg, message)
+		if err != nil {
+			// a pattern that can't decide can't clear the message either
+			logger.Warn.Println("Skipping responder", pr.Name+":", err)
+			return rg
+		}
+		if match != nil {
+			return rg
+		}
+	}
+	return nil
+}
+
+// matchAll tells whether every pattern matches, for "all" mode, along with
+// the named groups captured by any of them, the first pattern to capture a
+// name wins
+func (pr *passiveResponderConfig) matchAll(message string,
+	mentionMode bool) (map[string]string, bool) {
+
+	named := make(map[string]string)
+	for _, rg := range pr.patterns(mentionMode) {
+		match, err := findMatch(rg, message)
+		if err != nil {
+			logger.Warn.Println("Skipping responder", pr.Name+":", err)
+			return nil, false
+		}
+		if match == nil {
+			return nil, false
+		}
+
+		for i, name := range rg.SubexpNames() {
+			if _, ok := named[name]; name != "" && !ok {
+				named[name] = match[i]
+			}
+		}
+	}
+	return named, true
+}
+
+// chooseAlternatives picks the one responder to run for every group that has
+// members matching the message, by weighted random choice among them
+func chooseAlternatives(responders *list.List, message string,
+	m *messageBlock, mentionMode bool) map[string]*passiveResponderConfig {
+
+	chosen := make(map[string]*passiveResponderConfig)
+	totals := make(map[string]int)
+
+	for epr := responders.Front(); epr != nil; epr = epr.Next() {
+		pr := epr.Value.(*passiveResponderConfig)
+		if pr.Group == "" || pr.skipReason(m) != "" ||
+			!pr.matchesText(message, mentionMode) {
+
+			continue
+		}
+
+		// weighted reservoir sampling, each member replaces the choice so
+		// far with a chance of its share of the weight seen so far
+		totals[pr.Group] += pr.Weight
+		if rand.Intn(totals[pr.Group]) < pr.Weight {
+			chosen[pr.Group] = pr
+		}
+	}
+
+	return chosen
+}
+
+func triggerAttachmentResponders(responders *list.List, m *messageBlock,
+	source string, dispatch chan<- *dispatcherRequest) (matched bool) {
+
+	for epr := responders.Front(); epr != nil; epr = epr.Next() {
+		pr := epr.Value.(*passiveResponderConfig)
+
+		if reason := pr.skipReason(m); reason != "" {
+			logger.Debug.Println("Skipping responder", pr.Name+":", reason)
+			continue
+		}
+
+		for _, att := range m.Attachments {
+			if !pr.matchAttachment(att) {
+				continue
+			}
+
+			logger.Debug.Println("Attachment match:", pr.Name, att.Name)
+			countMetric("responders.matched", 1, "kind", "passive",
+				"responder", pr.Name)
+
+			if closed, replied := pr.outsideSchedule(source, m, false,
+				dispatch); closed {
+
+				matched = matched || replied
+				continue
+			}
+			matched = true
+
+			if pr.StateChanging && inMaintenance() {
+				logger.Info.Println("Blocked by maintenance mode:", pr.Name)
+				replyPassive(pr, conf.MaintenanceMsg, source, m, false,
+					dispatch)
+				continue
+			}
+
+			captured := map[string]string{
+				"attachment": att.ref(),
+				"filename":   att.Name,
+			}
+			args, env := pr.invocation(nil, captured, m, source, att)
+
+			if pr.serial != nil {
+				pr.serialRun(captured[pr.Serialize.Group], func() {
+					runPassiveResponder(pr, args, env, source, m, false,
+						dispatch)
+				})
 			} else {
-				logger.Debug.Println("Passive responder executed:",
-					string(output))
-
-				request := dispatcherRequest{
-					Query: &query{
-						Type:   "message",
-						Source: "Passive Responder: " + pr.Name,
-						To:     source,
-						Message: &messageBlock{
-							Message: strings.Trim(string(output), " \n"),
-							Room:    room,
-						},
-					},
-				}
+				go runPassiveResponder(pr, args, env, source, m, false,
+					dispatch)
+			}
+		}
+	}
+	return
+}
+
+// outsideSchedule tells whether the responder is outside of its schedule,
+// and whether it replied with the schedule's message, that reply handles the
+// message. Every path a passive responder fires through checks it.
+func (pr *passiveResponderConfig) outsideSchedule(source string,
+	m *messageBlock, mentionMode bool,
+	dispatch chan<- *dispatcherRequest) (closed, replied bool) {
+
+	if pr.Schedule == nil || pr.Schedule.open(time.Now()) {
+		return false, false
+	}
+
+	logger.Debug.Println("Outside of schedule:", pr.Name)
+	if pr.Schedule.Message == "" {
+		return true, false
+	}
+	replyPassive(pr, pr.Schedule.Message, source, m, mentionMode, dispatch)
+	return true, true
+}
+
+// skipReason tells why the responder shouldn't handle the message at all,
+// regardless of its content, or returns an empty string if it may
+func (pr *passiveResponderConfig) skipReason(m *messageBlock) string {
+	if pr.disabledIn(m.Room) {
+		return "disabled in room " + m.Room
+	}
+
+	if m.IsBot && (pr.IgnoreBots == nil || *pr.IgnoreBots) {
+		return "message from a bot"
+	}
+
+	if pr.DMOnly && !m.IsDM {
+		return "not a direct message"
+	}
+
+	if len(pr.Visibility) > 0 {
+		allowed := false
+		for _, visibility := range pr.Visibility {
+			if visibility == m.Visibility {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			return "visibility " + m.Visibility + " not allowed"
+		}
+	}
+
+	if len(pr.Locales) > 0 && !localeMatches(pr.Locales, m.Locale) {
+		return "locale " + m.Locale + " not allowed"
+	}
+
+	return ""
+}
+
+func (pr *passiveResponderConfig) matchAttachment(att *Attachment) bool {
+	if att == nil {
+		return false
+	}
+
+	if len(pr.nameRegex) > 0 && !anyMatch(pr.nameRegex, att.Name) {
+		return false
+	}
+
+	if len(pr.mimeRegex) > 0 && !anyMatch(pr.mimeRegex, att.Mime) {
+		return false
+	}
 
-				if mentionMode {
-					request.Query.Message.MentionNotify = []string{from}
+	return true
+}
+
+// anyMatch tells whether any of the patterns match, a pattern that times out
+// counts as no match
+func anyMatch(patterns []*regexp.Regexp, s string) bool {
+	for _, rg := range patterns {
+		matched, err := matchString(rg, s)
+		if err != nil {
+			logger.Warn.Println("Skipping pattern", rg.String()+":", err)
+			continue
+		}
+		if matched {
+			return true
+		}
+	}
+	return false
+}
+
+func (pr *passiveResponderConfig) expandArgs(match []string,
+	captured map[string]string, m *messageBlock, source string,
+	att *Attachment) []string {
+
+	// submatch, may need to substitute
+	logger.Debug.Println("Substitution:", len(pr.substitute))
+	logger.Debug.Println("Room substitution:", len(pr.roomParam))
+	logger.Debug.Println("Attachment substitution:", len(pr.attachParam))
+
+	if len(pr.substitute) == 0 && len(pr.namedParam) == 0 &&
+		len(pr.roomParam) == 0 && len(pr.userParam) == 0 &&
+		len(pr.sourceParam) == 0 && len(pr.attachParam) == 0 {
+
+		return pr.Args
+	}
+
+	logger.Debug.Println("Substitution necessary")
+
+	subArgs := make([]string, len(pr.Args))
+	copy(subArgs, pr.Args)
+
+	// flags referencing a submatch that didn't capture anything are left out
+	// entirely, "--branch=" or a literal "--branch=__1__" would only confuse
+	// the command
+	drop := make(map[int]bool)
+
+	for i, _ := range pr.substitute {
+		logger.Debug.Println("Try sub:", subArgs[i])
+
+		matchIds := subRegex.FindAllStringSubmatch(subArgs[i], -1)
+		logger.Debug.Println("MatchIds:", matchIds)
+
+		for _, matchId := range matchIds {
+			logger.Debug.Println("MatchId:", matchId)
+
+			mId, _ := strconv.Atoi(matchId[1])
+			if mId < len(match)-1 {
+				logger.Debug.Println("Subbed:", match[mId+1])
+
+				subArgs[i] = strings.Replace(subArgs[i],
+					"__"+matchId[1]+"__", match[mId+1], -1)
+			}
+
+			if (mId >= len(match)-1 || match[mId+1] == "") &&
+				strings.HasPrefix(pr.Args[i], "-") {
+
+				logger.Debug.Println("Dropping flag, nothing captured:",
+					pr.Args[i])
+				drop[i] = true
+			}
+		}
+	}
+
+	for i, _ := range pr.namedParam {
+		for _, name := range namedSubRegex.FindAllStringSubmatch(pr.Args[i],
+			-1) {
+
+			// a pattern without the group leaves it uncaptured
+			value := captured[name[1]]
+			subArgs[i] = strings.Replace(subArgs[i], name[0], value, -1)
+
+			if value == "" && strings.HasPrefix(pr.Args[i], "-") {
+				logger.Debug.Println("Dropping flag, nothing captured:",
+					pr.Args[i])
+				drop[i] = true
+			}
+		}
+	}
+
+	for i, _ := range pr.roomParam {
+		logger.Debug.Println("Room substitution")
+		subArgs[i] = strings.Replace(subArgs[i], "__room__", m.Room, -1)
+	}
+
+	sender := map[string]string{"user": m.From, "source": source}
+	for i := range pr.Args {
+		if !pr.userParam[i] && !pr.sourceParam[i] {
+			continue
+		}
+		logger.Debug.Println("Sender substitution")
+		subArgs[i] = senderRegex.ReplaceAllStringFunc(subArgs[i],
+			func(token string) string {
+				if token[0] == '\\' {
+					return token[1:]
 				}
+				return sender[strings.Trim(token, "_")]
+			})
+	}
+
+	if att != nil {
+		ref := att.ref()
+		for i, _ := range pr.attachParam {
+			logger.Debug.Println("Attachment substitution")
+			subArgs[i] = strings.Replace(subArgs[i], "__attachment__", ref, -1)
+			subArgs[i] = strings.Replace(subArgs[i], "__filename__", att.Name,
+				-1)
+		}
+	}
+
+	if len(drop) == 0 {
+		return subArgs
+	}
+
+	kept := make([]string, 0, len(subArgs))
+	for i, arg := range subArgs {
+		if !drop[i] {
+			kept = append(kept, arg)
+		}
+	}
+
+	return kept
+}
+
+// invocation is the args and env the responder runs with for the match, an
+// http responder gets its url, body and headers instead
+func (pr *passiveResponderConfig) invocation(match []string,
+	captured map[string]string, m *messageBlock, source string,
+	att *Attachment) ([]string, []string) {
 
-				dispatch <- &request
+	if pr.Type == "http" {
+		return pr.httpArgs(match, captured, m, source)
+	}
+
+	args, env := pr.jsonArgs(pr.expandArgs(match, captured, m, source, att),
+		captured)
+	return args, append(pr.expandEnv(match, captured, m, source), env...)
+}
+
+// jsonArgs encodes the captures as a JSON object and passes it to the
+// command as the last argument or the PRISCILLA_ARGS environment variable,
+// depending on the responder's args-json setting
+func (pr *passiveResponderConfig) jsonArgs(args []string,
+	captures map[string]string) ([]string, []string) {
+
+	if pr.ArgsJson == "" {
+		return args, nil
+	}
+
+	encoded, err := json.Marshal(captures)
+	if err != nil {
+		logger.Error.Println("Unable to encode arguments:", err)
+		return args, nil
+	}
+
+	if pr.ArgsJson == "env" {
+		return args, []string{"PRISCILLA_ARGS=" + string(encoded)}
+	}
+
+	jsonArgs := make([]string, len(args), len(args)+1)
+	copy(jsonArgs, args)
+	return append(jsonArgs, string(encoded)), nil
+}
+
+// limitInput enforces max-input-bytes on every matched group before it's
+// handed to the command, oversized groups are truncated or the input is
+// rejected, depending on the responder's policy
+func (pr *passiveResponderConfig) limitInput(match []string) ([]string,
+	error) {
+
+	if pr.MaxInputBytes <= 0 {
+		return match, nil
+	}
+
+	limited := make([]string, len(match))
+	for i, group := range match {
+		if len(group) <= pr.MaxInputBytes {
+			limited[i] = group
+			continue
+		}
+
+		if pr.MaxInputPolicy == "reject" {
+			return nil, fmt.Errorf("Input too long (max %d bytes)",
+				pr.MaxInputBytes)
+		}
+
+		// cut on a rune boundary so the argument stays valid UTF-8
+		cut := pr.MaxInputBytes
+		for cut > 0 && !utf8.RuneStart(group[cut]) {
+			cut--
+		}
+		limited[i] = group[:cut]
+	}
+
+	return limited, nil
+}
+
+// captures maps the submatches by their substitution index, and named groups
+// by their name as well
+func captures(rg *regexp.Regexp, match []string) map[string]string {
+	captured := make(map[string]string)
+
+	names := rg.SubexpNames()
+	for i := 1; i < len(match); i++ {
+		captured[strconv.Itoa(i-1)] = match[i]
+		if i < len(names) && names[i] != "" {
+			captured[names[i]] = match[i]
+		}
+	}
+
+	return captured
+}
+
+func runPassiveResponder(pr *passiveResponderConfig, args, env []string,
+	source string, m *messageBlock, mentionMode bool,
+	dispatch chan<- *dispatcherRequest) {
+
+	start := time.Now()
+	output, err := pr.cachedExecute(args, env)
+	duration := time.Since(start)
+
+	countMetric("passive.runs", 1)
+	timeMetric("passive.duration", duration)
+	if err != nil {
+		countMetric("passive.failures", 1)
+	}
+
+	if err == nil && pr.OutputActions {
+		dispatchActions(pr, output, source, m, mentionMode, dispatch)
+		return
+	}
+
+	if err == nil && pr.OutputAttach != nil {
+		replyAttachment(pr, output, source, m, mentionMode, dispatch)
+		return
+	}
+
+	if err == errCommandsBusy {
+		logger.Warn.Println("Passive responder", pr.Name, "dropped:", err)
+		return
+	}
+
+	if err == errCommandTimeout {
+		logger.Warn.Println("Passive responder", pr.Name, "timed out after",
+			pr.Timeout, "seconds")
+		replyPassive(pr, fmt.Sprintf("%s timed out after %ds", pr.Name,
+			pr.Timeout), source, m, mentionMode, dispatch)
+		return
+	}
+
+	if stderr := commandStderr(err); stderr != "" {
+		logger.Error.Println("Passive responder", pr.Name, "stderr:", stderr)
+	}
+
+	if msg, ok := pr.exitMessage(output, err, duration); ok {
+		logger.Debug.Println("Passive responder exit message:", msg)
+		replyPassive(pr, pr.sanitizer.sanitize(msg), source, m, mentionMode,
+			dispatch)
+		return
+	}
+
+	if err != nil {
+		logger.Error.Println("Passive responder error:", err)
+		if pr.FailureNotice {
+			replyPassive(pr, pr.failureNotice(err), source, m, mentionMode,
+				dispatch)
+		}
+		return
+	}
+
+	logger.Debug.Println("Passive responder executed:", string(output))
+
+	replyPassive(pr, pr.sanitizer.sanitize(string(output)), source, m,
+		mentionMode, dispatch)
+}
+
+// cachedExecute serves the output from the responder's cache if it has one
+// and the same arguments ran successfully within the ttl, otherwise it runs
+// the command
+func (pr *passiveResponderConfig) cachedExecute(args, env []string) ([]byte,
+	error) {
+
+	if pr.cache == nil {
+		return pr.execute(args, env)
+	}
+
+	key := cacheKey(args, env)
+	if output, ok := pr.cache.get(key); ok {
+		logger.Debug.Println("Passive responder served from cache:", pr.Name)
+		countMetric("passive.cache_hits", 1)
+		return output, nil
+	}
+
+	output, err := pr.execute(args, env)
+	if err == nil {
+		pr.cache.put(key, output)
+	}
+	return output, err
+}
+
+// execute runs the command, retrying up to pr.Retries times with an
+// exponential backoff when it fails with a transient exit code. The timeout
+// is the budget for all the attempts and the backoff between them, a retry
+// that can't start before it runs out isn't made
+func (pr *passiveResponderConfig) execute(args, env []string) ([]byte,
+	error) {
+
+	backoff := time.Duration(pr.RetryBackoff) * time.Millisecond
+	var deadline time.Time
+
+	for attempt := 0; ; attempt++ {
+		output, err := pr.limitedOutput(args, env, &deadline)
+		if err == nil || attempt >= pr.Retries || !pr.transient(err) {
+			return output, err
+		}
+
+		if !deadline.IsZero() && !time.Now().Add(backoff).Before(deadline) {
+			logger.Warn.Println("Passive responder", pr.Name, "failed, no",
+				"time left to retry:", err)
+			return output, err
+		}
+
+		logger.Warn.Println("Passive responder", pr.Name, "failed, retrying:",
+			err)
+		time.Sleep(backoff)
+		backoff *= 2
+	}
+}
+
+// limitedOutput runs the command once a slot is free under
+// max-concurrent-commands, the deadline is set from the timeout when the
+// first attempt gets its slot, waiting for one doesn't count against it
+func (pr *passiveResponderConfig) limitedOutput(args, env []string,
+	deadline *time.Time) ([]byte, error) {
+
+	if commandSlots != nil {
+		release, err := commandSlots.acquire()
+		if err != nil {
+			return nil, err
+		}
+		defer release()
+	}
+
+	if deadline.IsZero() && pr.Timeout > 0 {
+		*deadline = time.Now().Add(time.Duration(pr.Timeout) * time.Second)
+	}
+
+	defer commandStarted()()
+	if pr.Type == "http" {
+		return pr.httpOutput(args, env, *deadline)
+	}
+	return pr.output(pr.command(args, env), *deadline)
+}
+
+// output runs the command and collects its output, a command running past
+// the deadline is killed along with its process group, stderr is kept apart
+// and handed back in the *exec.ExitError of a non-zero exit
+func (pr *passiveResponderConfig) output(cmd *exec.Cmd,
+	deadline time.Time) ([]byte, error) {
+
+	var stdout bytes.Buffer
+	var stderr stderrBuffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- cmd.Wait()
+	}()
+
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		timeout = time.After(deadline.Sub(time.Now()))
+	}
+
+	select {
+	case err := <-done:
+		if exitErr, ok := err.(*exec.ExitError); ok {
+			exitErr.Stderr = stderr.Bytes()
+		}
+		return stdout.Bytes(), err
+	case <-timeout:
+		// not waiting for it, a child that escaped the kill could keep the
+		// output open
+		killProcessGroup(cmd)
+		return nil, errCommandTimeout
+	}
+}
+
+// command builds the process for an execution, applying the responder's
+// restrictions, passive commands always run in their own process group so
+// they can be killed along with any children they spawn
+func (pr *passiveResponderConfig) command(args, env []string) *exec.Cmd {
+	name, cmdArgs := pr.Cmd, args
+	if r := pr.Restrict; r != nil && (r.Nice != 0 || r.MaxCpu > 0 ||
+		r.MaxMemory > 0) {
+
+		name, cmdArgs = "/bin/sh", append([]string{"-c", r.script(), pr.Cmd},
+			args...)
+	}
+
+	cmd := exec.Command(name, cmdArgs...)
+	setProcessGroup(cmd)
+	cmd.Dir = pr.Workdir
+
+	// later entries win, so env overrides what's inherited
+	if pr.Restrict != nil && pr.Restrict.CleanEnv {
+		cmd.Env = append([]string{"PATH=" + os.Getenv("PATH")}, env...)
+	} else if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
+	}
+
+	return cmd
+}
+
+// script is the shell wrapper applying the limits before the command is
+// exec'd, so they are in place before the command starts running
+func (r *restrictConfig) script() string {
+	script := ""
+	if r.MaxCpu > 0 {
+		script += fmt.Sprintf("ulimit -t %d || exit 126; ", r.MaxCpu)
+	}
+	if r.MaxMemory > 0 {
+		// ulimit -v takes kilobytes
+		script += fmt.Sprintf("ulimit -v %d || exit 126; ",
+			(r.MaxMemory+1023)/1024)
+	}
+	if r.Nice != 0 {
+		script += fmt.Sprintf("exec nice -n %d \"$0\" \"$@\"", r.Nice)
+	} else {
+		script += "exec \"$0\" \"$@\""
+	}
+	return script
+}
+
+type exitMessageData struct {
+	Output string
+	Code   int
+	Signal string
+	// Fields holds the output decoded, if the command emitted a JSON object
+	Fields map[string]interface{}
+	// Duration is how long the command took, i.e. "350ms" or "1m5s"
+	Duration string
+}
+
+// exitMessage renders the message configured for the way the command exited,
+// ok is false when there's none and the output should be handled as usual
+func (pr *passiveResponderConfig) exitMessage(output []byte, err error,
+	duration time.Duration) (msg string, ok bool) {
+
+	data := &exitMessageData{
+		Output:   strings.Trim(string(output), " \n"),
+		Duration: formatDuration(duration),
+	}
+	if json.Unmarshal(output, &data.Fields) != nil {
+		data.Fields = nil
+	}
+
+	tmpl := pr.exitTmpl[0]
+	if pr.outputTmpl != nil && data.Fields != nil {
+		// output that isn't JSON is replied as is
+		tmpl = pr.outputTmpl
+	}
+
+	if err != nil {
+		status, exited := exitStatus(err)
+		if !exited {
+			return "", false
+		}
+
+		if status.Signaled() {
+			data.Code = -1
+			data.Signal = status.Signal().String()
+			tmpl = pr.signalTmpl
+		} else {
+			data.Code = status.ExitStatus()
+			tmpl = pr.exitTmpl[data.Code]
+			if tmpl == nil {
+				tmpl = pr.defaultExitTmpl
 			}
+		}
+	}
 
-			// one regex in the match is good, continue onto next responder
-			continue ResponderLoop
+	if tmpl == nil {
+		return "", false
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		logger.Error.Println("Unable to render exit message:", err)
+		return "", false
+	}
+
+	return buf.String(), true
+}
+
+// formatDuration rounds to milliseconds under a second and to seconds above
+func formatDuration(d time.Duration) string {
+	if d < time.Second {
+		return fmt.Sprintf("%dms", d/time.Millisecond)
+	}
+	d += time.Second / 2
+	return (d - d%time.Second).String()
+}
+
+// exitStatus extracts the wait status of a command that ran and exited
+// unsuccessfully, exited is false if the command never ran
+func exitStatus(err error) (status syscall.WaitStatus, exited bool) {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return status, false
+	}
+
+	status, ok = exitErr.Sys().(syscall.WaitStatus)
+	return status, ok
+}
+
+// transient tells whether the command failure is worth a retry, only non-zero
+// exits are, limited to pr.TransientCodes if any are configured, for http
+// responders the codes are HTTP statuses and only 5xx are retried by default
+func (pr *passiveResponderConfig) transient(err error) bool {
+	var code int
+	if statusErr, ok := err.(*httpStatusError); ok {
+		if len(pr.TransientCodes) == 0 {
+			return statusErr.code >= 500
+		}
+		code = statusErr.code
+	} else {
+		status, exited := exitStatus(err)
+		if !exited {
+			return false
 		}
+		if len(pr.TransientCodes) == 0 {
+			return true
+		}
+		code = status.ExitStatus()
 	}
-	return
+
+	for _, transient := range pr.TransientCodes {
+		if code == transient {
+			return true
+		}
+	}
+	return false
+}
+
+// diagnose runs the responder's test input through its patterns and
+// executes the command, with PRISCILLA_DIAGNOSE set so commands with side
+// effects can do a dry run instead
+func (pr *passiveResponderConfig) diagnose() error {
+	patterns := append(append([]*regexp.Regexp{}, pr.regex...), pr.mRegex...)
+
+	for _, rg := range patterns {
+		matches := rg.FindAllStringSubmatch(pr.TestInput, 1)
+		if len(matches) == 0 {
+			continue
+		}
+		match := matches[0]
+
+		if err := pr.checkArgs(match); err != nil {
+			return err
+		}
+
+		captured := captures(rg, match)
+		args, env := pr.invocation(match, captured, &messageBlock{}, "", nil)
+
+		if pr.Type == "http" {
+			env = append(env, "X-Priscilla-Diagnose: 1")
+		} else {
+			env = append(env, "PRISCILLA_DIAGNOSE=1")
+		}
+		_, err := pr.execute(args, env)
+		return err
+	}
+
+	return errors.New("test-input doesn't match any pattern")
+}
+
+// replyPassive sends the reply to the message m that triggered the
+// responder, in the thread m is in, or in a new thread off m if the responder
+// replies in threads, or privately to the sender if it replies as DMs
+func replyPassive(pr *passiveResponderConfig, msg, source string,
+	m *messageBlock, mentionMode bool, dispatch chan<- *dispatcherRequest) {
+
+	dispatch <- passiveReply(pr, msg, source, m, mentionMode)
+}
+
+// replyAttachment replies with the command's output as a file, unless it's
+// over the size limit
+func replyAttachment(pr *passiveResponderConfig, output []byte, source string,
+	m *messageBlock, mentionMode bool, dispatch chan<- *dispatcherRequest) {
+
+	oa := pr.OutputAttach
+	if len(output) > oa.MaxSize {
+		logger.Warn.Println("Passive responder", pr.Name, "output too large:",
+			len(output))
+		replyPassive(pr, fmt.Sprintf("Output too large to attach (%d bytes)",
+			len(output)), source, m, mentionMode, dispatch)
+		return
+	}
+
+	request := passiveReply(pr, "", source, m, mentionMode)
+	request.Query.Message.Attachments = []*Attachment{{
+		Name: oa.Name,
+		Mime: oa.Mime,
+		Size: int64(len(output)),
+		Data: output,
+	}}
+	dispatch <- request
+}
+
+func passiveReply(pr *passiveResponderConfig, msg, source string,
+	m *messageBlock, mentionMode bool) *dispatcherRequest {
+
+	request := dispatcherRequest{
+		Query: &query{
+			Type:   "message",
+			Source: "Passive Responder: " + pr.Name,
+			To:     source,
+			Message: &messageBlock{
+				Message: strings.Trim(msg, " \n"),
+				Room:    m.Room,
+				Thread:  m.Thread,
+			},
+		},
+	}
+
+	if m.Thread == "" && pr.ReplyInThread {
+		request.Query.Message.Thread = m.Id
+	}
+
+	if pr.ReplyAsDM {
+		request.Query.Message.DMUser = m.From
+	}
+
+	if mentionMode {
+		request.Query.Message.MentionNotify = []string{m.From}
+	}
+
+	return &request
+}
+
+func (pr *passiveResponderConfig) checkArgs(match []string) error {
+	for _, schema := range pr.ArgSchema {
+		value := ""
+		if schema.Group+1 < len(match) {
+			value = match[schema.Group+1]
+		}
+
+		if value == "" {
+			if schema.Optional {
+				continue
+			}
+			return fmt.Errorf("Missing argument %d", schema.Group)
+		}
+
+		if schema.regex != nil {
+			matched, err := matchString(schema.regex, value)
+			if err != nil {
+				return fmt.Errorf("Argument %d: %s", schema.Group, err)
+			}
+			if !matched {
+				return fmt.Errorf("Invalid argument %d: %s", schema.Group,
+					value)
+			}
+		}
+
+		if len(schema.Enum) > 0 {
+			found := false
+			for _, allowed := range schema.Enum {
+				if value == allowed {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return fmt.Errorf("Invalid argument %d: %s (one of: %s)",
+					schema.Group, value, strings.Join(schema.Enum, ", "))
+			}
+		}
+	}
+	return nil
+}
+
+func (pr *passiveResponderConfig) usage(err error) string {
+	usage := err.Error() + "\nUsage:"
+	for _, cmd := range pr.HelpCmds {
+		if pr.NoPrefix {
+			usage += fmt.Sprintf("\n%s - %s", cmd, pr.Help)
+		} else {
+			usage += fmt.Sprintf("\n%s %s - %s", conf.Prefix, cmd, pr.Help)
+		}
+	}
+	return usage
 }
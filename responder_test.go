@@ -0,0 +1,673 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+const mentionResponders = `
+responders:
+  passive:
+  - name: alpha
+    match: ["^alpha$"]
+    mentionmatch: ["deploy"]
+    cmd: /bin/echo
+    args: ["alpha"]
+  - name: bravo
+    match: ["^bravo$"]
+    mentionmatch: ["deploy"]
+    cmd: /bin/echo
+    args: ["bravo"]
+    priority: 5
+  - name: charlie
+    match: ["^charlie$"]
+    mentionmatch: ["deploy"]
+    cmd: /bin/echo
+    args: ["charlie"]
+`
+
+func TestMentionMatchModes(t *testing.T) {
+	for _, test := range []struct {
+		mode  string
+		fired []string
+	}{
+		{"all", []string{"alpha", "bravo", "charlie"}},
+		{"first", []string{"alpha"}},
+		{"priority", []string{"bravo"}},
+	} {
+		setupTest(t, "mention-match: "+test.mode+"\n"+mentionResponders)
+
+		dispatch := make(chan *dispatcherRequest, 10)
+		m := testMessage("deploy now", "room")
+		m.Mentioned = true
+		m.handleMessage("adapter", dispatch)
+
+		// wait long enough for responders that shouldn't fire
+		got := collectReplies(t, dispatch, 3, time.Second)
+		sort.Strings(got)
+		if strings.Join(got, ",") != strings.Join(test.fired, ",") {
+			t.Errorf("mention-match %s fired %v, expected %v", test.mode, got,
+				test.fired)
+		}
+	}
+}
+
+func TestMentionMatchFallThrough(t *testing.T) {
+	setupTest(t, "mention-match: priority\n"+
+		strings.Replace(mentionResponders, "priority: 5",
+			"priority: 5\n    fallthrough: true", 1))
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	m := testMessage("deploy now", "room")
+	m.Mentioned = true
+	m.handleMessage("adapter", dispatch)
+
+	got := collectReplies(t, dispatch, 3, time.Second)
+	sort.Strings(got)
+	if strings.Join(got, ",") != "alpha,bravo" {
+		t.Error("Fall through fired", got)
+	}
+}
+
+func TestRetriesUntilSuccess(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-retry")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// fails the first two runs, counted in a file
+	setupTest(t, `
+responders:
+  passive:
+  - name: flaky
+    match: ["^flaky$"]
+    cmd: /bin/sh
+    args:
+    - -c
+    - n=$(($(cat `+dir+`/runs 2>/dev/null || echo 0) + 1));
+      echo $n > `+dir+`/runs; [ $n -ge 3 ] && echo "ok after $n"
+    retries: 3
+    retry-backoff: 10
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris flaky", "room").handleMessage("adapter", dispatch)
+
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "ok after 3" {
+		t.Fatal("Expected success on the third run, got:", got)
+	}
+}
+
+func TestRetriesStayWithinTimeout(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: broken
+    match: ["^broken$"]
+    cmd: /bin/false
+    retries: 10
+    retry-backoff: 400
+    timeout: 1
+`)
+
+	start := time.Now()
+	if _, err := findPassiveResponder("broken").execute(nil,
+		nil); err == nil {
+
+		t.Fatal("Broken command succeeded")
+	}
+	// 400ms and 800ms of backoff would be 1.2s, past the 1s budget
+	if elapsed := time.Since(start); elapsed > 1100*time.Millisecond {
+		t.Fatal("Retries ran past the timeout:", elapsed)
+	}
+}
+
+func TestLimitInput(t *testing.T) {
+	pr := &passiveResponderConfig{MaxInputBytes: 2}
+	match := []string{"héllo", "héllo", "ok"}
+
+	limited, err := pr.limitInput(match)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// é is two bytes, cutting at 2 would split it
+	if limited[1] != "h" || limited[2] != "ok" {
+		t.Fatal("Unexpected truncation:", limited)
+	}
+	if match[1] != "héllo" {
+		t.Fatal("Match changed in place")
+	}
+
+	pr.MaxInputPolicy = "reject"
+	if _, err := pr.limitInput(match); err == nil {
+		t.Fatal("Oversized input not rejected")
+	}
+}
+
+func TestAttachmentMatch(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: csvscan
+    attachmentmatch:
+      name: ['\.csv$']
+      mime: ['^text/csv$']
+    cmd: /bin/echo
+    args: ["scanned", "__filename__"]
+    help: scan csv uploads
+    help-commands: [csvscan]
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	png := testMessage("", "room")
+	png.Attachments = []*Attachment{
+		{Id: "f1", Name: "chart.png", Mime: "image/png"}}
+	png.handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, time.Second); len(got) != 0 {
+		t.Fatal("Responder fired on a PNG upload:", got)
+	}
+
+	csv := testMessage("", "room")
+	csv.Attachments = []*Attachment{
+		{Id: "f2", Name: "report.csv", Mime: "text/csv"}}
+	csv.handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "scanned report.csv" {
+		t.Fatal("Expected the CSV to be scanned, got:", got)
+	}
+}
+
+func TestArgSchema(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: scale
+    match: ['^scale (\S+) (\S+)$']
+    cmd: /bin/echo
+    args: ["scaled", "__0__", "to", "__1__"]
+    help: scale a service
+    help-commands: ["scale <service> <replicas>"]
+    arg-schema:
+    - group: 0
+      enum: [web, worker]
+    - group: 1
+      pattern: '^[0-9]+$'
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris scale web lots", "room").handleMessage("adapter",
+		dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || !strings.HasPrefix(got[0],
+		"Invalid argument 1: lots\nUsage:") ||
+		!strings.Contains(got[0], "scale <service> <replicas>") {
+
+		t.Fatal("Expected the usage reply, got:", got)
+	}
+
+	testMessage("pris scale web 3", "room").handleMessage("adapter", dispatch)
+	got = collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "scaled web to 3" {
+		t.Fatal("Valid invocation didn't run, got:", got)
+	}
+}
+
+func TestNamedFlagArgs(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ['^deploy (?P<svc>\S+)(?: to (\w+))?$']
+    cmd: /bin/echo
+    args: ["--service=__name:svc__", "--env=__1__", "now"]
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris deploy web to prod", "room").handleMessage("adapter",
+		dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "--service=web --env=prod now" {
+		t.Fatal("Unexpected flags:", got)
+	}
+
+	// nothing captured for the env, the flag is left out
+	testMessage("pris deploy web", "room").handleMessage("adapter", dispatch)
+	got = collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "--service=web now" {
+		t.Fatal("Uncaptured flag not dropped:", got)
+	}
+}
+
+func TestArgsJson(t *testing.T) {
+	for _, test := range []struct {
+		mode string
+		args string
+	}{
+		{"arg", `["-c", "echo \"$1\"", "sh"]`},
+		{"env", `["-c", "echo \"$PRISCILLA_ARGS\""]`},
+	} {
+		setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ['^deploy (?P<svc>\S+) to (\w+)$']
+    cmd: /bin/sh
+    args: `+test.args+`
+    args-json: `+test.mode+`
+`)
+
+		dispatch := make(chan *dispatcherRequest, 10)
+		testMessage("pris deploy web to prod", "room").handleMessage("adapter",
+			dispatch)
+		got := collectReplies(t, dispatch, 1, 5*time.Second)
+		if len(got) != 1 || got[0] != `{"0":"web","1":"prod","svc":"web"}` {
+			t.Errorf("args-json %s passed %v", test.mode, got)
+		}
+	}
+}
+
+func TestIgnoreBots(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+    args: ["hi"]
+  - name: bot-hello
+    match: ["^hello bot$"]
+    cmd: /bin/echo
+    args: ["hi bot"]
+    ignore-bots: false
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	m := testMessage("pris hello", "room")
+	m.IsBot = true
+	m.handleMessage("adapter", dispatch)
+	for _, reply := range collectReplies(t, dispatch, 1, 500*time.Millisecond) {
+		if reply == "hi" {
+			t.Fatal("Responder answered a bot")
+		}
+	}
+
+	testMessage("pris hello", "room").handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 ||
+		got[0] != "hi" {
+
+		t.Fatal("Responder didn't answer a human:", got)
+	}
+
+	m = testMessage("pris hello bot", "room")
+	m.IsBot = true
+	m.handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 ||
+		got[0] != "hi bot" {
+
+		t.Fatal("ignore-bots false didn't answer the bot:", got)
+	}
+}
+
+func TestMaintenanceBlocksStateChanging(t *testing.T) {
+	setupTest(t, `
+maintenance: true
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/echo
+    args: ["deployed"]
+    state-changing: true
+  - name: status
+    match: ["^status$"]
+    cmd: /bin/echo
+    args: ["all good"]
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	for _, test := range []struct {
+		text, reply string
+	}{
+		{"pris deploy", "maintenance"},
+		{"pris status", "all good"},
+	} {
+		testMessage(test.text, "room").handleMessage("adapter", dispatch)
+		got := collectReplies(t, dispatch, 1, 5*time.Second)
+		if len(got) != 1 || got[0] != test.reply {
+			t.Errorf("%q in maintenance replied %v", test.text, got)
+		}
+	}
+
+	if _, err := adminMaintenance(&adminRequest{cmd: &commandBlock{
+		Map: map[string]string{"enabled": "false"}}}); err != nil {
+
+		t.Fatal(err)
+	}
+	testMessage("pris deploy", "room").handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 ||
+		got[0] != "deployed" {
+
+		t.Fatal("Maintenance mode off still blocked:", got)
+	}
+}
+
+func TestExitMessages(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: lookup
+    match: ['^lookup (\d+)$']
+    cmd: /bin/sh
+    args: ["-c", "echo found; exit __0__"]
+    exit-messages:
+      0: "ok: {{.Output}}"
+      1: not found
+      2: "conflict ({{.Code}})"
+    default-exit-message: "failed with {{.Code}}"
+    signal-message: "killed by {{.Signal}}"
+  - name: crash
+    match: ['^crash$']
+    cmd: /bin/sh
+    args: ["-c", "kill -9 $$"]
+    signal-message: "killed by {{.Signal}}"
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	for _, test := range []struct {
+		text, reply string
+	}{
+		{"pris lookup 0", "ok: found"},
+		{"pris lookup 1", "not found"},
+		{"pris lookup 2", "conflict (2)"},
+		{"pris lookup 7", "failed with 7"},
+		{"pris crash", "killed by killed"},
+	} {
+		testMessage(test.text, "room").handleMessage("adapter", dispatch)
+		got := collectReplies(t, dispatch, 1, 5*time.Second)
+		if len(got) != 1 || got[0] != test.reply {
+			t.Errorf("%q replied %v, expected %q", test.text, got, test.reply)
+		}
+	}
+}
+
+func TestOutputTemplateFields(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ['^deploy$']
+    cmd: /bin/echo
+    args: ['{"status": "ok", "build": 42}']
+    output-template: "Deploy {{.Fields.status}}, build {{.Fields.build}}"
+  - name: rollback
+    match: ['^rollback$']
+    cmd: /bin/echo
+    args: ["rolled back"]
+    output-template: "Rollback {{.Fields.status}}"
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	for _, test := range []struct {
+		text, reply string
+	}{
+		{"pris deploy", "Deploy ok, build 42"},
+		// output that isn't JSON is replied as is
+		{"pris rollback", "rolled back"},
+	} {
+		testMessage(test.text, "room").handleMessage("adapter", dispatch)
+		got := collectReplies(t, dispatch, 1, 5*time.Second)
+		if len(got) != 1 || got[0] != test.reply {
+			t.Errorf("%q replied %v, expected %q", test.text, got, test.reply)
+		}
+	}
+}
+
+func TestGroupWeightedChoice(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: heads
+    match: ["^flip$"]
+    cmd: /bin/echo
+    args: ["heads"]
+    group: coin
+    weight: 1
+  - name: tails
+    match: ["^flip$"]
+    cmd: /bin/echo
+    args: ["tails"]
+    group: coin
+    weight: 3
+`)
+
+	m := testMessage("pris flip", "room")
+	counts := make(map[string]int)
+	const rounds = 4000
+	for i := 0; i < rounds; i++ {
+		chosen := chooseAlternatives(prefixPResponders, "flip", m, false)
+		counts[chosen["coin"].Name]++
+	}
+	if share := float64(counts["tails"]) / rounds; share < 0.7 ||
+		share > 0.8 {
+
+		t.Error("Weight 3 of 4 chosen", share, "of the time:", counts)
+	}
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	m.handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 2, time.Second)
+	if len(got) != 1 || (got[0] != "heads" && got[0] != "tails") {
+		t.Fatal("Expected one group member to fire, got:", got)
+	}
+}
+
+func TestReplyInThread(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: threaded
+    match: ["^status$"]
+    cmd: /bin/echo
+    args: ["all good"]
+    reply-in-thread: true
+  - name: inline
+    match: ["^ping$"]
+    cmd: /bin/echo
+    args: ["pong"]
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	for _, test := range []struct {
+		text, thread, replyThread string
+	}{
+		{"pris status", "", "msg-1"},
+		// already in a thread, the reply stays in it
+		{"pris status", "thread-7", "thread-7"},
+		{"pris ping", "", ""},
+	} {
+		m := testMessage(test.text, "room")
+		m.Id, m.Thread = "msg-1", test.thread
+		m.handleMessage("adapter", dispatch)
+
+		select {
+		case req := <-dispatch:
+			if req.Query.Message.Thread != test.replyThread {
+				t.Errorf("%q in thread %q replied in %q", test.text,
+					test.thread, req.Query.Message.Thread)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No reply to", test.text)
+		}
+	}
+}
+
+func TestReplyAsDM(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: mybuilds
+    match: ["^my builds$"]
+    cmd: /bin/echo
+    args: ["2 builds running"]
+    reply-as-dm: true
+  - name: builds
+    match: ["^builds$"]
+    cmd: /bin/echo
+    args: ["5 builds running"]
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	for _, test := range []struct {
+		text, dmUser string
+	}{
+		{"pris my builds", "tester"},
+		{"pris builds", ""},
+	} {
+		testMessage(test.text, "general").handleMessage("chat", dispatch)
+
+		select {
+		case req := <-dispatch:
+			q := req.Query
+			if q.To != "chat" || q.Message.Room != "general" ||
+				q.Message.DMUser != test.dmUser {
+
+				t.Errorf("%q replied to %s in %s, dm_user %q", test.text,
+					q.To, q.Message.Room, q.Message.DMUser)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("No reply to", test.text)
+		}
+	}
+}
+
+func TestOutputCache(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+
+	setupTest(t, `
+responders:
+  passive:
+  - name: lookup
+    match: ['^lookup (\S+)$']
+    cmd: /bin/sh
+    args: ["-c", "echo __0__ >> `+runs+`; echo __0__ $(wc -l < `+runs+`)"]
+    cache:
+      ttl: 1
+      size: 1
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	for _, test := range []struct {
+		wait        time.Duration
+		text, reply string
+	}{
+		{0, "pris lookup web", "web 1"},
+		{0, "pris lookup web", "web 1"},
+		// the only slot goes to the db lookup, web is evicted
+		{0, "pris lookup db", "db 2"},
+		{0, "pris lookup web", "web 3"},
+		{0, "pris lookup web", "web 3"},
+		{1100 * time.Millisecond, "pris lookup web", "web 4"},
+	} {
+		time.Sleep(test.wait)
+
+		testMessage(test.text, "room").handleMessage("adapter", dispatch)
+		got := collectReplies(t, dispatch, 1, 5*time.Second)
+		if len(got) != 1 || got[0] != test.reply {
+			t.Fatalf("%q replied %v, expected %q", test.text, got, test.reply)
+		}
+	}
+}
+
+func TestDurationInReply(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/sh
+    args: ["-c", "sleep 0.3"]
+    exit-messages:
+      0: "deployed in {{.Duration}}"
+`)
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris deploy", "room").handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || !strings.HasPrefix(got[0], "deployed in ") {
+		t.Fatal("Unexpected reply:", got)
+	}
+	took, err := time.ParseDuration(strings.TrimPrefix(got[0], "deployed in "))
+	if err != nil || took < 300*time.Millisecond || took > 3*time.Second {
+		t.Fatal("Implausible duration:", got[0])
+	}
+
+	for d, formatted := range map[time.Duration]string{
+		42 * time.Millisecond:                 "42ms",
+		1400 * time.Millisecond:               "1s",
+		42*time.Second + 600*time.Millisecond: "43s",
+		65 * time.Second:                      "1m5s",
+	} {
+		if formatDuration(d) != formatted {
+			t.Errorf("%v formatted as %s, expected %s", d, formatDuration(d),
+				formatted)
+		}
+	}
+}
+
+func TestOutputAttachment(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: chart
+    match: ["^chart$"]
+    cmd: /bin/sh
+    args: ["-c", "printf '\\211PNG\\r\\n\\032\\n\\000\\377 '"]
+    output-attachment:
+      name: chart.png
+      mime: image/png
+  - name: big-chart
+    match: ["^big chart$"]
+    cmd: /bin/sh
+    args: ["-c", "printf '\\211PNG\\r\\n\\032\\n\\000\\377 '"]
+    output-attachment:
+      name: chart.png
+      max-size: 4
+`)
+	png := "\x89PNG\r\n\x1a\n\x00\xff "
+	dispatch := make(chan *dispatcherRequest, 10)
+
+	testMessage("pris chart", "room").handleMessage("adapter", dispatch)
+	select {
+	case req := <-dispatch:
+		m := req.Query.Message
+		if len(m.Attachments) != 1 || m.Message != "" {
+			t.Fatal("Expected only an attachment, got:", *m)
+		}
+		a := m.Attachments[0]
+		if a.Name != "chart.png" || a.Mime != "image/png" ||
+			string(a.Data) != png || a.Size != int64(len(png)) {
+
+			t.Fatalf("Unexpected attachment: %+v", *a)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("No reply")
+	}
+
+	testMessage("pris big chart", "room").handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "Output too large to attach (11 bytes)" {
+		t.Fatal("Expected the size limit reply, got:", got)
+	}
+}
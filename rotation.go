@@ -0,0 +1,90 @@
+package main
+
+import (
+	"container/list"
+	"strconv"
+	"time"
+)
+
+type rotateIdsConfig struct {
+	Interval int `yaml:"interval"`
+	Grace    int `yaml:"grace"`
+}
+
+// rotateIds asks the dispatcher to rotate the ids of every connection once
+// per interval
+func rotateIds(rc *rotateIdsConfig, dispatch chan<- *dispatcherRequest) {
+	for range time.Tick(time.Duration(rc.Interval) * time.Second) {
+		dispatch <- &dispatcherRequest{
+			Query: &query{
+				Type:    "command",
+				Source:  "server",
+				Command: &commandBlock{Action: "rotate"},
+			},
+		}
+	}
+}
+
+// renameSource repoints the active responders registered by a connection to
+// its new id
+func renameSource(old, id string) {
+	routeLock.Lock()
+	defer routeLock.Unlock()
+
+	for _, arl := range []*list.List{prefixAResponders,
+		noPrefixAResponders, mentionAResponders, unhandledAResponders} {
+
+		for eAr := arl.Front(); eAr != nil; eAr = eAr.Next() {
+			ar := eAr.Value.(*activeResponderConfig)
+			if ar.source == old {
+				ar.source = id
+			}
+			if ar.scope != nil && ar.scope.adapter == old {
+				ar.scope.adapter = id
+			}
+		}
+	}
+}
+
+// rotateConnections gives every connection a new id and moves its state over,
+// the connection is told its new id with a rotate command
+func rotateConnections(connMap *connRegistry, labels map[string][]string,
+	trackers ...*routeTracker) {
+
+	grace := time.Duration(conf.RotateIds.Grace) * time.Second
+
+	for _, old := range connMap.ids() {
+		id, ok := connMap.rotate(old, grace)
+		if !ok {
+			continue
+		}
+
+		renameSource(old, id)
+		for _, t := range trackers {
+			t.rename(old, id)
+		}
+		infoAccess.rename(old, id)
+		if l, ok := labels[old]; ok {
+			labels[id] = l
+			delete(labels, old)
+		}
+
+		logger.Info.Println("Connection", old, "rotated to", id)
+
+		if encoder, ok := connMap.get(id); ok {
+			encoder.Encode(&query{
+				Type:   "command",
+				Source: "server",
+				To:     id,
+				Command: &commandBlock{
+					Action: "rotate",
+					Data:   id,
+					Map: map[string]string{
+						"previous": old,
+						"grace":    strconv.Itoa(conf.RotateIds.Grace),
+					},
+				},
+			})
+		}
+	}
+}
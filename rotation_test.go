@@ -0,0 +1,57 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRotatedIdRoutesAndOldIdExpires(t *testing.T) {
+	setupTest(t, "")
+	conf.RotateIds = &rotateIdsConfig{Interval: 3600, Grace: 1}
+	dispatch := startDispatcher(t)
+
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+	engageAs(t, dispatch, "deployer", "responder")
+
+	dispatch <- &dispatcherRequest{Query: &query{
+		Type:    "command",
+		Source:  "server",
+		Command: &commandBlock{Action: "rotate"},
+	}}
+	q := adapter.next(t, "rotate")
+	id := q.Command.Data
+	if id == "" || id == "chat" || q.Command.Map["previous"] != "chat" ||
+		q.Command.Map["grace"] != "1" {
+
+		t.Fatal("Unexpected rotation:", *q.Command)
+	}
+	rotated := time.Now()
+
+	send := func(to, text string) {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:    "message",
+			Source:  "deployer",
+			To:      to,
+			Message: &messageBlock{Message: text, Room: "general"},
+		}}
+	}
+
+	send(id, "to the new id")
+	if q := adapter.next(t, "message"); q.Message.Message != "to the new id" {
+		t.Fatal("Unexpected message:", q.Message.Message)
+	}
+	send("chat", "to the old id")
+	if q := adapter.next(t, "message"); q.Message.Message != "to the old id" {
+		t.Fatal("Old id not routed during the grace period:",
+			q.Message.Message)
+	}
+
+	time.Sleep(time.Until(rotated.Add(1200 * time.Millisecond)))
+
+	// the old id is gone, the next message through is the one to the new id
+	send("chat", "too late")
+	send(id, "still here")
+	if q := adapter.next(t, "message"); q.Message.Message != "still here" {
+		t.Fatal("Old id routed after the grace period:", q.Message.Message)
+	}
+}
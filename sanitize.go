@@ -0,0 +1,74 @@
+package main
+
+import (
+	"regexp"
+	"unicode/utf8"
+)
+
+// sanitizeConfig fields left out fall back to the top level "sanitize"
+// config, and to the defaults after that: everything on and a 4000 character
+// limit
+type sanitizeConfig struct {
+	Mentions  *bool `yaml:"mentions"`
+	Links     *bool `yaml:"links"`
+	MaxLength *int  `yaml:"max-length"`
+}
+
+// sanitizer is a responder's resolved sanitize config
+type sanitizer struct {
+	mentions  bool
+	links     bool
+	maxLength int
+}
+
+var (
+	// "@channel" and "@user", but not email addresses
+	mentionRegex = regexp.MustCompile(`(^|\W)@(\w)`)
+	// "<!here>" and "<@U1234>" style mentions
+	markupMentionRegex = regexp.MustCompile(`<([!@#])(\w)`)
+	// links not already in angle brackets, which suppresses previews
+	linkRegex = regexp.MustCompile(`(^|[^<])(https?://[^\s<>]+)`)
+)
+
+func (sc *sanitizeConfig) resolve(global *sanitizeConfig) *sanitizer {
+	s := &sanitizer{mentions: true, links: true, maxLength: 4000}
+
+	for _, c := range []*sanitizeConfig{global, sc} {
+		if c == nil {
+			continue
+		}
+		if c.Mentions != nil {
+			s.mentions = *c.Mentions
+		}
+		if c.Links != nil {
+			s.links = *c.Links
+		}
+		if c.MaxLength != nil {
+			s.maxLength = *c.MaxLength
+		}
+	}
+
+	return s
+}
+
+// sanitize neutralizes command output before it's sent to chat, so it can't
+// notify a whole room or spoof a mention, links are sent without preview and
+// output over the limit is cut, a limit of 0 or less disables it
+func (s *sanitizer) sanitize(text string) string {
+	if s.mentions {
+		// a zero width space keeps the mention readable but inert
+		text = mentionRegex.ReplaceAllString(text, "$1@\u200b$2")
+		text = markupMentionRegex.ReplaceAllString(text, "<\u200b$1$2")
+	}
+
+	if s.links {
+		text = linkRegex.ReplaceAllString(text, "$1<$2>")
+	}
+
+	if s.maxLength > 0 && utf8.RuneCountInString(text) > s.maxLength {
+		runes := []rune(text)
+		text = string(runes[:s.maxLength]) + "…"
+	}
+
+	return text
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSanitize(t *testing.T) {
+	off, limit := false, 5
+
+	for _, test := range []struct {
+		sc       *sanitizeConfig
+		in, want string
+	}{
+		{nil, "@channel done", "@\u200bchannel done"},
+		{nil, "ping <!here> and <@U123>",
+			"ping <\u200b!here> and <@\u200bU123>"},
+		{nil, "mail ops@example.com", "mail ops@example.com"},
+		{nil, "see https://ci/1", "see <https://ci/1>"},
+		{nil, "see <https://ci/1>", "see <https://ci/1>"},
+		{&sanitizeConfig{Mentions: &off}, "@channel done", "@channel done"},
+		{&sanitizeConfig{Links: &off}, "see https://ci/1", "see https://ci/1"},
+		{&sanitizeConfig{MaxLength: &limit}, "déploiement", "déplo…"},
+	} {
+		if got := test.sc.resolve(nil).sanitize(test.in); got != test.want {
+			t.Errorf("sanitize(%q) = %q, expected %q", test.in, got, test.want)
+		}
+	}
+
+	// the responder's setting wins over the global one
+	on := true
+	s := (&sanitizeConfig{Mentions: &on}).resolve(
+		&sanitizeConfig{Mentions: &off})
+	if got := s.sanitize("@here"); got != "@\u200bhere" {
+		t.Error("Global setting overrode the responder's:", got)
+	}
+}
+
+func TestCommandOutputSanitizedBeforeAdapter(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: announce
+    match: ["^announce$"]
+    cmd: /bin/echo
+    args: ["@channel deploy done"]
+  - name: trusted
+    match: ["^page$"]
+    cmd: /bin/echo
+    args: ["@channel paging on-call"]
+    sanitize:
+      mentions: false
+`)
+	dispatch := startDispatcher(t)
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+
+	for _, test := range []struct {
+		text, reply string
+	}{
+		{"pris announce", "@\u200bchannel deploy done"},
+		{"pris page", "@channel paging on-call"},
+	} {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:    "message",
+			Source:  "chat",
+			Message: testMessage(test.text, "general"),
+		}}
+		q := adapter.next(t, "message")
+		if q.Message.Message != test.reply {
+			t.Errorf("%s reached the adapter as %q", test.text,
+				q.Message.Message)
+		}
+	}
+
+	done := make(chan struct{})
+	workers.submit("chat", func() { close(done) })
+	<-done
+}
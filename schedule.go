@@ -0,0 +1,91 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+type scheduleConfig struct {
+	Days     []string `yaml:"days"`
+	Hours    []string `yaml:"hours"`
+	Timezone string   `yaml:"timezone"`
+	Message  string   `yaml:"message"`
+	days     map[time.Weekday]bool
+	hours    []minuteRange
+	location *time.Location
+}
+
+// minuteRange is a range of minutes since midnight, end excluded, a range
+// with its end before its start goes across midnight
+type minuteRange struct {
+	start, end int
+}
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+func (s *scheduleConfig) parse() error {
+	s.days = make(map[time.Weekday]bool)
+	for _, day := range s.Days {
+		weekday, ok := weekdays[strings.ToLower(day)]
+		if !ok {
+			return errors.New("Invalid day: " + day)
+		}
+		s.days[weekday] = true
+	}
+
+	for _, hours := range s.Hours {
+		var sh, sm, eh, em int
+		_, err := fmt.Sscanf(hours, "%d:%d-%d:%d", &sh, &sm, &eh, &em)
+		r := minuteRange{start: sh*60 + sm, end: eh*60 + em}
+		if err != nil || sh < 0 || sm < 0 || sm > 59 || eh < 0 || em < 0 ||
+			em > 59 || r.start >= 24*60 || r.end > 24*60 {
+
+			return errors.New("Invalid hours: " + hours)
+		}
+		s.hours = append(s.hours, r)
+	}
+
+	s.location = conf.location
+	if s.Timezone != "" {
+		var err error
+		if s.location, err = time.LoadLocation(s.Timezone); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// open tells whether t falls within the schedule, no days means every day
+// and no hours means all day
+func (s *scheduleConfig) open(t time.Time) bool {
+	t = t.In(s.location)
+	if len(s.days) > 0 && !s.days[t.Weekday()] {
+		return false
+	}
+
+	if len(s.hours) == 0 {
+		return true
+	}
+
+	minute := t.Hour()*60 + t.Minute()
+	for _, r := range s.hours {
+		if r.start <= r.end && minute >= r.start && minute < r.end {
+			return true
+		}
+		if r.start > r.end && (minute >= r.start || minute < r.end) {
+			return true
+		}
+	}
+	return false
+}
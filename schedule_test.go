@@ -0,0 +1,118 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestScheduleOpen(t *testing.T) {
+	conf.location = time.UTC
+	s := &scheduleConfig{
+		Days:     []string{"Mon", "tue", "wed", "thu", "fri"},
+		Hours:    []string{"09:00-17:00", "22:30-01:00"},
+		Timezone: "America/New_York",
+	}
+	if err := s.parse(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		at   string
+		open bool
+	}{
+		{"2026-10-14T09:00:00-04:00", true},
+		{"2026-10-14T16:59:00-04:00", true},
+		{"2026-10-14T17:00:00-04:00", false},
+		{"2026-10-14T08:59:00-04:00", false},
+		// across midnight
+		{"2026-10-14T23:15:00-04:00", true},
+		{"2026-10-15T00:30:00-04:00", true},
+		{"2026-10-15T01:00:00-04:00", false},
+		// the responder's timezone, not the one given
+		{"2026-10-14T13:30:00Z", true},
+		{"2026-10-14T12:30:00Z", false},
+		// saturday
+		{"2026-10-17T10:00:00-04:00", false},
+	} {
+		at, err := time.Parse(time.RFC3339, test.at)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := s.open(at); got != test.open {
+			t.Errorf("open(%s) = %v, expected %v", test.at, got, test.open)
+		}
+	}
+
+	for _, hours := range []string{"9-17", "09:00-25:00", "09:60-10:00"} {
+		bad := &scheduleConfig{Hours: []string{hours}}
+		if err := bad.parse(); err == nil {
+			t.Error("Invalid hours accepted:", hours)
+		}
+	}
+}
+
+func TestResponderOutsideWindow(t *testing.T) {
+	// open every day but today
+	today := time.Now().UTC().Weekday()
+	days := make([]string, 0, 6)
+	for name, day := range weekdays {
+		if day != today {
+			days = append(days, name)
+		}
+	}
+
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy$"]
+    cmd: /bin/echo
+    args: ["deploying"]
+    schedule:
+      timezone: UTC
+      days: [`+strings.Join(days, ", ")+`]
+      message: Deploys are closed today
+  - name: status
+    match: ["^status$"]
+    cmd: /bin/echo
+    args: ["all good"]
+    schedule:
+      timezone: UTC
+      hours: ["00:00-24:00"]
+  - name: csvscan
+    attachmentmatch:
+      name: ['\.csv$']
+    cmd: /bin/echo
+    args: ["scanned"]
+    help: scan csv uploads
+    help-commands: [csvscan]
+    schedule:
+      timezone: UTC
+      days: [`+strings.Join(days, ", ")+`]
+      message: Scans are closed today
+`)
+	dispatch := make(chan *dispatcherRequest, 10)
+
+	for _, test := range []struct {
+		text, reply string
+	}{
+		{"pris deploy", "Deploys are closed today"},
+		{"pris status", "all good"},
+	} {
+		testMessage(test.text, "room").handleMessage("adapter", dispatch)
+		got := collectReplies(t, dispatch, 1, 5*time.Second)
+		if len(got) != 1 || got[0] != test.reply {
+			t.Errorf("%s got %v, expected %q", test.text, got, test.reply)
+		}
+	}
+
+	// attachments are matched apart from the text, the schedule still holds
+	upload := testMessage("", "room")
+	upload.Attachments = []*Attachment{{Id: "f1", Name: "report.csv"}}
+	upload.handleMessage("adapter", dispatch)
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "Scans are closed today" {
+		t.Error("Upload got", got)
+	}
+}
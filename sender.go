@@ -0,0 +1,139 @@
+package main
+
+import (
+	"container/list"
+	"errors"
+	"io"
+	"sync"
+)
+
+var (
+	errNotQuery      = errors.New("Only queries can be sent")
+	errSenderStopped = errors.New("Connection is closing")
+	errQueueFull     = errors.New("Send queue is full")
+)
+
+// connSender is the only thing that writes to a connection once it's
+// engaged, Encode queues the query and a single goroutine drains the queue
+// into the connection's encoder, json.Encoder isn't safe for concurrent use.
+// The queue is ordered by message priority, a query only overtakes the ones
+// queued with a lower priority, so queries of the same priority, commands
+// included, are written in the order they were queued
+type connSender struct {
+	lock     sync.Mutex
+	ready    *sync.Cond
+	encoder  queryEncoder
+	queue    *list.List
+	size     int
+	identity *connIdentity
+	closer   io.Closer
+	stopped  bool
+}
+
+func newConnSender(encoder queryEncoder, identity *connIdentity,
+	size int) *connSender {
+
+	s := &connSender{
+		encoder:  encoder,
+		queue:    list.New(),
+		size:     size,
+		identity: identity,
+	}
+	s.ready = sync.NewCond(&s.lock)
+	return s
+}
+
+// start begins draining the queue, anything queued before it is held back
+// so the engagement reply can be written first
+func (s *connSender) start() {
+	go s.drain()
+}
+
+// Encode queues the query without blocking, it's dropped if the queue is
+// full or the connection is going away
+func (s *connSender) Encode(v interface{}) error {
+	q, ok := v.(*query)
+	if !ok {
+		return errNotQuery
+	}
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return errSenderStopped
+	}
+
+	if s.queue.Len() >= s.size {
+		logger.Error.Println("Send queue full for", s.name()+",",
+			"query dropped")
+		return errQueueFull
+	}
+
+	// behind everything of the same priority or higher
+	priority := q.priority()
+	e := s.queue.Back()
+	for e != nil && e.Value.(*query).priority() < priority {
+		e = e.Prev()
+	}
+	if e == nil {
+		s.queue.PushFront(q)
+	} else {
+		s.queue.InsertAfter(q, e)
+	}
+	s.ready.Signal()
+
+	return nil
+}
+
+// close closes the connection once everything queued before it is written
+func (s *connSender) close(closer io.Closer) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	if s.stopped {
+		return
+	}
+	s.closer = closer
+	s.stopped = true
+	s.ready.Signal()
+}
+
+// stop discards the sender of a disengaged connection, what's still queued
+// is written if the connection is still there to take it
+func (s *connSender) stop() {
+	s.close(nil)
+}
+
+func (s *connSender) drain() {
+	for {
+		s.lock.Lock()
+		for s.queue.Len() == 0 && !s.stopped {
+			s.ready.Wait()
+		}
+		if s.queue.Len() == 0 {
+			s.lock.Unlock()
+			break
+		}
+		q := s.queue.Remove(s.queue.Front()).(*query)
+		s.lock.Unlock()
+
+		if err := s.encoder.Encode(q); err != nil {
+			logger.Debug.Println("Failed to send to", s.name()+":", err)
+		}
+	}
+
+	// stopped is set by now and closer doesn't change after that
+	if s.closer != nil {
+		if err := s.closer.Close(); err != nil {
+			logger.Warn.Println("Error closing connection", s.name()+":", err)
+		}
+	}
+}
+
+func (s *connSender) name() string {
+	if s.identity == nil {
+		return "unknown"
+	}
+	return s.identity.get()
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// blockingEncoder holds every write until release is closed
+type blockingEncoder struct {
+	release chan struct{}
+	written chan *query
+}
+
+func (e *blockingEncoder) Encode(v interface{}) error {
+	<-e.release
+	e.written <- v.(*query)
+	return nil
+}
+
+func priorityMessage(text string, priority int) *query {
+	return &query{
+		Type:    "message",
+		Source:  "server",
+		To:      "adapter",
+		Message: &messageBlock{Message: text, Priority: priority},
+	}
+}
+
+func TestSenderHighPriorityJumpsAhead(t *testing.T) {
+	encoder := &blockingEncoder{
+		release: make(chan struct{}),
+		written: make(chan *query, 10),
+	}
+	sender := newConnSender(encoder, nil, 10)
+
+	// queued before start, so nothing is written yet
+	for _, q := range []*query{
+		priorityMessage("chatter 1", 0),
+		priorityMessage("chatter 2", 0),
+		priorityMessage("warning", 5),
+		priorityMessage("chatter 3", 0),
+		priorityMessage("incident", 10),
+		priorityMessage("warning 2", 5),
+	} {
+		if err := sender.Encode(q); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sender.start()
+	close(encoder.release)
+	sender.stop()
+
+	expected := []string{"incident", "warning", "warning 2", "chatter 1",
+		"chatter 2", "chatter 3"}
+	for _, text := range expected {
+		if q := <-encoder.written; q.Message.Message != text {
+			t.Fatalf("Expected %q, got %q", text, q.Message.Message)
+		}
+	}
+}
+
+func TestSenderDropsPastQueueSize(t *testing.T) {
+	sender := newConnSender(&recordEncoder{}, nil, 2)
+
+	for i := 0; i < 2; i++ {
+		if err := sender.Encode(priorityMessage("queued", 0)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	err := sender.Encode(priorityMessage("urgent", 10))
+	if err != errQueueFull {
+		t.Fatal("Query past the queue size not dropped:", err)
+	}
+
+	sender.stop()
+	err = sender.Encode(priorityMessage("late", 0))
+	if err != errSenderStopped {
+		t.Fatal("Query accepted after stop:", err)
+	}
+}
+
+func TestConcurrentSendsDecodeCleanly(t *testing.T) {
+	server, client := net.Pipe()
+	defer client.Close()
+
+	sender := newConnSender(json.NewEncoder(server), &connIdentity{}, 1000)
+	sender.start()
+	defer sender.close(server)
+
+	// messages of all sizes, so writes of different lengths interleave
+	expected := make(map[string]bool)
+	for i := 0; i < 500; i++ {
+		expected[fmt.Sprintf("message %d %s", i, strings.Repeat("x", i))] =
+			false
+	}
+
+	var wg sync.WaitGroup
+	for text := range expected {
+		wg.Add(1)
+		go func(text string) {
+			defer wg.Done()
+			if err := sender.Encode(priorityMessage(text, 0)); err != nil {
+				t.Error("Send failed:", err)
+			}
+		}(text)
+	}
+
+	decoder := json.NewDecoder(client)
+	client.SetReadDeadline(time.Now().Add(10 * time.Second))
+	for i := 0; i < len(expected); i++ {
+		q := &query{}
+		if err := decoder.Decode(q); err != nil {
+			t.Fatal("Stream corrupted after", i, "queries:", err)
+		}
+		seen, ok := expected[q.Message.Message]
+		if !ok || seen {
+			t.Fatal("Unexpected query:", q.Message.Message)
+		}
+		expected[q.Message.Message] = true
+	}
+	wg.Wait()
+}
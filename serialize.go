@@ -0,0 +1,73 @@
+package main
+
+import (
+	"sync"
+)
+
+type serializeConfig struct {
+	Group   string `yaml:"group"`
+	MaxKeys int    `yaml:"max-keys"`
+}
+
+// serialLocks lets one run per key go at a time, runs with the same key
+// queue up and runs with different keys go in parallel. Keys are forgotten
+// once nothing holds or waits on them, past max keys in use the runs with
+// new keys share a single overflow key.
+type serialLocks struct {
+	lock sync.Mutex
+	max  int
+	keys map[string]*serialKey
+}
+
+type serialKey struct {
+	held chan struct{}
+	refs int
+}
+
+// overflowKey can't be a capture, captures never hold a NUL
+const overflowKey = "\x00overflow"
+
+func newSerialLocks(max int) *serialLocks {
+	return &serialLocks{max: max, keys: make(map[string]*serialKey)}
+}
+
+// acquire blocks until the key is free, the returned func releases it
+func (s *serialLocks) acquire(key string) func() {
+	s.lock.Lock()
+	if _, ok := s.keys[key]; !ok && len(s.keys) >= s.max {
+		logger.Warn.Println("Too many serialization keys in use, queueing",
+			"run with overflow")
+		key = overflowKey
+	}
+
+	k, ok := s.keys[key]
+	if !ok {
+		k = &serialKey{held: make(chan struct{}, 1)}
+		s.keys[key] = k
+	}
+	k.refs++
+	s.lock.Unlock()
+
+	k.held <- struct{}{}
+
+	return func() {
+		<-k.held
+
+		s.lock.Lock()
+		k.refs--
+		if k.refs == 0 {
+			delete(s.keys, key)
+		}
+		s.lock.Unlock()
+	}
+}
+
+// serialRun runs the responder in the background once its key is free, it's
+// the only place runs of a responder wait on each other
+func (pr *passiveResponderConfig) serialRun(key string, run func()) {
+	go func() {
+		release := pr.serial.acquire(key)
+		defer release()
+		run()
+	}()
+}
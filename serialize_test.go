@@ -0,0 +1,91 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestSerializePerCapturedKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "priscilla-serialize")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// a run finding the lock taken overlapped another run of its key
+	setupTest(t, `
+responders:
+  passive:
+  - name: deploy
+    match: ["^deploy (?P<svc>\\w+)$"]
+    cmd: /bin/sh
+    args:
+    - -c
+    - |
+      mkdir `+dir+`/__name:svc__ 2>/dev/null || { echo overlap; exit 0; }
+      sleep 0.4
+      rmdir `+dir+`/__name:svc__
+      echo deployed __name:svc__
+    serialize:
+      group: svc
+`)
+	dispatch := make(chan *dispatcherRequest, 10)
+
+	start := time.Now()
+	for _, text := range []string{"pris deploy web", "pris deploy web",
+		"pris deploy api"} {
+
+		testMessage(text, "room").handleMessage("adapter", dispatch)
+	}
+
+	got := collectReplies(t, dispatch, 3, 5*time.Second)
+	elapsed := time.Since(start)
+	if len(got) != 3 {
+		t.Fatal("Expected 3 replies, got:", got)
+	}
+	for _, reply := range got {
+		if reply == "overlap" {
+			t.Fatal("Runs with the same key overlapped:", got)
+		}
+	}
+	// api doesn't wait on the web deploys
+	if got[2] != "deployed web" {
+		t.Fatal("Unexpected reply order:", got)
+	}
+	if elapsed < 800*time.Millisecond || elapsed > 1200*time.Millisecond {
+		t.Fatal("Expected the web runs, and only them, to queue:", elapsed)
+	}
+}
+
+func TestSerialLocksOverflowKey(t *testing.T) {
+	locks := newSerialLocks(1)
+
+	releaseWeb := locks.acquire("web")
+	// past max keys, new keys share the overflow key
+	releaseApi := locks.acquire("api")
+	acquired := make(chan func())
+	go func() {
+		acquired <- locks.acquire("db")
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("Key beyond max-keys tracked on its own")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	releaseApi()
+	select {
+	case release := <-acquired:
+		release()
+	case <-time.After(time.Second):
+		t.Fatal("Overflow key never released")
+	}
+
+	releaseWeb()
+	if len(locks.keys) != 0 {
+		t.Fatal("Keys not forgotten:", locks.keys)
+	}
+}
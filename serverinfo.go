@@ -0,0 +1,58 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+var startTime = time.Now()
+
+// versionInfo is the version and build the binary was stamped with,
+// "development" for a binary built without them
+func versionInfo() (string, string) {
+	v, b := version, build
+	if v == "" {
+		v = "development"
+	}
+	if b == "" {
+		b = "development"
+	}
+	return v, b
+}
+
+// adapters counts the engaged adapters, aliases left out
+func (r *connRegistry) adapters() int {
+	r.lock.RLock()
+	defer r.lock.RUnlock()
+
+	count := 0
+	for id, entry := range r.conns {
+		if entry.adapter && !r.aliases[id] {
+			count++
+		}
+	}
+	return count
+}
+
+// serverInfoReply is the reply to server-info, uptime is in seconds
+func serverInfoReply(to, id string, connMap *connRegistry) *query {
+	v, b := versionInfo()
+
+	return &query{
+		Type:   "command",
+		Source: "server",
+		To:     to,
+		Command: &commandBlock{
+			Id:     id,
+			Action: "server-info",
+			Time:   startTime.Unix(),
+			Map: map[string]string{
+				"version": v,
+				"build":   b,
+				"uptime": fmt.Sprintf("%d",
+					int64(time.Since(startTime).Seconds())),
+				"adapters": fmt.Sprintf("%d", connMap.adapters()),
+			},
+		},
+	}
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// handleSignals shuts the server down on SIGINT or SIGTERM: no new
+// connections are accepted, and the dispatcher asks every connection to
+// disengage, it returns once they're all gone or the shutdown timeout runs
+// out
+func handleSignals(server io.Closer, dispatch chan<- *dispatcherRequest) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	sig := <-signals
+	logger.Warn.Println("Received", sig, "shutting down")
+
+	server.Close()
+	dispatch <- &dispatcherRequest{Query: shutdownQuery("")}
+}
+
+func shutdownQuery(kind string) *query {
+	return &query{
+		Type:    "command",
+		Source:  "server",
+		Command: &commandBlock{Action: "shutdown", Type: kind},
+	}
+}
+
+// shutdown sends every connection a terminate and closes it, their serve()
+// disengages them like for any other disconnection, it returns how many
+// connections there were
+func shutdown(connMap *connRegistry) int {
+	ids := connMap.ids()
+
+	for _, id := range ids {
+		if encoder, ok := connMap.get(id); ok {
+			encoder.Encode(&query{
+				Type:   "command",
+				Source: "server",
+				To:     id,
+				Command: &commandBlock{
+					Action: "terminate",
+					Data:   "Server shutting down",
+				},
+			})
+		}
+		connMap.close(id)
+	}
+
+	logger.Warn.Println("Terminated", len(ids), "connections")
+	return len(ids)
+}
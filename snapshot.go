@@ -0,0 +1,236 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"time"
+)
+
+// stateSnapshot is the runtime state an admin can snapshot and restore.
+// Connections can't be restored, they're only recorded for reference, but the
+// active responders they registered are, for the connections engaged with
+// the same id at the time of the restore.
+type stateSnapshot struct {
+	Time        int64                `json:"time"`
+	Maintenance bool                 `json:"maintenance"`
+	LogLevel    string               `json:"loglevel"`
+	Disabled    map[string][]string  `json:"disabled"`
+	Connections []*snapshotConn      `json:"connections"`
+	Active      []*snapshotResponder `json:"active"`
+}
+
+type snapshotConn struct {
+	Id      string `json:"id"`
+	Adapter bool   `json:"adapter"`
+}
+
+type snapshotResponder struct {
+	Source    string `json:"source"`
+	Type      string `json:"type"`
+	Id        string `json:"id,omitempty"`
+	Pattern   string `json:"pattern"`
+	HelpCmd   string `json:"help_cmd,omitempty"`
+	Help      string `json:"help,omitempty"`
+	MatchNext bool   `json:"fallthrough,omitempty"`
+	Priority  int    `json:"priority,omitempty"`
+}
+
+var activeLists = []struct {
+	kind string
+	arl  **list.List
+}{
+	{"prefix", &prefixAResponders},
+	{"noprefix", &noPrefixAResponders},
+	{"mention", &mentionAResponders},
+	{"unhandled", &unhandledAResponders},
+}
+
+func snapshotName(c *commandBlock) string {
+	if c.Map["name"] == "" {
+		return "snapshot"
+	}
+	return c.Map["name"]
+}
+
+// snapshotKey keeps snapshots apart from the other state in the store, so a
+// snapshot name can't overwrite what the server persists, i.e. disabled rooms
+func snapshotKey(name string) string {
+	return "snapshot-" + name
+}
+
+func adminSnapshot(r *adminRequest) (string, error) {
+	if stateStore == nil {
+		return "", errors.New("No state-dir configured")
+	}
+
+	s := &stateSnapshot{
+		Time:     time.Now().Unix(),
+		LogLevel: logLevel(),
+		Disabled: make(map[string][]string),
+	}
+
+	for _, id := range r.connMap.ids() {
+		s.Connections = append(s.Connections,
+			&snapshotConn{Id: id, Adapter: r.connMap.isAdapter(id)})
+	}
+	sort.Sort(connsById(s.Connections))
+
+	routeLock.RLock()
+	s.Maintenance = maintenance
+	for name, rooms := range disabledRooms {
+		for room := range rooms {
+			s.Disabled[name] = append(s.Disabled[name], room)
+		}
+		sort.Strings(s.Disabled[name])
+	}
+
+	// temporary responders are left out, they'd be gone by the restore
+	for _, group := range activeLists {
+		for eAr := (*group.arl).Front(); eAr != nil; eAr = eAr.Next() {
+			ar := eAr.Value.(*activeResponderConfig)
+			if ar.oneShot || !ar.expires.IsZero() {
+				continue
+			}
+			s.Active = append(s.Active, &snapshotResponder{
+				Source:    ar.source,
+				Type:      group.kind,
+				Id:        ar.id,
+				Pattern:   ar.regex.String(),
+				HelpCmd:   ar.helpCmd,
+				Help:      ar.help,
+				MatchNext: ar.matchNext,
+				Priority:  ar.priority,
+			})
+		}
+	}
+	routeLock.RUnlock()
+
+	data, err := json.MarshalIndent(s, "", "\t")
+	if err != nil {
+		return "", err
+	}
+
+	name := snapshotName(r.cmd)
+	if err := stateStore.put(snapshotKey(name), data); err != nil {
+		return "", err
+	}
+
+	return fmt.Sprintf("Snapshot %s saved: %d connections, %d active "+
+		"responders", name, len(s.Connections), len(s.Active)), nil
+}
+
+// adminRestore replaces maintenance, log level and disabled rooms with the
+// snapshot's, and registers the snapshot's active responders again for the
+// connections that are engaged and don't have them registered already
+func adminRestore(r *adminRequest) (string, error) {
+	if stateStore == nil {
+		return "", errors.New("No state-dir configured")
+	}
+
+	data, err := stateStore.get(snapshotKey(snapshotName(r.cmd)))
+	if err != nil {
+		return "", err
+	}
+
+	s := &stateSnapshot{}
+	if err := json.Unmarshal(data, s); err != nil {
+		return "", err
+	}
+
+	if s.LogLevel != "" {
+		if err := setLogLevel(s.LogLevel); err != nil {
+			return "", err
+		}
+	}
+
+	routeLock.Lock()
+	maintenance = s.Maintenance
+	disabledRooms = make(map[string]map[string]bool)
+	for name, rooms := range s.Disabled {
+		disabledRooms[name] = make(map[string]bool)
+		for _, room := range rooms {
+			disabledRooms[name][room] = true
+		}
+	}
+	if err := saveDisabledRooms(); err != nil {
+		logger.Error.Println(err)
+	}
+	routeLock.Unlock()
+
+	restored, skipped := 0, 0
+	for _, sr := range s.Active {
+		if _, ok := r.connMap.get(sr.Source); !ok || sr.registered() {
+			skipped++
+			continue
+		}
+
+		ar, err := sr.responder()
+		if err != nil {
+			logger.Warn.Println("Unable to restore active responder:", err)
+			skipped++
+			continue
+		}
+
+		addActiveResponder(sr.Type, ar, true)
+		restored++
+	}
+
+	return fmt.Sprintf("Snapshot from %s restored: %d active responders "+
+		"registered, %d skipped (not engaged or already registered)",
+		time.Unix(s.Time, 0).Format(time.RFC3339), restored, skipped), nil
+}
+
+func (sr *snapshotResponder) responder() (*activeResponderConfig, error) {
+	known := false
+	for _, group := range activeLists {
+		known = known || group.kind == sr.Type
+	}
+	if !known {
+		return nil, errors.New("Unsupported register type: " + sr.Type)
+	}
+
+	regex, err := regexp.Compile(sr.Pattern)
+	if err != nil {
+		return nil, err
+	}
+
+	return &activeResponderConfig{
+		regex:     regex,
+		source:    sr.Source,
+		id:        sr.Id,
+		matchNext: sr.MatchNext,
+		helpCmd:   sr.HelpCmd,
+		help:      sr.Help,
+		priority:  sr.Priority,
+	}, nil
+}
+
+// registered tells whether the source already has the pattern registered,
+// i.e. it registered again after reconnecting
+func (sr *snapshotResponder) registered() bool {
+	routeLock.RLock()
+	defer routeLock.RUnlock()
+
+	for _, group := range activeLists {
+		if group.kind != sr.Type {
+			continue
+		}
+		for eAr := (*group.arl).Front(); eAr != nil; eAr = eAr.Next() {
+			ar := eAr.Value.(*activeResponderConfig)
+			if ar.source == sr.Source && ar.regex.String() == sr.Pattern {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+type connsById []*snapshotConn
+
+func (c connsById) Len() int           { return len(c) }
+func (c connsById) Less(i, j int) bool { return c[i].Id < c[j].Id }
+func (c connsById) Swap(i, j int)      { c[i], c[j] = c[j], c[i] }
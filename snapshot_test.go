@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+func TestSnapshotRestore(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+`)
+	dir, err := ioutil.TempDir("", "priscilla-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if stateStore, err = newFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	logOutput = ioutil.Discard
+	defer setLogLevel("error")
+	if err := setLogLevel("warn"); err != nil {
+		t.Fatal(err)
+	}
+
+	connMap := newConnRegistry()
+	for _, id := range []string{"chat", "deployer"} {
+		identity := &connIdentity{}
+		connMap.claim(id, &connEntry{id: identity, adapter: id == "chat",
+			sender: newConnSender(make(chanEncoder, 10), identity, 10)})
+	}
+	defer connMap.remove("chat")
+	r := &adminRequest{cmd: &commandBlock{Map: map[string]string{
+		"name": "before-upgrade", "responder": "hello", "room": "quiet"}},
+		connMap: connMap}
+
+	maintenance = true
+	if _, err := adminDisable(r); err != nil {
+		t.Fatal(err)
+	}
+	addActiveResponder("prefix", &activeResponderConfig{
+		regex: regexp.MustCompile("^deploy$"), source: "deployer",
+		id: "deploy", helpCmd: "deploy", help: "deploy things"}, true)
+	// temporary ones would be gone by the restore
+	addActiveResponder("prefix", &activeResponderConfig{
+		regex: regexp.MustCompile("^yes$"), source: "deployer",
+		oneShot: true}, true)
+
+	reply, err := adminSnapshot(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if reply != "Snapshot before-upgrade saved: 2 connections, 1 active "+
+		"responders" {
+
+		t.Fatal("Unexpected reply:", reply)
+	}
+
+	// what a restart would leave
+	maintenance = false
+	disabledRooms = make(map[string]map[string]bool)
+	prefixAResponders.Init()
+	setLogLevel("error")
+
+	reply, err = adminRestore(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasSuffix(reply, "1 active responders registered, "+
+		"0 skipped (not engaged or already registered)") {
+
+		t.Fatal("Unexpected reply:", reply)
+	}
+
+	if !maintenance || !disabledRooms["hello"]["quiet"] ||
+		logLevel() != "warn" {
+
+		t.Fatal("State not restored:", maintenance, disabledRooms,
+			logLevel())
+	}
+	if prefixAResponders.Len() != 1 {
+		t.Fatal("Expected one active responder, got:",
+			prefixAResponders.Len())
+	}
+	ar := prefixAResponders.Front().Value.(*activeResponderConfig)
+	if ar.source != "deployer" || ar.id != "deploy" ||
+		ar.regex.String() != "^deploy$" || ar.help != "deploy things" {
+
+		t.Fatal("Unexpected active responder:", *ar)
+	}
+
+	// responders registered again and connections that are gone are skipped
+	for _, gone := range []bool{false, true} {
+		if gone {
+			connMap.remove("deployer")
+			prefixAResponders.Init()
+		}
+		reply, err = adminRestore(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.HasSuffix(reply, "0 active responders registered, "+
+			"1 skipped (not engaged or already registered)") {
+
+			t.Fatal("Unexpected reply:", reply)
+		}
+	}
+}
+
+func TestSnapshotNamedLikeServerState(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+`)
+	dir, err := ioutil.TempDir("", "priscilla-state")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if stateStore, err = newFileStore(dir); err != nil {
+		t.Fatal(err)
+	}
+
+	r := &adminRequest{cmd: &commandBlock{Map: map[string]string{
+		"name": disabledRoomsState, "responder": "hello", "room": "quiet"}},
+		connMap: newConnRegistry()}
+	if _, err := adminDisable(r); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := adminSnapshot(r); err != nil {
+		t.Fatal(err)
+	}
+
+	// the disabled rooms persisted are still there for the next start
+	disabledRooms = make(map[string]map[string]bool)
+	if err := loadDisabledRooms(); err != nil {
+		t.Fatal("Disabled rooms overwritten by the snapshot:", err)
+	}
+	if !disabledRooms["hello"]["quiet"] {
+		t.Fatal("Disabled room lost:", disabledRooms)
+	}
+
+	if _, err := adminRestore(r); err != nil {
+		t.Fatal("Snapshot not restored by its name:", err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"time"
+)
+
+type statsdConfig struct {
+	Host   string `yaml:"host"`
+	Port   int    `yaml:"port"`
+	Prefix string `yaml:"prefix"`
+}
+
+// statsdSink pushes metrics over UDP, a lost packet is a lost sample, sends
+// never block the caller on the collector
+type statsdSink struct {
+	conn   net.Conn
+	prefix string
+}
+
+func newStatsdSink(sc *statsdConfig) (*statsdSink, error) {
+	if sc.Host == "" {
+		return nil, errors.New("Missing statsd host")
+	}
+
+	if sc.Port == 0 {
+		sc.Port = 8125
+	}
+
+	if sc.Prefix == "" {
+		sc.Prefix = "priscilla."
+	}
+
+	conn, err := net.Dial("udp",
+		net.JoinHostPort(sc.Host, strconv.Itoa(sc.Port)))
+	if err != nil {
+		return nil, err
+	}
+
+	return &statsdSink{conn: conn, prefix: sc.Prefix}, nil
+}
+
+// count has no labels to put them in, their values go in the name, i.e.
+// passive.matched.deploy
+func (s *statsdSink) count(name string, value int64, labels []string) {
+	for i := 1; i < len(labels); i += 2 {
+		name += "." + labels[i]
+	}
+	s.send(fmt.Sprintf("%s%s:%d|c", s.prefix, name, value))
+}
+
+func (s *statsdSink) gauge(name string, value int64) {
+	s.send(fmt.Sprintf("%s%s:%d|g", s.prefix, name, value))
+}
+
+func (s *statsdSink) timing(name string, d time.Duration) {
+	s.send(fmt.Sprintf("%s%s:%d|ms", s.prefix, name, d/time.Millisecond))
+}
+
+func (s *statsdSink) send(line string) {
+	if _, err := s.conn.Write([]byte(line)); err != nil {
+		logger.Debug.Println("Unable to send statsd metric:", err)
+	}
+}
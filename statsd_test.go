@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestStatsdLinesAfterTraffic(t *testing.T) {
+	collector, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer collector.Close()
+
+	setupTest(t, `
+responders:
+  passive:
+  - name: hi
+    match: ["^hi$"]
+    cmd: /bin/echo
+    args: ["hello"]
+`)
+	sink, err := newStatsdSink(&statsdConfig{Host: "127.0.0.1",
+		Port: collector.LocalAddr().(*net.UDPAddr).Port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	metricSinks = []metricsSink{sink}
+	defer func() { metricSinks = nil }()
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris hi", "room").handleMessage("adapter", dispatch)
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 {
+		t.Fatal("Expected a reply, got:", got)
+	}
+
+	expected := map[string]bool{
+		"priscilla.messages.received:1|c":             false,
+		"priscilla.messages.matched:1|c":              false,
+		"priscilla.responders.matched.passive.hi:1|c": false,
+		"priscilla.passive.runs:1|c":                  false,
+		"priscilla.passive.duration:":                 false,
+		"priscilla.commands.in_flight:1|g":            false,
+	}
+
+	buf := make([]byte, 1500)
+	collector.SetReadDeadline(time.Now().Add(5 * time.Second))
+	for missing := len(expected); missing > 0; {
+		n, _, err := collector.ReadFrom(buf)
+		if err != nil {
+			t.Fatal("Lines never sent:", expected, err)
+		}
+		line := string(buf[:n])
+		// timings vary, only their names are checked
+		if strings.HasSuffix(line, "|ms") {
+			line = line[:strings.Index(line, ":")+1]
+		}
+		if seen, ok := expected[line]; ok && !seen {
+			expected[line] = true
+			missing--
+		}
+	}
+}
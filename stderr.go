@@ -0,0 +1,55 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"os/exec"
+	"strings"
+)
+
+// maxStderr is how much of a command's stderr is kept for the log
+const maxStderr = 4096
+
+// stderrBuffer keeps the start of a command's stderr, the rest is discarded
+// so a noisy command can't grow it without bound
+type stderrBuffer struct {
+	bytes.Buffer
+}
+
+func (b *stderrBuffer) Write(p []byte) (int, error) {
+	if room := maxStderr - b.Len(); room < len(p) {
+		if room > 0 {
+			b.Buffer.Write(p[:room])
+		}
+		return len(p), nil
+	}
+	return b.Buffer.Write(p)
+}
+
+// commandStderr is the stderr of a command that exited non-zero
+func commandStderr(err error) string {
+	exitErr, ok := err.(*exec.ExitError)
+	if !ok {
+		return ""
+	}
+	return strings.Trim(string(exitErr.Stderr), " \n")
+}
+
+// failureNotice is the short reply for a failed command when the responder
+// has failure-notice set, stderr isn't included, it's only logged
+func (pr *passiveResponderConfig) failureNotice(err error) string {
+	if statusErr, ok := err.(*httpStatusError); ok {
+		return statusErr.notice(pr.Name)
+	}
+
+	status, exited := exitStatus(err)
+	switch {
+	case !exited:
+		return fmt.Sprintf("%s failed to run", pr.Name)
+	case status.Signaled():
+		return fmt.Sprintf("%s was killed by %s", pr.Name, status.Signal())
+	default:
+		return fmt.Sprintf("%s failed with exit code %d", pr.Name,
+			status.ExitStatus())
+	}
+}
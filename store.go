@@ -0,0 +1,61 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// store keeps named blobs of server state across restarts
+type store interface {
+	put(name string, data []byte) error
+	get(name string) ([]byte, error)
+}
+
+// stateStore is nil unless "state-dir" is configured
+var stateStore store
+
+// fileStore keeps every blob in its own file in a directory
+type fileStore struct {
+	dir string
+}
+
+func newFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &fileStore{dir: dir}, nil
+}
+
+func (s *fileStore) path(name string) (string, error) {
+	if name == "" || strings.ContainsAny(name, `/\`) ||
+		strings.HasPrefix(name, ".") {
+
+		return "", errors.New("Invalid state name: " + name)
+	}
+	return filepath.Join(s.dir, name+".json"), nil
+}
+
+// put writes to a temporary file first, so a failed write never leaves a
+// truncated blob behind
+func (s *fileStore) put(name string, data []byte) error {
+	path, err := s.path(name)
+	if err != nil {
+		return err
+	}
+
+	if err := ioutil.WriteFile(path+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+func (s *fileStore) get(name string) ([]byte, error) {
+	path, err := s.path(name)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
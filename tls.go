@@ -0,0 +1,78 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+// tlsHandshakeTimeout bounds the handshake when there's no idle timeout, a
+// client that never finishes it would otherwise hold its connection forever
+const tlsHandshakeTimeout = 10 * time.Second
+
+// handshakeTimeout is the idle timeout if there's one, a client can't take
+// longer to finish the handshake than it may go without sending a query
+func handshakeTimeout() time.Duration {
+	if conf.IdleTimeout > 0 {
+		return time.Duration(conf.IdleTimeout) * time.Second
+	}
+	return tlsHandshakeTimeout
+}
+
+// tlsConfig builds the listener's TLS config, nil when no certificate is
+// configured and the server listens in plain text. With a CA, clients have
+// to present a certificate signed by it.
+func tlsConfig(lc listenConfig) (*tls.Config, error) {
+	if lc.cert == "" && lc.key == "" {
+		if lc.ca != "" {
+			return nil, errors.New("tls-ca needs tls-cert and tls-key")
+		}
+		return nil, nil
+	}
+
+	if lc.cert == "" || lc.key == "" {
+		return nil, errors.New("Both tls-cert and tls-key are needed")
+	}
+
+	cert, err := tls.LoadX509KeyPair(lc.cert, lc.key)
+	if err != nil {
+		return nil, err
+	}
+
+	tc := &tls.Config{Certificates: []tls.Certificate{cert}}
+
+	if lc.ca != "" {
+		pem, err := ioutil.ReadFile(lc.ca)
+		if err != nil {
+			return nil, err
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("No certificate found in " + lc.ca)
+		}
+
+		tc.ClientCAs = pool
+		tc.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+
+	return tc, nil
+}
+
+// keepAliveListener applies the keepalive config to accepted connections,
+// before TLS gets wrapped around them
+type keepAliveListener struct {
+	*net.TCPListener
+}
+
+func (l keepAliveListener) Accept() (net.Conn, error) {
+	conn, err := l.AcceptTCP()
+	if err != nil {
+		return nil, err
+	}
+	setKeepAlive(conn)
+	return conn, nil
+}
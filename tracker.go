@@ -0,0 +1,85 @@
+package main
+
+import (
+	"container/list"
+	"strings"
+)
+
+// routeTracker remembers which responder sent each message or request with an
+// id to an adapter, so the adapter's delivery result or info response can be
+// routed back to it. Adapters aren't required to answer, the oldest entries
+// are dropped once there are more than max of them. It's only used by the
+// dispatcher.
+type routeTracker struct {
+	max     int
+	senders map[string]string
+	order   *list.List
+}
+
+func newRouteTracker(max int) *routeTracker {
+	return &routeTracker{
+		max:     max,
+		senders: make(map[string]string),
+		order:   list.New(),
+	}
+}
+
+// ids are only unique per adapter
+func routeKey(adapter, id string) string {
+	return adapter + "\x00" + id
+}
+
+func (t *routeTracker) track(adapter, id, responder string) {
+	key := routeKey(adapter, id)
+	if _, ok := t.senders[key]; !ok {
+		t.order.PushBack(key)
+	}
+	t.senders[key] = responder
+
+	for t.order.Len() > t.max {
+		delete(t.senders, t.order.Remove(t.order.Front()).(string))
+	}
+}
+
+func (t *routeTracker) pending(adapter, id string) bool {
+	_, ok := t.senders[routeKey(adapter, id)]
+	return ok
+}
+
+// route returns the responder that sent the id and forgets about it
+func (t *routeTracker) route(adapter, id string) (string, bool) {
+	key := routeKey(adapter, id)
+	responder, ok := t.senders[key]
+	if !ok {
+		return "", false
+	}
+
+	delete(t.senders, key)
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		if e.Value.(string) == key {
+			t.order.Remove(e)
+			break
+		}
+	}
+
+	return responder, true
+}
+
+// rename moves everything tracked for or sent by a connection to its new id
+func (t *routeTracker) rename(old, id string) {
+	prefix := routeKey(old, "")
+	for e := t.order.Front(); e != nil; e = e.Next() {
+		key := e.Value.(string)
+		sender := t.senders[key]
+		if sender == old {
+			sender = id
+		}
+
+		if strings.HasPrefix(key, prefix) {
+			delete(t.senders, key)
+			key = routeKey(id, key[len(prefix):])
+			e.Value = key
+		}
+		t.senders[key] = sender
+	}
+}
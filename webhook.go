@@ -0,0 +1,146 @@
+package main
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+type webhookConfig struct {
+	Url      string `yaml:"url"`
+	Messages string `yaml:"messages"`
+	Secret   string `yaml:"secret"`
+	Queue    int    `yaml:"queue"`
+	Retries  int    `yaml:"retries"`
+	Timeout  int    `yaml:"timeout"`
+}
+
+type webhookPayload struct {
+	Source  string        `json:"source"`
+	Time    int64         `json:"time"`
+	Matched bool          `json:"matched"`
+	Message *messageBlock `json:"message"`
+}
+
+type webhookSink struct {
+	conf   *webhookConfig
+	client *http.Client
+	queue  chan []byte
+}
+
+var webhook *webhookSink
+
+func newWebhookSink(wc *webhookConfig) (*webhookSink, error) {
+	if wc.Url == "" {
+		return nil, errors.New("Missing webhook url")
+	}
+
+	switch wc.Messages {
+	case "":
+		wc.Messages = "all"
+	case "all", "unmatched":
+	default:
+		return nil, errors.New("Unsupported webhook messages: " + wc.Messages)
+	}
+
+	if wc.Queue <= 0 {
+		wc.Queue = 100
+	}
+
+	if wc.Retries < 0 {
+		return nil, errors.New("Webhook retries can't be negative")
+	}
+
+	if wc.Timeout <= 0 {
+		wc.Timeout = 5
+	}
+
+	w := &webhookSink{
+		conf:   wc,
+		client: &http.Client{Timeout: time.Duration(wc.Timeout) * time.Second},
+		queue:  make(chan []byte, wc.Queue),
+	}
+
+	go w.run()
+
+	return w, nil
+}
+
+// post queues the message for delivery without blocking, the message is
+// dropped if the queue is full
+func (w *webhookSink) post(source string, m *messageBlock, matched bool) {
+	if matched && w.conf.Messages == "unmatched" {
+		return
+	}
+
+	body, err := json.Marshal(&webhookPayload{
+		Source:  source,
+		Time:    time.Now().Unix(),
+		Matched: matched,
+		Message: m,
+	})
+
+	if err != nil {
+		logger.Error.Println("Unable to encode webhook payload:", err)
+		return
+	}
+
+	select {
+	case w.queue <- body:
+	default:
+		logger.Warn.Println("Webhook queue full, message dropped")
+	}
+}
+
+func (w *webhookSink) run() {
+	for body := range w.queue {
+		for attempt := 0; ; attempt++ {
+			err := w.deliver(body)
+			if err == nil {
+				break
+			}
+
+			if attempt >= w.conf.Retries {
+				logger.Error.Println("Webhook delivery failed, giving up:", err)
+				break
+			}
+
+			logger.Warn.Println("Webhook delivery failed, retrying:", err)
+			time.Sleep(time.Duration(1<<uint(attempt)) * time.Second)
+		}
+	}
+}
+
+func (w *webhookSink) deliver(body []byte) error {
+	req, err := http.NewRequest("POST", w.conf.Url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	if w.conf.Secret != "" {
+		mac := hmac.New(sha256.New, []byte(w.conf.Secret))
+		mac.Write(body)
+		req.Header.Set("X-Priscilla-Signature",
+			"sha256="+hex.EncodeToString(mac.Sum(nil)))
+	}
+
+	resp, err := w.client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return fmt.Errorf("Unexpected webhook response: %s", resp.Status)
+	}
+
+	return nil
+}
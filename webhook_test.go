@@ -0,0 +1,87 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+type webhookDelivery struct {
+	body      []byte
+	signature string
+}
+
+func TestWebhookDeliversSignedUnmatched(t *testing.T) {
+	deliveries := make(chan *webhookDelivery, 10)
+	endpoint := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			deliveries <- &webhookDelivery{body,
+				r.Header.Get("X-Priscilla-Signature")}
+		}))
+	defer endpoint.Close()
+
+	setupTest(t, `
+responders:
+  passive:
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+`)
+	sink, err := newWebhookSink(&webhookConfig{
+		Url:      endpoint.URL,
+		Messages: "unmatched",
+		Secret:   "webhooksecret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	webhook = sink
+	defer func() { webhook = nil }()
+
+	dispatch := make(chan *dispatcherRequest, 10)
+	testMessage("pris hello", "room").handleMessage("adapter", dispatch)
+	testMessage("nobody answers this", "room").handleMessage("adapter",
+		dispatch)
+
+	var d *webhookDelivery
+	select {
+	case d = <-deliveries:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Nothing delivered")
+	}
+
+	mac := hmac.New(sha256.New, []byte("webhooksecret"))
+	mac.Write(d.body)
+	if d.signature != "sha256="+hex.EncodeToString(mac.Sum(nil)) {
+		t.Fatal("Bad signature:", d.signature)
+	}
+
+	var payload webhookPayload
+	if err := json.Unmarshal(d.body, &payload); err != nil {
+		t.Fatal(err)
+	}
+	if payload.Matched || payload.Source != "adapter" ||
+		payload.Message.Message != "nobody answers this" {
+
+		t.Fatal("Unexpected payload:", string(d.body))
+	}
+
+	select {
+	case d := <-deliveries:
+		t.Fatal("Matched message delivered:", string(d.body))
+	case <-time.After(200 * time.Millisecond):
+	}
+
+	// the matched command runs off the config, let it finish before the next
+	// test replaces it
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 {
+		t.Fatal("Matched message wasn't answered")
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"container/list"
+	"encoding/json"
+	"errors"
+	"hash/fnv"
+	"runtime/debug"
+	"sync"
+)
+
+var errWorkQueueFull = errors.New("Worker queue is full")
+
+// workQueue is a FIFO of jobs drained by a single goroutine, the dispatcher
+// must never block when handing work off, otherwise a worker waiting on the
+// dispatcher channel could deadlock it, so jobs past max are dropped instead
+type workQueue struct {
+	lock  sync.Mutex
+	ready *sync.Cond
+	jobs  *list.List
+	max   int
+}
+
+// workerPool runs the matching for messages and commands, jobs only decide
+// what to do, passive responder commands are run on their own goroutines so
+// a slow one doesn't hold up the jobs queued behind it
+type workerPool struct {
+	queues []*workQueue
+}
+
+func newWorkerPool(size, queue int) *workerPool {
+	if size < 1 {
+		size = 1
+	}
+
+	pool := &workerPool{queues: make([]*workQueue, size)}
+
+	for i := range pool.queues {
+		q := &workQueue{jobs: list.New(), max: queue}
+		q.ready = sync.NewCond(&q.lock)
+		pool.queues[i] = q
+		go q.run()
+	}
+
+	return pool
+}
+
+// submit queues the job on the worker owning the key, jobs submitted with
+// the same key (connection source id) always run in submission order, the
+// job is dropped if the worker's queue is full
+func (p *workerPool) submit(key string, job func()) error {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	q := p.queues[h.Sum32()%uint32(len(p.queues))]
+
+	q.lock.Lock()
+	if q.jobs.Len() >= q.max {
+		q.lock.Unlock()
+		logger.Error.Println("Worker queue full, dropping job from", key)
+		countMetric("workers.dropped", 1)
+		return errWorkQueueFull
+	}
+	q.jobs.PushBack(job)
+	q.lock.Unlock()
+	q.ready.Signal()
+	return nil
+}
+
+func (q *workQueue) run() {
+	for {
+		q.lock.Lock()
+		for q.jobs.Len() == 0 {
+			q.ready.Wait()
+		}
+		job := q.jobs.Remove(q.jobs.Front()).(func())
+		q.lock.Unlock()
+
+		job()
+	}
+}
+
+// recoverJob is deferred by jobs so one that panics is logged along with
+// what it was handling instead of taking the whole server down
+func recoverJob(handling interface{}) {
+	r := recover()
+	if r == nil {
+		return
+	}
+
+	dump, err := json.Marshal(handling)
+	if err != nil {
+		dump = []byte(err.Error())
+	}
+	logger.Error.Println("Recovered from panic:", r, "while handling:",
+		string(dump))
+	logger.Error.Println(string(debug.Stack()))
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestWorkerPoolKeepsOrderPerKey(t *testing.T) {
+	pool := newWorkerPool(4, 10000)
+
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	seen := make(map[string][]int)
+
+	for i := 0; i < 500; i++ {
+		for k := 0; k < 16; k++ {
+			key, i := fmt.Sprintf("conn-%d", k), i
+			wg.Add(1)
+			pool.submit(key, func() {
+				defer wg.Done()
+				lock.Lock()
+				seen[key] = append(seen[key], i)
+				lock.Unlock()
+			})
+		}
+	}
+	wg.Wait()
+
+	for key, order := range seen {
+		for i, n := range order {
+			if n != i {
+				t.Fatalf("%s ran job %d as number %d", key, n, i)
+			}
+		}
+	}
+}
+
+func TestWorkerPoolDropsPastQueueLimit(t *testing.T) {
+	pool := newWorkerPool(1, 2)
+
+	block := make(chan struct{})
+	running := make(chan struct{})
+	pool.submit("a", func() {
+		close(running)
+		<-block
+	})
+	<-running
+
+	for i := 0; i < 2; i++ {
+		if err := pool.submit("a", func() {}); err != nil {
+			t.Fatal("Job within the limit dropped:", err)
+		}
+	}
+	if err := pool.submit("a", func() {}); err != errWorkQueueFull {
+		t.Fatal("Job past the limit not dropped:", err)
+	}
+	close(block)
+}
+
+func TestSlowCommandDoesNotHoldUpSource(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: slow
+    match: ["^slow$"]
+    cmd: /bin/sh
+    args: ["-c", "sleep 2; echo slow"]
+  - name: fast
+    match: ["^fast$"]
+    cmd: /bin/echo
+    args: ["fast"]
+`)
+	workers = newWorkerPool(1, 1000)
+	dispatch := make(chan *dispatcherRequest, 10)
+
+	var wg sync.WaitGroup
+	start := time.Now()
+	for _, text := range []string{"pris slow", "pris fast"} {
+		m := testMessage(text, "room")
+		wg.Add(1)
+		workers.submit("adapter", func() {
+			defer wg.Done()
+			m.handleMessage("adapter", dispatch)
+		})
+	}
+
+	got := collectReplies(t, dispatch, 1, 5*time.Second)
+	if len(got) != 1 || got[0] != "fast" {
+		t.Fatal("Expected the fast reply, got:", got)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatal("Fast reply waited on the slow command:", elapsed)
+	}
+
+	// the slow one is still running off the config, let it finish before
+	// the next test replaces it
+	wg.Wait()
+	if got := collectReplies(t, dispatch, 1, 5*time.Second); len(got) != 1 ||
+		got[0] != "slow" {
+
+		t.Fatal("Expected the slow reply, got:", got)
+	}
+}
+
+func TestPanickingJobKeepsServerUp(t *testing.T) {
+	setupTest(t, `
+responders:
+  passive:
+  - name: broken
+    match: ["^broken$"]
+    cmd: /bin/echo
+  - name: hello
+    match: ["^hello$"]
+    cmd: /bin/echo
+    args: ["hello"]
+`)
+	// a schedule that skipped parsing has no location, checking it panics in
+	// the job of the message that matched
+	findPassiveResponder("broken").Schedule = &scheduleConfig{}
+
+	out := &syncBuffer{}
+	logOutput = out
+	defer func() {
+		logOutput = ioutil.Discard
+		setLogLevel("error")
+	}()
+	if err := setLogLevel("error"); err != nil {
+		t.Fatal(err)
+	}
+
+	dispatch := startDispatcher(t)
+	adapter := engageAs(t, dispatch, "chat", "adapter")
+
+	for _, text := range []string{"pris broken", "pris hello"} {
+		dispatch <- &dispatcherRequest{Query: &query{
+			Type:    "message",
+			Source:  "chat",
+			Message: testMessage(text, "room"),
+		}}
+	}
+	if q := adapter.next(t, "message"); q.Message.Message != "hello" {
+		t.Fatal("Unexpected message:", *q.Message)
+	}
+
+	logged := out.String()
+	for _, part := range []string{"Recovered from panic:",
+		`"message":"pris broken"`, "goroutine"} {
+
+		if !strings.Contains(logged, part) {
+			t.Errorf("Panic log is missing %q:\n%s", part, logged)
+		}
+	}
+
+	done := make(chan struct{})
+	workers.submit("chat", func() { close(done) })
+	<-done
+}
+
+// BenchmarkWorkerPool matches messages from many connections, throughput
+// should go up with the number of workers on a multi-core host
+func BenchmarkWorkerPool(b *testing.B) {
+	rg := regexp.MustCompile(`^(deploy|rollback) (\S+) to (\w+)( now)?$`)
+	text := "deploy priscilla-server-with-a-long-name to production now"
+
+	for _, size := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("workers-%d", size), func(b *testing.B) {
+			pool := newWorkerPool(size, b.N+1)
+			var wg sync.WaitGroup
+			wg.Add(b.N)
+
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				pool.submit(fmt.Sprintf("conn-%d", i%64), func() {
+					defer wg.Done()
+					for j := 0; j < 20; j++ {
+						rg.FindStringSubmatch(text)
+					}
+				})
+			}
+			wg.Wait()
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"sync"
+	"time"
+)
+
+// flushWriter coalesces writes to a connection, the buffer is flushed when
+// it fills up or when the flush interval has elapsed since the first
+// unflushed write, whichever comes first
+type flushWriter struct {
+	lock     sync.Mutex
+	buf      *bufio.Writer
+	interval time.Duration
+	timer    *time.Timer
+}
+
+func newFlushWriter(w io.Writer, size int,
+	interval time.Duration) *flushWriter {
+
+	return &flushWriter{
+		buf:      bufio.NewWriterSize(w, size),
+		interval: interval,
+	}
+}
+
+func (w *flushWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	n, err := w.buf.Write(p)
+
+	if w.buf.Buffered() == 0 {
+		w.stopTimer()
+	} else if w.timer == nil {
+		w.timer = time.AfterFunc(w.interval, func() { w.Flush() })
+	}
+
+	return n, err
+}
+
+func (w *flushWriter) Flush() error {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+
+	w.stopTimer()
+	return w.buf.Flush()
+}
+
+func (w *flushWriter) stopTimer() {
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
+}
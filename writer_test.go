@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"sync"
+	"testing"
+	"time"
+)
+
+// countingWriter counts the writes reaching it, each would be a syscall on
+// a connection
+type countingWriter struct {
+	lock   sync.Mutex
+	writes int
+	buf    bytes.Buffer
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	w.writes++
+	return w.buf.Write(p)
+}
+
+func (w *countingWriter) written() (int, string) {
+	w.lock.Lock()
+	defer w.lock.Unlock()
+	return w.writes, w.buf.String()
+}
+
+func TestFlushWriterFlushesWithinInterval(t *testing.T) {
+	out := &countingWriter{}
+	w := newFlushWriter(out, 4096, 20*time.Millisecond)
+	encoder := json.NewEncoder(w)
+
+	for i := 0; i < 10; i++ {
+		encoder.Encode(priorityMessage("hello", 0))
+	}
+	if writes, _ := out.written(); writes != 0 {
+		t.Fatal("Written before the flush interval:", writes)
+	}
+
+	time.Sleep(100 * time.Millisecond)
+	writes, data := out.written()
+	if writes != 1 {
+		t.Fatal("Expected one coalesced write, got", writes)
+	}
+
+	decoder := json.NewDecoder(bytes.NewBufferString(data))
+	for i := 0; i < 10; i++ {
+		var q query
+		if err := decoder.Decode(&q); err != nil ||
+			q.Message.Message != "hello" {
+
+			t.Fatal("Message", i, "didn't arrive intact:", err)
+		}
+	}
+}
+
+// BenchmarkConnectionWrites reports the writes reaching the connection per
+// message with and without a write buffer
+func BenchmarkConnectionWrites(b *testing.B) {
+	for _, size := range []int{0, 4096} {
+		b.Run(map[int]string{0: "unbuffered", 4096: "buffered"}[size],
+			func(b *testing.B) {
+				out := &countingWriter{}
+				var w io.Writer = out
+				if size > 0 {
+					w = newFlushWriter(out, size, 10*time.Millisecond)
+				}
+				encoder := json.NewEncoder(w)
+				q := priorityMessage("a line of chatter from the bot", 0)
+
+				for i := 0; i < b.N; i++ {
+					encoder.Encode(q)
+				}
+				if f, ok := w.(*flushWriter); ok {
+					f.Flush()
+				}
+
+				writes, _ := out.written()
+				b.ReportMetric(float64(writes)/float64(b.N), "writes/op")
+			})
+	}
+}